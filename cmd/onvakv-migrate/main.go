@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coinexchain/onvakv/datatree"
+	"github.com/coinexchain/onvakv/logging"
+)
+
+// Rewrite the files of an OnvaKV directory into the on-disk format of this version.
+// OnvaKV must be closed before running it.
+func main() {
+	check := flag.Bool("check", false, "only print the format versions of the files")
+	cold := flag.String("cold", "", "the directory of the DirColdStore holding the old segments")
+	keys := flag.String("keys", "", "the file of the encryption keys, one '<key-id> <hex-key>' per line")
+	keyID := flag.Uint("key-id", 0, "the key ID for the rewritten segments, the largest one in -keys by default")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-check] [-cold <dir>] [-keys <file> [-key-id <id>]] <onvakv-dir>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dirName := flag.Arg(0)
+	if *check {
+		if err := printVersions(dirName); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	var opts datatree.HPFileOptions
+	if *cold != "" {
+		coldStore, err := datatree.NewDirColdStore(*cold)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		opts.ColdStore = coldStore
+	}
+	if *keys != "" {
+		encryption, err := loadKeyFile(*keys, uint32(*keyID))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		opts.Encryption = encryption
+	}
+	logger := logging.NewJSONLogger(os.Stdout, logging.InfoLevel)
+	if err := datatree.MigrateDirWithOptions(dirName, logger, opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s is in format version %d\n", dirName, datatree.FormatVersion)
+}
+
+// Load the keys for the encrypted segments. Empty lines and the lines beginning with '#' are
+// ignored. The new segments are encrypted with keyID, or the largest ID if it is 0.
+func loadKeyFile(fname string, keyID uint32) (*datatree.Encryption, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keyMap := make(map[uint32][]byte)
+	largest := uint32(0)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expect '<key-id> <hex-key>'", fname, lineNum)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("%s:%d: invalid key ID %s", fname, lineNum, fields[0])
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", fname, lineNum, err)
+		}
+		keyMap[uint32(id)] = key
+		if uint32(id) > largest {
+			largest = uint32(id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if keyID == 0 {
+		keyID = largest
+	}
+	if _, ok := keyMap[keyID]; !ok {
+		return nil, fmt.Errorf("Key %d is not in %s", keyID, fname)
+	}
+	return &datatree.Encryption{
+		KeyID: keyID,
+		GetKey: func(id uint32) ([]byte, error) {
+			if key, ok := keyMap[id]; ok {
+				return key, nil
+			}
+			return nil, fmt.Errorf("Key %d is not in %s", id, fname)
+		},
+	}, nil
+}
+
+func printVersions(dirName string) error {
+	for _, pattern := range []string{"entries/*", "twigmt/*"} {
+		paths, err := filepath.Glob(filepath.Join(dirName, pattern))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if fileInfo, err := os.Stat(path); err == nil && fileInfo.IsDir() {
+				continue // the tail records of encryption
+			}
+			if err := printVersion(path, true); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range []string{"twigs.dat", "nodes.dat", "mtree4YT.dat"} {
+		path := filepath.Join(dirName, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := printVersion(path, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printVersion(path string, isSegment bool) error {
+	version, err := datatree.FileFormatVersion(path, isSegment)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%d\n", path, version)
+	return nil
+}
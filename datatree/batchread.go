@@ -0,0 +1,258 @@
+package datatree
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// The alignment of the offsets, lengths and buffers of the reads with O_DIRECT
+	directIOAlign = 4096
+	// The default number of reads in flight in ReadBatch
+	DefaultBatchReadDepth = 64
+	// The bytes read for each entry at first in ReadEntries. The longer entries are read again.
+	entryFirstReadSize = 512
+)
+
+// A request of ReadBatch. Buf[:N] is filled with the bytes at Off. N is less than len(Buf) only
+// when the segment ends before.
+type ReadReq struct {
+	Off int64
+	Buf []byte
+	N   int
+}
+
+// A read submitted to the OS. io.EOF is not taken as an error.
+type ioReq struct {
+	f       *os.File
+	off     int64
+	buf     []byte
+	n       int
+	err     error
+	aligned bool // whether buf is an aligned copy of the requested range
+	skip    int  // the bytes before the requested range in an aligned buf
+	idx     int  // index in the requests of ReadBatch
+}
+
+func (r *ioReq) pread() {
+	r.n, r.err = r.f.ReadAt(r.buf, r.off)
+	if r.err == io.EOF {
+		r.err = nil
+	}
+}
+
+// Return a buffer of size bytes, whose address is aligned for O_DIRECT
+func alignedBuf(size int) []byte {
+	b := make([]byte, size+directIOAlign)
+	rem := int(uintptr(unsafe.Pointer(&b[0])) % directIOAlign)
+	skip := 0
+	if rem != 0 {
+		skip = directIOAlign - rem
+	}
+	return b[skip : skip+size : skip+size]
+}
+
+// Issue the reads with up to depth of them in flight
+func preadAll(ios []ioReq, depth int) {
+	if depth > len(ios) {
+		depth = len(ios)
+	}
+	sharedIdx := int64(-1)
+	ParrallelRun(depth, func(workerID int) {
+		for {
+			myIdx := atomic.AddInt64(&sharedIdx, 1)
+			if myIdx >= int64(len(ios)) {
+				return
+			}
+			ios[myIdx].pread()
+		}
+	})
+}
+
+// Return the file of the segment with id opened with O_DIRECT, or nil if it is unavailable
+func (hpf *HPFile) directFile(id int) *os.File {
+	if !hpf.directIO {
+		return nil
+	}
+	hpf.directMtx.Lock()
+	defer hpf.directMtx.Unlock()
+	if f, ok := hpf.directFiles[id]; ok {
+		return f
+	}
+	fname := fmt.Sprintf("%s/%d-%d", hpf.dirName, id, hpf.blockSize)
+	f, err := openDirect(fname)
+	if err != nil { // e.g. tmpfs does not support O_DIRECT
+		hpf.logger.Info("O_DIRECT is unavailable", "fileName", fname, "err", err)
+		f = nil
+	}
+	hpf.directFiles[id] = f
+	return f
+}
+
+// Close the file opened with O_DIRECT for the segment with id, which will be removed
+func (hpf *HPFile) closeDirect(id int) error {
+	hpf.directMtx.Lock()
+	defer hpf.directMtx.Unlock()
+	f := hpf.directFiles[id]
+	delete(hpf.directFiles, id)
+	if f != nil {
+		return f.Close()
+	}
+	return nil
+}
+
+// Read many ranges of the HPFile at once. Up to BatchReadDepth reads are in flight, and they
+// are submitted with O_DIRECT and io_uring if enabled in the HPFileOptions. The encrypted
+// segments and the ones in the cold tier are read with ordinary positional reads.
+func (hpf *HPFile) ReadBatch(reqs []ReadReq) error {
+	hpf.mtx.RLock()
+	defer hpf.mtx.RUnlock()
+	var ios []ioReq
+	var others []int // the requests read by readSegment
+	for i := range reqs {
+		r := &reqs[i]
+		r.N = 0
+		if len(r.Buf) == 0 {
+			continue
+		}
+		if m, ok := hpf.mapped(r.Off, len(r.Buf)); ok {
+			r.N = copy(r.Buf, m)
+			continue
+		}
+		fileID := int(r.Off / int64(hpf.blockSize))
+		pos := r.Off % int64(hpf.blockSize)
+		if _, ok := hpf.segmentReader(fileID); !ok {
+			return fmt.Errorf("Can not find the file with id=%d (%d/%d)", fileID, r.Off, hpf.blockSize)
+		}
+		f, ok := hpf.fileMap[fileID]
+		if !ok || hpf.aeads[fileID] != nil {
+			others = append(others, i)
+			continue
+		}
+		req := ioReq{f: f, off: pos + hpf.headerSizes[fileID], buf: r.Buf, idx: i}
+		if df := hpf.directFile(fileID); df != nil {
+			start := req.off &^ (directIOAlign - 1)
+			end := (req.off + int64(len(r.Buf)) + directIOAlign - 1) &^ (directIOAlign - 1)
+			req.f, req.buf, req.skip = df, alignedBuf(int(end-start)), int(req.off-start)
+			req.aligned = true
+			req.off = start
+		}
+		ios = append(ios, req)
+	}
+	errs := make([]error, len(others))
+	done := make(chan struct{})
+	go func() {
+		sharedIdx := int64(-1)
+		workers := hpf.batchReadDepth
+		if workers > len(others) {
+			workers = len(others)
+		}
+		ParrallelRun(workers, func(workerID int) {
+			for {
+				myIdx := atomic.AddInt64(&sharedIdx, 1)
+				if myIdx >= int64(len(others)) {
+					return
+				}
+				r := &reqs[others[myIdx]]
+				fileID := int(r.Off / int64(hpf.blockSize))
+				f, _ := hpf.segmentReader(fileID)
+				r.N, errs[myIdx] = hpf.readSegment(fileID, f, r.Buf, r.Off%int64(hpf.blockSize))
+				if errs[myIdx] == io.EOF {
+					errs[myIdx] = nil
+				}
+			}
+		})
+		close(done)
+	}()
+	var err error
+	if hpf.ring != nil {
+		err = hpf.ring.readAll(ios)
+	} else {
+		preadAll(ios, hpf.batchReadDepth)
+	}
+	<-done
+	if err != nil {
+		return err
+	}
+	for _, e := range errs {
+		if e != nil {
+			return e
+		}
+	}
+	for i := range ios {
+		req := &ios[i]
+		if req.err != nil {
+			return req.err
+		}
+		r := &reqs[req.idx]
+		n := req.n - req.skip
+		if n < 0 {
+			n = 0
+		} else if n > len(r.Buf) {
+			n = len(r.Buf)
+		}
+		if req.aligned {
+			copy(r.Buf, req.buf[req.skip:req.skip+n])
+		}
+		r.N = n
+	}
+	return nil
+}
+
+// Read the entries at positions. It is much faster than calling ReadEntry one by one, because
+// many reads are in flight at the same time, which is what SSDs need to reach their IOPS. The
+// entries at positions with hints are read in one go.
+func (ef *EntryFile) ReadEntries(positions []int64) []*Entry {
+	reqs := make([]ReadReq, len(positions))
+	for i, pos := range positions {
+		off, hintLen := UnpackEntryPos(pos)
+		if hintLen < 12 {
+			hintLen = entryFirstReadSize
+		}
+		reqs[i] = ReadReq{Off: off, Buf: make([]byte, hintLen)}
+	}
+	err := ef.HPFile.ReadBatch(reqs)
+	if err != nil {
+		panic(err)
+	}
+	var longReqs []ReadReq
+	var longIdx []int
+	for i := range reqs {
+		off := reqs[i].Off
+		if reqs[i].N < 12 {
+			panic(fmt.Sprintf("Can not read the entry at %d(0x%x)", off, off))
+		}
+		length, _ := parseMagicBytesAndLength(off, reqs[i].Buf)
+		total := 12 + int(length)
+		if total <= reqs[i].N {
+			reqs[i].Buf = reqs[i].Buf[:total]
+			continue
+		}
+		// The whole entry is read again, because its later part may be beyond the end of
+		// blockSize, whose offsets would point to the next segment.
+		longReqs = append(longReqs, ReadReq{Off: off, Buf: make([]byte, total)})
+		longIdx = append(longIdx, i)
+	}
+	if len(longReqs) != 0 {
+		err = ef.HPFile.ReadBatch(longReqs)
+		if err != nil {
+			panic(err)
+		}
+		for j, r := range longReqs {
+			if r.N != len(r.Buf) {
+				panic(fmt.Sprintf("Can not read the entry at %d(0x%x)", r.Off, r.Off))
+			}
+			reqs[longIdx[j]].Buf = r.Buf
+		}
+	}
+	entries := make([]*Entry, len(positions))
+	for i := range reqs {
+		b := reqs[i].Buf[12:] // ignore magicbytes and length
+		n := recoverMagicBytes(b)
+		entries[i], _ = EntryFromBytes(b[n:], 0)
+	}
+	return entries
+}
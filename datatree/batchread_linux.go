@@ -0,0 +1,154 @@
+package datatree
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+func openDirect(fname string) (*os.File, error) {
+	return os.OpenFile(fname, os.O_RDONLY|syscall.O_DIRECT, 0)
+}
+
+// The ABI of io_uring, from include/uapi/linux/io_uring.h
+const (
+	sysIOURingSetup = 425
+	sysIOURingEnter = 426
+
+	iouringOffSQRing = 0
+	iouringOffCQRing = 0x8000000
+	iouringOffSQEs   = 0x10000000
+
+	iouringEnterGetEvents = 1
+	iouringOpRead         = 22 // since Linux 5.6
+
+	iouringSQESize = 64
+	iouringCQESize = 16
+)
+
+type iouringSQRingOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	resv2                                                           uint64
+}
+
+type iouringCQRingOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	resv2                                                           uint64
+}
+
+type iouringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  iouringSQRingOffsets
+	cqOff                                                                  iouringCQRingOffsets
+}
+
+// A minimal io_uring which only submits reads. It is used by one ReadBatch at a time.
+type uring struct {
+	mtx       sync.Mutex
+	fd        int
+	params    iouringParams
+	sqRing    []byte
+	cqRing    []byte
+	sqes      []byte
+	sqEntries uint32
+	cqEntries uint32
+}
+
+func newURing(entries uint32) (*uring, error) {
+	r := &uring{}
+	fd, _, errno := syscall.Syscall(sysIOURingSetup, uintptr(entries), uintptr(unsafe.Pointer(&r.params)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	r.fd = int(fd)
+	p := &r.params
+	r.sqEntries, r.cqEntries = p.sqEntries, p.cqEntries
+	var err error
+	prot, flags := syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE
+	r.sqRing, err = syscall.Mmap(r.fd, iouringOffSQRing, int(p.sqOff.array+p.sqEntries*4), prot, flags)
+	if err == nil {
+		r.cqRing, err = syscall.Mmap(r.fd, iouringOffCQRing, int(p.cqOff.cqes+p.cqEntries*iouringCQESize), prot, flags)
+	}
+	if err == nil {
+		r.sqes, err = syscall.Mmap(r.fd, iouringOffSQEs, int(p.sqEntries*iouringSQESize), prot, flags)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *uring) Close() error {
+	for _, b := range [][]byte{r.sqRing, r.cqRing, r.sqes} {
+		if b != nil {
+			syscall.Munmap(b)
+		}
+	}
+	return syscall.Close(r.fd)
+}
+
+func u32At(b []byte, off uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&b[off]))
+}
+
+// Submit the reads and wait for all of them. A read is retried with pread if the kernel
+// does not support it in io_uring.
+func (r *uring) readAll(ios []ioReq) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	p := &r.params
+	sqHead, sqTail := u32At(r.sqRing, p.sqOff.head), u32At(r.sqRing, p.sqOff.tail)
+	sqMask := *u32At(r.sqRing, p.sqOff.ringMask)
+	cqHead, cqTail := u32At(r.cqRing, p.cqOff.head), u32At(r.cqRing, p.cqOff.tail)
+	cqMask := *u32At(r.cqRing, p.cqOff.ringMask)
+	submitted, completed, inFlight := 0, 0, uint32(0)
+	for completed < len(ios) {
+		tail := atomic.LoadUint32(sqTail)
+		for submitted < len(ios) && inFlight < r.cqEntries && tail-atomic.LoadUint32(sqHead) < r.sqEntries {
+			idx := tail & sqMask
+			sqe := r.sqes[idx*iouringSQESize : (idx+1)*iouringSQESize]
+			for i := range sqe {
+				sqe[i] = 0
+			}
+			req := &ios[submitted]
+			sqe[0] = iouringOpRead
+			*(*int32)(unsafe.Pointer(&sqe[4])) = int32(req.f.Fd())
+			*(*uint64)(unsafe.Pointer(&sqe[8])) = uint64(req.off)
+			*(*uint64)(unsafe.Pointer(&sqe[16])) = uint64(uintptr(unsafe.Pointer(&req.buf[0])))
+			*(*uint32)(unsafe.Pointer(&sqe[24])) = uint32(len(req.buf))
+			*(*uint64)(unsafe.Pointer(&sqe[32])) = uint64(submitted)
+			*u32At(r.sqRing, p.sqOff.array+idx*4) = idx
+			tail++
+			submitted++
+			inFlight++
+		}
+		atomic.StoreUint32(sqTail, tail)
+		toSubmit := tail - atomic.LoadUint32(sqHead)
+		_, _, errno := syscall.Syscall6(sysIOURingEnter, uintptr(r.fd), uintptr(toSubmit), 1,
+			iouringEnterGetEvents, 0, 0)
+		if errno != 0 && errno != syscall.EINTR && errno != syscall.EAGAIN && errno != syscall.EBUSY {
+			return errno
+		}
+		head := atomic.LoadUint32(cqHead)
+		for ; head != atomic.LoadUint32(cqTail); head++ {
+			cqe := r.cqRing[p.cqOff.cqes+(head&cqMask)*iouringCQESize:]
+			req := &ios[*(*uint64)(unsafe.Pointer(&cqe[0]))]
+			res := *(*int32)(unsafe.Pointer(&cqe[8]))
+			if res >= 0 {
+				req.n = int(res)
+			} else if errno := syscall.Errno(-res); errno == syscall.EINVAL || errno == syscall.EOPNOTSUPP {
+				req.pread()
+			} else {
+				req.err = errno
+			}
+			completed++
+			inFlight--
+		}
+		atomic.StoreUint32(cqHead, head)
+	}
+	return nil
+}
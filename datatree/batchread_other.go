@@ -0,0 +1,28 @@
+// +build !linux
+
+package datatree
+
+import (
+	"errors"
+	"os"
+)
+
+var errNotLinux = errors.New("Only supported on Linux")
+
+func openDirect(fname string) (*os.File, error) {
+	return nil, errNotLinux
+}
+
+type uring struct{}
+
+func newURing(entries uint32) (*uring, error) {
+	return nil, errNotLinux
+}
+
+func (r *uring) readAll(ios []ioReq) error {
+	return errNotLinux
+}
+
+func (r *uring) Close() error {
+	return nil
+}
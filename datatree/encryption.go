@@ -0,0 +1,327 @@
+package datatree
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The plaintext of an encrypted segment is split into chunks of EncryptionChunkSize bytes. Each
+// chunk is stored as a 12-byte random nonce, the ciphertext and a 16-byte tag of AES-GCM, whose
+// additional data are the segment's ID and the chunk's index. The last chunk of a closed segment
+// may be shorter.
+//
+// A written chunk is never overwritten. The last partial chunk of the latest segment is not in
+// the segment. Instead, it is sealed into a tail record at each flush, which replaces the old
+// record by renaming. The record holds the segment's ID and the chunk's index in 16 bytes, and
+// then the sealed chunk, which may have no plaintext. The chunks at and after the index are not
+// flushed completely, so they are dropped when opening the HPFile. When a new segment is created,
+// the partial chunk is appended to the previous segment, which becomes closed.
+const (
+	EncryptionChunkSize = 4096
+	encNonceSize        = 12
+	encTagSize          = 16
+	encChunkOverhead    = encNonceSize + encTagSize
+	encChunkPhysSize    = EncryptionChunkSize + encChunkOverhead
+	encTailDir          = "enctail"
+	encTailName         = "tail"
+)
+
+// Encryption encrypts the new segments of a HPFile. The ID of the key is recorded in each
+// segment's header, so keys can be rotated: old segments are still read with their own keys.
+type Encryption struct {
+	// The key ID for new segments. It must not be 0, which marks plaintext segments.
+	KeyID uint32
+	// Return the 16, 24 or 32-byte AES key with the ID
+	GetKey func(keyID uint32) ([]byte, error)
+}
+
+func (hpf *HPFile) newAEAD(keyID uint32) (cipher.AEAD, error) {
+	if hpf.encryption == nil || hpf.encryption.GetKey == nil {
+		return nil, fmt.Errorf("No key is provided for the segments encrypted with key %d", keyID)
+	}
+	key, err := hpf.encryption.GetKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkAD(id int, idx int64) []byte {
+	var ad [16]byte
+	binary.LittleEndian.PutUint64(ad[:8], uint64(id))
+	binary.LittleEndian.PutUint64(ad[8:], uint64(idx))
+	return ad[:]
+}
+
+// Read from the segment with id, like os.File.ReadAt, but pos excludes the header
+func (hpf *HPFile) readSegment(id int, f io.ReaderAt, buf []byte, pos int64) (int, error) {
+	aead := hpf.aeads[id]
+	if aead == nil {
+		return f.ReadAt(buf, pos+hpf.headerSizes[id])
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	tailIdx := int64(-1) // the chunk kept in hpf.tail
+	if id == hpf.largestID {
+		tailIdx = hpf.writtenSize / EncryptionChunkSize
+	}
+	first := pos / EncryptionChunkSize
+	last := (pos + int64(len(buf)) - 1) / EncryptionChunkSize
+	phys := make([]byte, (last-first+1)*encChunkPhysSize)
+	m, err := f.ReadAt(phys, hpf.headerSizes[id]+first*encChunkPhysSize)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	phys = phys[:m]
+	n := 0
+	for idx := first; idx <= last; idx++ {
+		plain := hpf.tail
+		if idx != tailIdx {
+			if len(phys) == 0 {
+				break
+			}
+			c := phys
+			if len(c) > encChunkPhysSize {
+				c = c[:encChunkPhysSize]
+			}
+			phys = phys[len(c):]
+			if plain, err = openChunk(aead, id, idx, c); err != nil {
+				return n, err
+			}
+		}
+		off := 0
+		if idx == first {
+			off = int(pos % EncryptionChunkSize)
+		}
+		if off >= len(plain) {
+			break
+		}
+		n += copy(buf[n:], plain[off:])
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func openChunk(aead cipher.AEAD, id int, idx int64, c []byte) ([]byte, error) {
+	if len(c) < encChunkOverhead {
+		return nil, fmt.Errorf("Truncated chunk %d in segment %d", idx, id)
+	}
+	plain, err := aead.Open(nil, c[:encNonceSize], c[encNonceSize:], chunkAD(id, idx))
+	if err != nil {
+		return nil, fmt.Errorf("Chunk %d in segment %d: %w", idx, id, err)
+	}
+	return plain, nil
+}
+
+func sealChunk(aead cipher.AEAD, id int, idx int64, plain []byte) ([]byte, error) {
+	c := make([]byte, encNonceSize, encChunkOverhead+len(plain))
+	if _, err := rand.Read(c); err != nil {
+		return nil, err
+	}
+	return aead.Seal(c, c[:encNonceSize], plain, chunkAD(id, idx)), nil
+}
+
+// Write data to the end of the latest segment. Only the full chunks are written to an encrypted
+// segment, and the remaining bytes are kept in hpf.tail until the next flush.
+func (hpf *HPFile) writeLatest(data []byte) error {
+	id := hpf.largestID
+	f := hpf.fileMap[id]
+	aead := hpf.aeads[id]
+	if aead == nil {
+		_, err := f.Write(data)
+		hpf.writtenSize += int64(len(data))
+		return err
+	}
+	hpf.tailDirty = true
+	for len(data) > 0 {
+		idx := hpf.writtenSize / EncryptionChunkSize
+		inChunk := int(hpf.writtenSize % EncryptionChunkSize)
+		n := EncryptionChunkSize - inChunk
+		if n > len(data) {
+			n = len(data)
+		}
+		plain := append(hpf.tail[:inChunk:inChunk], data[:n]...)
+		if len(plain) < EncryptionChunkSize {
+			hpf.tail = plain
+		} else if err := hpf.writeChunk(id, idx, plain); err != nil {
+			return err
+		} else {
+			hpf.tail = nil
+		}
+		hpf.writtenSize += int64(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+func (hpf *HPFile) writeChunk(id int, idx int64, plain []byte) error {
+	c, err := sealChunk(hpf.aeads[id], id, idx, plain)
+	if err != nil {
+		return err
+	}
+	_, err = hpf.fileMap[id].WriteAt(c, hpf.headerSizes[id]+idx*encChunkPhysSize)
+	return err
+}
+
+// Append the partial chunk to the latest segment, which will not be written any more
+func (hpf *HPFile) closeTail() error {
+	id := hpf.largestID
+	if hpf.aeads[id] == nil || len(hpf.tail) == 0 {
+		return nil
+	}
+	err := hpf.writeChunk(id, hpf.writtenSize/EncryptionChunkSize, hpf.tail)
+	if err == nil {
+		err = hpf.fileMap[id].Sync()
+	}
+	return err
+}
+
+// Replace the tail record with the one of the latest segment. The chunks before the tail must
+// have been synced.
+func (hpf *HPFile) saveTail() error {
+	id := hpf.largestID
+	idx := hpf.writtenSize / EncryptionChunkSize
+	c, err := sealChunk(hpf.aeads[id], id, idx, hpf.tail)
+	if err != nil {
+		return err
+	}
+	rec := make([]byte, 16, 16+len(c))
+	binary.LittleEndian.PutUint64(rec[:8], uint64(id))
+	binary.LittleEndian.PutUint64(rec[8:], uint64(idx))
+	rec = append(rec, c...)
+	dir := filepath.Join(hpf.dirName, encTailDir)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmpName := filepath.Join(dir, encTailName+".tmp")
+	f, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(rec)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filepath.Join(dir, encTailName))
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err == nil {
+		hpf.tailDirty = false
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Read the tail record of the latest segment. A negative idx is returned if there is no record
+// for it: the segment is written before the tail records were introduced, or when it was created
+// we crashed before writing the record.
+func (hpf *HPFile) readTail() (idx int64, tail []byte, err error) {
+	id := hpf.largestID
+	rec, err := ioutil.ReadFile(filepath.Join(hpf.dirName, encTailDir, encTailName))
+	if os.IsNotExist(err) {
+		return -1, nil, nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+	if len(rec) < 16 {
+		return 0, nil, fmt.Errorf("Truncated tail record of segment %d", id)
+	}
+	if int(binary.LittleEndian.Uint64(rec[:8])) != id {
+		return -1, nil, nil
+	}
+	idx = int64(binary.LittleEndian.Uint64(rec[8:16]))
+	tail, err = openChunk(hpf.aeads[id], id, idx, rec[16:])
+	return idx, tail, err
+}
+
+// Return the chunks and the plaintext of the partial chunk at the end of a segment, whose chunks
+// take physSize bytes
+func (hpf *HPFile) readLastChunk(id int, physSize int64) (idx int64, tail []byte, err error) {
+	idx = physSize / encChunkPhysSize
+	if rem := physSize % encChunkPhysSize; rem != 0 {
+		c := make([]byte, rem)
+		if _, err = hpf.fileMap[id].ReadAt(c, hpf.headerSizes[id]+idx*encChunkPhysSize); err != nil {
+			return 0, nil, err
+		}
+		tail, err = openChunk(hpf.aeads[id], id, idx, c)
+	}
+	return
+}
+
+// Load the partial chunk of the latest encrypted segment from its tail record, or from the end
+// of the segment if it has no record, whose chunks take physSize bytes. Then the segment is cut
+// after its full chunks. The tail record is saved before cutting, so a crash in the middle loses
+// nothing.
+func (hpf *HPFile) openTail(physSize int64) error {
+	id := hpf.largestID
+	idx, tail, err := hpf.readTail()
+	if err != nil {
+		return err
+	}
+	if idx < 0 {
+		if idx, tail, err = hpf.readLastChunk(id, physSize); err != nil {
+			return err
+		}
+		hpf.tailDirty = true
+	} else if idx*encChunkPhysSize > physSize {
+		return fmt.Errorf("Segment %d has less chunks than its tail record", id)
+	}
+	hpf.writtenSize = idx*EncryptionChunkSize + int64(len(tail))
+	hpf.tail = tail
+	if hpf.tailDirty {
+		if err = hpf.saveTail(); err != nil {
+			return err
+		}
+	}
+	return hpf.fileMap[id].Truncate(hpf.headerSizes[id] + idx*encChunkPhysSize)
+}
+
+// Truncate the latest encrypted segment to size bytes of plaintext
+func (hpf *HPFile) truncateEncrypted(size int64) error {
+	id := hpf.largestID
+	idx := size / EncryptionChunkSize
+	var tail []byte
+	if rem := size % EncryptionChunkSize; rem != 0 {
+		tail = make([]byte, rem)
+		if _, err := hpf.readSegment(id, hpf.fileMap[id], tail, size-rem); err != nil {
+			return err
+		}
+	}
+	hpf.writtenSize = size
+	hpf.tail = tail
+	if err := hpf.saveTail(); err != nil {
+		return err
+	}
+	return hpf.fileMap[id].Truncate(hpf.headerSizes[id] + idx*encChunkPhysSize)
+}
@@ -2,16 +2,44 @@ package datatree
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 
+	"github.com/golang/snappy"
+
 	"github.com/coinexchain/onvakv/types"
 )
 
 type Entry = types.Entry
 
+type EntryFormat = types.EntryFormat
+
 const MaxEntryBytes int = (1 << 24) - 1
 
+// The position of an entry returned by AppendEntry carries a hint in its high 16 bits: the
+// entry's length including padding, in 8-byte units, so the entry can be read in one I/O. A
+// position without hint (zero in the high bits) is still accepted by the reading functions.
+const (
+	EntryPosHintShift = 48
+	entryPosMask      = (int64(1) << EntryPosHintShift) - 1
+	maxEntryPosHint   = (1 << 16) - 1
+)
+
+// Add the hint of paddedLen to pos, unless paddedLen is too large for the hint
+func PackEntryPos(pos int64, paddedLen int) int64 {
+	units := paddedLen / 8
+	if units > maxEntryPosHint || pos > entryPosMask {
+		return pos
+	}
+	return pos | int64(units)<<EntryPosHintShift
+}
+
+// Return the real position and the hinted length including padding, which is 0 if unknown
+func UnpackEntryPos(pos int64) (int64, int) {
+	return pos & entryPosMask, int(uint64(pos)>>EntryPosHintShift) * 8
+}
+
 var MagicBytes = [8]byte{255, 254, 253, 252, 252, 253, 254, 255}
 
 var dbg bool
@@ -46,6 +74,24 @@ func NullEntry() Entry {
 // normalPayload
 // DeactivedSerialNumList (list of 64b-int)
 // padding-zero-bytes
+//
+// normalPayload of version 0:
+// 32b-keyLength key 32b-valueLength value 32b-nextKeyLength nextKey height lastHeight serialNum
+// normalPayload of version 1:
+// 32b-(keyLength|version<<24) key 8b-flags 32b-valueLength value nextKeyField height lastHeight serialNum
+// where value is snappy-compressed if flagCompressedValue is set, and nextKeyField is
+// 32b-sharedPrefixLength 32b-suffixLength suffix if flagDeltaNextKey is set, or else
+// 32b-nextKeyLength nextKey
+
+const (
+	EntryVersion0 = 0
+	EntryVersion1 = 1
+
+	keyLengthMask = (1 << 24) - 1
+
+	flagCompressedValue = 1
+	flagDeltaNextKey    = 2
+)
 
 const (
 	MSB32 = uint32(1<<31)
@@ -82,13 +128,13 @@ func GetUint24(b []byte) (n uint32) {
 func ExtractKeyFromRawBytes(b []byte) []byte {
 	bb := b[4:]
 	if (bb[0]&bb[1]&bb[2]&bb[3]) == 0xFF { // No MagicBytes to recover
-		length := int(binary.LittleEndian.Uint32(bb[4:8]))
+		length := int(binary.LittleEndian.Uint32(bb[4:8]) & keyLengthMask)
 		return append([]byte{}, bb[8:8+length]...)
 	}
 	bb = append([]byte{}, b[4:]...)
 	n := recoverMagicBytes(bb)
 	bb = bb[n:]
-	length := int(binary.LittleEndian.Uint32(bb[:4]))
+	length := int(binary.LittleEndian.Uint32(bb[:4]) & keyLengthMask)
 	return append([]byte{}, bb[4:4+length]...)
 }
 
@@ -100,7 +146,7 @@ func EntryFromRawBytes(b []byte) *Entry {
 	}
 	bb = append([]byte{}, b[4:]...)
 	n := recoverMagicBytes(bb)
-	e, _ := EntryFromBytes(bb[n+4:], 0)
+	e, _ := EntryFromBytes(bb[n:], 0)
 	return e
 }
 
@@ -122,24 +168,40 @@ func SNListToBytes(deactivedSerialNumList []int64) []byte {
 	return res
 }
 
+// The largest possible value of the 24-bit length field, for an entry whose key, value and
+// next key have kvSize bytes in total. In the worst case, MagicBytes occur every 8 bytes
+// and each occurrence adds a 4-byte position. Compression and delta encoding are only used
+// when they make an entry shorter, so version 1 only adds the 1-byte flags.
+func WorstCaseEntryLength(kvSize int) int {
+	payload := 4*3 + kvSize + 8*3 + 1
+	return 4 + 4*(payload/8+1) + payload
+}
+
+// Serialize entry in the legacy version 0 format
 func EntryToBytes(entry Entry, deactivedSerialNumList []int64) []byte {
+	return EncodeEntry(entry, deactivedSerialNumList, EntryFormat{})
+}
+
+// Serialize entry in the format selected by format. The zero EntryFormat selects version 0.
+func EncodeEntry(entry Entry, deactivedSerialNumList []int64, format EntryFormat) []byte {
 	length := 4 + 4                                                        // 32b-length and empty magicBytesPos
 	length += 4*3 + len(entry.Key) + len(entry.Value) + len(entry.NextKey) // Three strings
-	length += 8 * 3                                                        // Three int64
+	length += 8*3 + 1                                                      // Three int64 and the flags
 	length += len(deactivedSerialNumList) * 8
-	b := make([]byte, length)
+	b := make([]byte, 8, length)
 
 	b[0] = byte(len(deactivedSerialNumList))
 	const start = 8
-	writeEntryPayload(b[start:], entry, deactivedSerialNumList)
+	b = appendEntryPayload(b, entry, format)
+	for _, sn := range deactivedSerialNumList {
+		b = appendUint64(b, uint64(sn))
+	}
+	length = len(b)
 
 	// MagicBytes can not lay in or overlap with these 64b integers
 	stop := len(b) - len(deactivedSerialNumList)*8 - 3*8
 	magicBytesPosList := getAllPos(b[start:stop], MagicBytes[:])
 	if len(magicBytesPosList) == 0 {
-		//!! if dbg {
-		//!! 	fmt.Printf("here-length %d %d\n", length, length-4-len(deactivedSerialNumList)*8)
-		//!! }
 		PutUint24(b[1:4], uint32(length-4-len(deactivedSerialNumList)*8))
 		binary.LittleEndian.PutUint32(b[4:8], ^uint32(0))
 		return b
@@ -164,40 +226,72 @@ func EntryToBytes(entry Entry, deactivedSerialNumList []int64) []byte {
 	// Re-write the new length. minus 4 because the first 4 bytes of length isn't included
 	buf[0] = byte(len(deactivedSerialNumList))
 	PutUint24(buf[1:4], uint32(length-4-len(deactivedSerialNumList)*8))
-	//!! if dbg {
-	//!! 	fmt.Printf("there-length %d %d\n", length, length-4-len(deactivedSerialNumList)*8)
-	//!! }
 	return buf
 }
 
-func writeEntryPayload(b []byte, entry Entry, deactivedSerialNumList []int64) {
-	i := 0
-	binary.LittleEndian.PutUint32(b[i:i+4], uint32(len(entry.Key)))
-	i += 4
-	copy(b[i:], entry.Key)
-	i += len(entry.Key)
-
-	binary.LittleEndian.PutUint32(b[i:i+4], uint32(len(entry.Value)))
-	i += 4
-	copy(b[i:], entry.Value)
-	i += len(entry.Value)
+func appendUint32(b []byte, n uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], n)
+	return append(b, buf[:]...)
+}
 
-	binary.LittleEndian.PutUint32(b[i:i+4], uint32(len(entry.NextKey)))
-	i += 4
-	copy(b[i:], entry.NextKey)
-	i += len(entry.NextKey)
+func appendUint64(b []byte, n uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], n)
+	return append(b, buf[:]...)
+}
 
-	binary.LittleEndian.PutUint64(b[i:i+8], uint64(entry.Height))
-	i += 8
-	binary.LittleEndian.PutUint64(b[i:i+8], uint64(entry.LastHeight))
-	i += 8
-	binary.LittleEndian.PutUint64(b[i:i+8], uint64(entry.SerialNum))
-	i += 8
+func commonPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
 
-	for _, sn := range deactivedSerialNumList {
-		binary.LittleEndian.PutUint64(b[i:i+8], uint64(sn))
-		i += 8
+func appendEntryPayload(b []byte, entry Entry, format EntryFormat) []byte {
+	if format == (EntryFormat{}) {
+		b = appendUint32(b, uint32(len(entry.Key)))
+		b = append(b, entry.Key...)
+		b = appendUint32(b, uint32(len(entry.Value)))
+		b = append(b, entry.Value...)
+		b = appendUint32(b, uint32(len(entry.NextKey)))
+		b = append(b, entry.NextKey...)
+	} else {
+		var flags byte
+		value := entry.Value
+		if format.Compression == types.CompressionSnappy && len(value) >= format.MinCompressLen {
+			compressed := snappy.Encode(nil, value)
+			if len(compressed) < len(value) {
+				value = compressed
+				flags |= flagCompressedValue
+			}
+		}
+		shared := 0
+		if format.DeltaNextKey {
+			shared = commonPrefixLen(entry.Key, entry.NextKey)
+			if shared > 4 { // shorter than the plain next key
+				flags |= flagDeltaNextKey
+			}
+		}
+		b = appendUint32(b, uint32(len(entry.Key))|EntryVersion1<<24)
+		b = append(b, entry.Key...)
+		b = append(b, flags)
+		b = appendUint32(b, uint32(len(value)))
+		b = append(b, value...)
+		if flags&flagDeltaNextKey != 0 {
+			b = appendUint32(b, uint32(shared))
+			b = appendUint32(b, uint32(len(entry.NextKey)-shared))
+			b = append(b, entry.NextKey[shared:]...)
+		} else {
+			b = appendUint32(b, uint32(len(entry.NextKey)))
+			b = append(b, entry.NextKey...)
+		}
 	}
+	b = appendUint64(b, uint64(entry.Height))
+	b = appendUint64(b, uint64(entry.LastHeight))
+	b = appendUint64(b, uint64(entry.SerialNum))
+	return b
 }
 
 func getAllPos(s, sep []byte) (allpos []int) {
@@ -215,20 +309,50 @@ func EntryFromBytes(b []byte, numberOfSN int) (*Entry, []int64) {
 	entry := &Entry{}
 	i := 0
 
-	length := int(binary.LittleEndian.Uint32(b[i : i+4]))
+	keyField := binary.LittleEndian.Uint32(b[i : i+4])
+	version := keyField >> 24
+	length := int(keyField & keyLengthMask)
 	i += 4
 	entry.Key = b[i:i+length]
 	i += length
 
+	var flags byte
+	switch version {
+	case EntryVersion0:
+	case EntryVersion1:
+		flags = b[i]
+		i++
+	default:
+		panic(fmt.Sprintf("Unknown entry version %d", version))
+	}
+
 	length = int(binary.LittleEndian.Uint32(b[i : i+4]))
 	i += 4
 	entry.Value = b[i:i+length]
 	i += length
+	if flags&flagCompressedValue != 0 {
+		value, err := snappy.Decode(nil, entry.Value)
+		if err != nil {
+			panic(err)
+		}
+		entry.Value = value
+	}
 
-	length = int(binary.LittleEndian.Uint32(b[i : i+4]))
-	i += 4
-	entry.NextKey = b[i:i+length]
-	i += length
+	if flags&flagDeltaNextKey != 0 {
+		shared := int(binary.LittleEndian.Uint32(b[i : i+4]))
+		i += 4
+		length = int(binary.LittleEndian.Uint32(b[i : i+4]))
+		i += 4
+		entry.NextKey = make([]byte, 0, shared+length)
+		entry.NextKey = append(entry.NextKey, entry.Key[:shared]...)
+		entry.NextKey = append(entry.NextKey, b[i:i+length]...)
+		i += length
+	} else {
+		length = int(binary.LittleEndian.Uint32(b[i : i+4]))
+		i += 4
+		entry.NextKey = b[i:i+length]
+		i += length
+	}
 
 	entry.Height = int64(binary.LittleEndian.Uint64(b[i : i+8]))
 	i += 8
@@ -269,9 +393,13 @@ func (ef *EntryFile) readMagicBytesAndLength(off int64, withBuf bool) (length in
 	if err != nil {
 		panic(err)
 	}
+	return parseMagicBytesAndLength(off, buf[:])
+}
+
+// Parse the first 12 bytes of the entry at off
+func parseMagicBytesAndLength(off int64, buf []byte) (length int64, numberOfSN int) {
 	if !bytes.Equal(buf[:8], MagicBytes[:]) {
-		fmt.Printf("Now off %d %x\n", off, off)
-		panic("Invalid MagicBytes")
+		panic(fmt.Sprintf("Invalid MagicBytes at %d(0x%x)", off, off))
 	}
 	length = int64(GetUint24(buf[9:12]))
 	if int(length) >= MaxEntryBytes {
@@ -285,7 +413,6 @@ func getNextPos(off, length int64) int64 {
 	paddingSize := getPaddingSize(int(length))
 	paddedLen := length + int64(paddingSize)
 	nextPos := off + paddedLen
-	//fmt.Printf("off %d length %d paddingSize %d paddedLen %d nextPos %d\n", off, length, paddingSize, paddedLen, nextPos)
 	return nextPos
 
 }
@@ -302,11 +429,30 @@ func (ef *EntryFile) ReadEntry(off int64) (entry *Entry, nextPos int64) {
 	return
 }
 
+// In the mmap mode, the raw bytes of the entries in closed segments are not copied. They must not
+// be modified, and they are only valid until PruneHead removes their segment, or until the first
+// PruneHead after their segment is moved to the cold tier.
 func (ef *EntryFile) ReadEntryRawBytes(off int64) (entryBz []byte, nextPos int64) {
 	entryBz, _, nextPos = ef.readEntry(off, false, true, true)
 	return
 }
 
+// Read the raw bytes of an entry, including its list of deactived serial numbers. The result's
+// sha256 hash is the entry's leaf in the Merkle tree. Like ReadEntryRawBytes, it does not copy
+// in the mmap mode.
+func (ef *EntryFile) ReadEntryRawBytesWithSNList(off int64) (entryBz []byte, nextPos int64) {
+	entryBz, _, nextPos = ef.readEntry(off, true, true, true)
+	return
+}
+
+// Decode the bytes returned by ReadEntryRawBytesWithSNList
+func EntryAndSNListFromRawBytes(entryBz []byte) (*Entry, []int64) {
+	numberOfSN := int(entryBz[0])
+	b := append([]byte{}, entryBz[4:]...)
+	n := recoverMagicBytes(b)
+	return EntryFromBytes(b[n:], numberOfSN)
+}
+
 func recoverMagicBytes(b []byte) (n int) {
 	for n = 0; n + 4 < len(b); n += 4 { // recover magic bytes in payload
 		pos := binary.LittleEndian.Uint32(b[n : n+4])
@@ -323,20 +469,46 @@ func recoverMagicBytes(b []byte) (n int) {
 }
 
 func (ef *EntryFile) readEntry(off int64, withSNList, useRaw, withBuf bool) (entrybz []byte, numberOfSN int, nextPos int64) {
-	length, numberOfSN := ef.readMagicBytesAndLength(off, withBuf)
+	off, hintLen := UnpackEntryPos(off)
+	var b []byte // the whole entry read at once with the hint
+	var length int64
+	if hintLen >= 12 {
+		b = ef.readWithHint(off, hintLen, useRaw, withBuf)
+	}
+	if b != nil {
+		length, numberOfSN = parseMagicBytesAndLength(off, b)
+		if getNextPos(off, length+8*int64(numberOfSN)) != off+int64(hintLen) { // a wrong hint
+			b = nil
+		}
+	}
+	if b == nil {
+		length, numberOfSN = ef.readMagicBytesAndLength(off, withBuf)
+	}
 	nextPos = getNextPos(off, int64(length)+8*int64(numberOfSN))
 	if withSNList {
 		length += 8 * int64(numberOfSN) // ignore snlist
 	} else {
 		numberOfSN = 0
 	}
-	b := make([]byte, 12+int(length)) // include 12 (magicbytes and length)
-	err := ef.HPFile.ReadAt(b, off, withBuf)
+	if b != nil {
+		b = b[:12+int(length):12+int(length)]
+		if useRaw {
+			return b[8:], numberOfSN, nextPos
+		}
+	} else if useRaw {
+		if b, ok := ef.HPFile.readMapped(off, 12+int(length)); ok {
+			return b[8:], numberOfSN, nextPos
+		}
+	}
+	if b == nil {
+		b = make([]byte, 12+int(length)) // include 12 (magicbytes and length)
+		err := ef.HPFile.ReadAt(b, off, withBuf)
+		if err != nil {
+			panic(err)
+		}
+	}
 	origB := b
 	b = b[12:] // ignore magicbytes and length
-	if err != nil {
-		panic(err)
-	}
 	if useRaw {
 		return origB[8:], numberOfSN, nextPos
 	}
@@ -344,8 +516,27 @@ func (ef *EntryFile) readEntry(off int64, withSNList, useRaw, withBuf bool) (ent
 	return b[n:length], numberOfSN, nextPos
 }
 
+// Read the hintLen bytes of the entry at off, or return nil if they can not be read. The mapped
+// memory is returned without copying if useRaw is true.
+func (ef *EntryFile) readWithHint(off int64, hintLen int, useRaw, withBuf bool) []byte {
+	if useRaw {
+		if b, ok := ef.HPFile.readMapped(off, hintLen); ok {
+			return b
+		}
+	}
+	b := make([]byte, hintLen)
+	if ef.HPFile.ReadAt(b, off, withBuf) != nil {
+		return nil
+	}
+	return b
+}
+
 func NewEntryFile(bufferSize, blockSize int, dirName string) (res EntryFile, err error) {
-	res.HPFile, err = NewHPFile(bufferSize, blockSize, dirName)
+	return NewEntryFileWithOptions(bufferSize, blockSize, dirName, HPFileOptions{})
+}
+
+func NewEntryFileWithOptions(bufferSize, blockSize int, dirName string, opts HPFileOptions) (res EntryFile, err error) {
+	res.HPFile, err = NewHPFileWithOptions(bufferSize, blockSize, dirName, opts)
 	res.HPFile.InitPreReader()
 	return
 }
@@ -379,10 +570,6 @@ func (ef *EntryFile) PruneHead(off int64) {
 }
 
 func (ef *EntryFile) Append(b [2][]byte) (pos int64) {
-	//!! if b[0][1] == 0 && b[0][2] == 0  && b[0][3] == 0 {
-	//!! 	fmt.Printf("%#v\n", b)
-	//!! 	panic("here in Append")
-	//!! }
 	var bb [4][]byte
 	bb[0] = MagicBytes[:]
 	bb[1] = b[0]
@@ -390,38 +577,44 @@ func (ef *EntryFile) Append(b [2][]byte) (pos int64) {
 	paddingSize := getPaddingSize(len(b[0])+len(b[1]))
 	bb[3] = make([]byte, paddingSize) // padding zero bytes
 	pos, err := ef.HPFile.Append(bb[:])
-	//!! if pos > 108996000 {
-	//!! 	dbg = true
-	//!! 	fmt.Printf("Append pos %d %#v len(bb[1]) %d padding %d\n", pos, bb[:], len(bb[1]), paddingSize)
-	//!! }
 	if pos%8 != 0 {
 		panic("Entries are not aligned")
 	}
 	if err != nil {
 		panic(err)
 	}
-	//fmt.Printf("Now Append At: %d len: %d\n", pos, len(b))
 	return
 }
 
 func (ef *EntryFile) GetActiveEntriesInTwig(twig *Twig) chan []byte {
 	res := make(chan []byte, 100)
-	go func() {
-		start := twig.FirstEntryPos
-		for i := 0; i < LeafCountInTwig; i++ {
-			if twig.getBit(i) {
-				entryBz, next := ef.ReadEntryRawBytes(start)
-				//!! fmt.Printf("Why start %d entryBz %#v\n", start, entryBz)
-				start = next
-				res <- entryBz
-			} else { // skip an inactive entry
-				length, numberOfSN := ef.readMagicBytesAndLength(start, true)
-				start = getNextPos(start, length+8*int64(numberOfSN))
+	go ef.GetActiveEntriesInTwigCtx(context.Background(), twig, res)
+	return res
+}
+
+// Send the raw bytes of the active entries in twig to outChan, and close outChan at the end.
+// When ctx is cancelled, it closes outChan and returns ctx.Err() without sending the rest entries.
+func (ef *EntryFile) GetActiveEntriesInTwigCtx(ctx context.Context, twig *Twig, outChan chan []byte) error {
+	defer close(outChan)
+	start := twig.FirstEntryPos
+	for i := 0; i < LeafCountInTwig && ctx.Err() == nil; i++ {
+		if twig.getBit(i) {
+			entryBz, next := ef.ReadEntryRawBytes(start)
+			if ef.mmapMode { // the receivers may change it
+				entryBz = append([]byte{}, entryBz...)
+			}
+			start = next
+			select {
+			case outChan <- entryBz:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
+		} else { // skip an inactive entry
+			length, numberOfSN := ef.readMagicBytesAndLength(start, true)
+			start = getNextPos(start, length+8*int64(numberOfSN))
 		}
-		close(res)
-	}()
-	return res
+	}
+	return ctx.Err()
 }
 
 //!! func (ef *EntryFile) GetActiveEntriesInTwigOld(twig *Twig) chan *Entry {
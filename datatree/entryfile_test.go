@@ -3,9 +3,12 @@ package datatree
 import (
 	//"fmt"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/coinexchain/onvakv/types"
 )
 
 
@@ -115,3 +118,144 @@ func TestEntryFile(t *testing.T) {
 	ef.Close()
 	os.RemoveAll("./entryF")
 }
+
+func TestEntryFormat(t *testing.T) {
+	os.RemoveAll("./entryF")
+	os.Mkdir("./entryF", 0700)
+
+	entry := Entry{
+		Key:        []byte("account/0123456789/balance"),
+		Value:      []byte(strings.Repeat("coin:100;", 40) + string(MagicBytes[:])),
+		NextKey:    []byte("account/0123456789/nonce"),
+		Height:     30,
+		LastHeight: 20,
+		SerialNum:  7,
+	}
+	snList := []int64{3, 5}
+	formats := []EntryFormat{
+		{},
+		{Compression: types.CompressionSnappy},
+		{DeltaNextKey: true},
+		{Compression: types.CompressionSnappy, MinCompressLen: 1000, DeltaNextKey: true},
+		{Compression: types.CompressionSnappy, DeltaNextKey: true},
+	}
+	ef, err := NewEntryFile(8*1024, 128*1024/*128KB*/, "./entryF")
+	assert.Equal(t, nil, err)
+	posList := make([]int64, len(formats))
+	bzList := make([][]byte, len(formats))
+	for i, format := range formats {
+		bzList[i] = EncodeEntry(entry, snList, format)
+		posList[i] = ef.Append([2][]byte{bzList[i], nil})
+	}
+	assert.Equal(t, EntryToBytes(entry, snList), bzList[0])
+	assert.True(t, len(bzList[1]) < len(bzList[0]))
+	assert.True(t, len(bzList[2]) < len(bzList[0]))
+	assert.True(t, len(bzList[3]) < len(bzList[0]))
+	assert.True(t, len(bzList[4]) < len(bzList[1]))
+	assert.True(t, len(bzList[0]) <= WorstCaseEntryLength(len(entry.Key)+len(entry.Value)+len(entry.NextKey)))
+	ef.Flush()
+
+	for i, pos := range posList {
+		e, l, _ := ef.ReadEntryAndSNList(pos)
+		assert.Equal(t, entry, *e)
+		assert.Equal(t, snList, l)
+		// a leaf's hash covers the stored bytes
+		raw, _ := ef.ReadEntryRawBytesWithSNList(pos)
+		assert.Equal(t, bzList[i], raw)
+		e, l = EntryAndSNListFromRawBytes(raw)
+		assert.Equal(t, entry, *e)
+		assert.Equal(t, snList, l)
+		raw, _ = ef.ReadEntryRawBytes(pos)
+		assert.Equal(t, entry.Key, ExtractKeyFromRawBytes(raw))
+		assert.Equal(t, entry, *EntryFromRawBytes(raw))
+		assert.Equal(t, entry.SerialNum, ExtractSerialNum(raw))
+	}
+
+	ef.Close()
+	os.RemoveAll("./entryF")
+}
+
+func TestReadEntries(t *testing.T) {
+	entries := makeEntries()
+	long := entries[1]
+	long.Value = []byte(strings.Repeat("LongValue", 100)) // beyond entryFirstReadSize
+	entries = append(entries, long)
+	for _, opts := range []HPFileOptions{
+		{},
+		{DirectIO: true},
+		{IOUring: true, BatchReadDepth: 8},
+		{DirectIO: true, IOUring: true},
+		{Encryption: testEncryption(1), DirectIO: true, IOUring: true},
+		{Mmap: true},
+	} {
+		os.RemoveAll("./entryF")
+		os.Mkdir("./entryF", 0700)
+		ef, err := NewEntryFileWithOptions(8*1024, 64*1024, "./entryF", opts)
+		assert.Equal(t, nil, err)
+		var positions []int64
+		for i := 0; i < 1000; i++ {
+			bz := EntryToBytes(entries[i%len(entries)], []int64{int64(i)})
+			positions = append(positions, ef.Append([2][]byte{bz, nil}))
+		}
+		ef.Flush()
+		assert.True(t, ef.Size() > 3*64*1024) // some entries are across the ends of blockSize
+		// in random order and with duplicates
+		var batch []int64
+		for i := 0; i < len(positions); i++ {
+			batch = append(batch, positions[(i*7)%len(positions)])
+		}
+		batch = append(batch, positions[0], positions[len(positions)-1])
+		res := ef.ReadEntries(batch)
+		assert.Equal(t, len(batch), len(res))
+		for i, pos := range batch {
+			e, _ := ef.ReadEntry(pos)
+			assert.Equal(t, *e, *res[i])
+			raw, _ := ef.ReadEntryRawBytes(pos) // not copied in the mmap mode
+			assert.Equal(t, *e, *EntryFromRawBytes(raw))
+		}
+		assert.Equal(t, 0, len(ef.ReadEntries(nil)))
+		ef.Close()
+	}
+	os.RemoveAll("./entryF")
+}
+
+func TestEntryPosHint(t *testing.T) {
+	os.RemoveAll("./entryF")
+	os.Mkdir("./entryF", 0700)
+	ef, err := NewEntryFile(8*1024, 128*1024, "./entryF")
+	assert.Equal(t, nil, err)
+	entries := makeEntries()
+	snLists := [][]int64{{1, 2, 3, 4}, {5}, {}, {10, 1}}
+	var positions, hinted []int64
+	for i, e := range entries {
+		bz := EntryToBytes(e, snLists[i])
+		pos := ef.Append([2][]byte{bz, nil})
+		positions = append(positions, pos)
+		hinted = append(hinted, PackEntryPos(pos, 8+len(bz)+getPaddingSize(len(bz))))
+	}
+	ef.Flush()
+	ef.InitPreReader()
+	for i, pos := range hinted {
+		off, hintLen := UnpackEntryPos(pos)
+		assert.Equal(t, positions[i], off)
+		assert.True(t, hintLen > 0 && hintLen%8 == 0)
+		e, l, next := ef.ReadEntryAndSNList(pos) // the last one is read up to the end of file
+		assert.Equal(t, entries[i], *e)
+		if len(snLists[i]) != 0 {
+			assert.Equal(t, snLists[i], l)
+		}
+		assert.Equal(t, off+int64(hintLen), next)
+		raw, _ := ef.ReadEntryRawBytes(pos)
+		rawNoHint, _ := ef.ReadEntryRawBytes(off)
+		assert.Equal(t, rawNoHint, raw)
+	}
+	assert.Equal(t, ef.ReadEntries(positions), ef.ReadEntries(hinted))
+
+	// a wrong hint is ignored
+	e, _ := ef.ReadEntry(PackEntryPos(positions[1], 8))
+	assert.Equal(t, entries[1], *e)
+	// no hint for the entries too long
+	assert.Equal(t, positions[1], PackEntryPos(positions[1], 8<<16))
+	ef.Close()
+	os.RemoveAll("./entryF")
+}
@@ -0,0 +1,415 @@
+package datatree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mmcloughlin/meow"
+
+	"github.com/coinexchain/onvakv/logging"
+)
+
+// Versions of the on-disk format. The files of version 0 have no header. Since version 1, every
+// HPFile segment and every dump file (twigs.dat, nodes.dat and mtree4YT.dat) begins with a
+// FormatHeaderSize-byte header: 8-byte magic, 32b-version and 32b-keyID. keyID is the ID of the
+// key encrypting an HPFile segment, or 0 for plaintext. Version 2 adds headers and checksums to
+// the records of the twig Merkle tree file, and leaves the other files unchanged.
+const (
+	FormatVersion0 = 0
+	FormatVersion1 = 1
+	FormatVersion2 = 2
+
+	// The version of the files written by this package
+	FormatVersion = FormatVersion2
+
+	FormatHeaderSize = 16
+
+	migratingSuffix = ".migrating"
+	oldDirSuffix    = ".old"
+)
+
+var (
+	HPFileMagic   = [8]byte{'O', 'N', 'V', 'A', 'H', 'P', 'F', 0}
+	DumpFileMagic = [8]byte{'O', 'N', 'V', 'A', 'D', 'M', 'P', 0}
+)
+
+func FormatHeader(magic [8]byte, version uint32) []byte {
+	b := make([]byte, FormatHeaderSize)
+	copy(b[:8], magic[:])
+	binary.LittleEndian.PutUint32(b[8:12], version)
+	return b
+}
+
+// Parse the header at the beginning of b. If b does not begin with magic, it has version 0 and
+// no header. An error is returned for the versions unknown to this package.
+func ParseFormatHeader(b []byte, magic [8]byte) (version uint32, headerSize int64, err error) {
+	if len(b) < FormatHeaderSize || !bytes.Equal(b[:8], magic[:]) {
+		return FormatVersion0, 0, nil
+	}
+	version = binary.LittleEndian.Uint32(b[8:12])
+	if version == FormatVersion0 || version > FormatVersion {
+		return 0, 0, fmt.Errorf("Unsupported format version %d", version)
+	}
+	return version, FormatHeaderSize, nil
+}
+
+func readFormatHeader(f io.ReaderAt, magic [8]byte) (version uint32, headerSize int64, keyID uint32, err error) {
+	var buf [FormatHeaderSize]byte
+	n, err := f.ReadAt(buf[:], 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, 0, err
+	}
+	version, headerSize, err = ParseFormatHeader(buf[:n], magic)
+	if headerSize != 0 {
+		keyID = binary.LittleEndian.Uint32(buf[12:16])
+	}
+	return
+}
+
+// Return the smallest format version of the segments
+func (hpf *HPFile) minFormatVersion() (uint32, error) {
+	res := uint32(FormatVersion)
+	var readers []io.ReaderAt
+	for _, f := range hpf.fileMap {
+		readers = append(readers, f)
+	}
+	for _, f := range hpf.coldFiles {
+		readers = append(readers, f)
+	}
+	for _, r := range readers {
+		version, _, _, err := readFormatHeader(r, HPFileMagic)
+		if err != nil {
+			return 0, err
+		}
+		if version < res {
+			res = version
+		}
+	}
+	return res, nil
+}
+
+func writeDumpHeader(w io.Writer) error {
+	_, err := w.Write(FormatHeader(DumpFileMagic, FormatVersion))
+	return err
+}
+
+// Read the version of a dump file and move its offset to the end of the header
+func readDumpHeader(f *os.File) (version uint32, err error) {
+	version, headerSize, _, err := readFormatHeader(f, DumpFileMagic)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(headerSize, io.SeekStart)
+	return version, err
+}
+
+// Return the version of the file at path, which is an HPFile segment if isSegment is true, or
+// else a dump file.
+func FileFormatVersion(path string, isSegment bool) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	version, _, _, err := readFormatHeader(f, fileMagic(isSegment))
+	return version, err
+}
+
+func fileMagic(isSegment bool) [8]byte {
+	if isSegment {
+		return HPFileMagic
+	}
+	return DumpFileMagic
+}
+
+// upgrades[v] rewrites a file of version v into version v+1. The segments of twig Merkle tree
+// files are not upgraded one by one, but rewritten together by migrateTwigMtDir.
+var upgrades = []func(path string, magic [8]byte) error{
+	FormatVersion0: addFormatHeader,
+	FormatVersion1: setHeaderVersion(FormatVersion2),
+}
+
+// Version 1 only prepends the header to the content of version 0
+func addFormatHeader(path string, magic [8]byte) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmpPath := path + migratingSuffix
+	out, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(FormatHeader(magic, FormatVersion1))
+	if err == nil {
+		_, err = io.Copy(out, in)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// The content of the other files is unchanged since version 1
+func setHeaderVersion(version uint32) func(path string, magic [8]byte) error {
+	return func(path string, magic [8]byte) error {
+		f, err := os.OpenFile(path, os.O_RDWR, 0700)
+		if err != nil {
+			return err
+		}
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], version)
+		_, err = f.WriteAt(buf[:], 8)
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+}
+
+// Rewrite the file at path into FormatVersion, one version after another. It returns the
+// version before migration. The segments of twig Merkle tree files can only be migrated by
+// MigrateDir.
+func MigrateFile(path string, isSegment bool) (uint32, error) {
+	from, err := FileFormatVersion(path, isSegment)
+	if err != nil {
+		return 0, err
+	}
+	if isSegment && from < FormatVersion2 && filepath.Base(filepath.Dir(path)) == twigMtPath {
+		return from, fmt.Errorf("%s must be migrated with the whole directory", path)
+	}
+	for version := from; version < FormatVersion; version++ {
+		err = upgrades[version](path, fileMagic(isSegment))
+		if err != nil {
+			return from, fmt.Errorf("Failed to upgrade %s from version %d: %w", path, version, err)
+		}
+	}
+	return from, nil
+}
+
+// Rewrite the entry file, the twig Merkle tree file and the dump files of the data tree in
+// dirName into FormatVersion. The data tree must not be opened during migration. The files
+// already in FormatVersion are left untouched, so an interrupted migration can be restarted.
+func MigrateDir(dirName string, logger logging.Logger) error {
+	return MigrateDirWithOptions(dirName, logger, HPFileOptions{})
+}
+
+// Like MigrateDir, but the twig Merkle tree file is read with opts, which provide the keys of
+// its encrypted segments and the cold store of its old segments.
+func MigrateDirWithOptions(dirName string, logger logging.Logger, opts HPFileOptions) error {
+	logger = logging.OrNop(logger).With("module", "migrate", "dir", dirName)
+	err := migrateTwigMtDir(filepath.Join(dirName, twigMtPath), logger, opts)
+	if err != nil {
+		return err
+	}
+	for _, sub := range []string{entriesPath} {
+		dir := filepath.Join(dirName, sub)
+		fileInfoList, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fileInfo := range fileInfoList {
+			path := filepath.Join(dir, fileInfo.Name())
+			if fileInfo.IsDir() {
+				continue
+			}
+			if strings.HasSuffix(path, migratingSuffix) { // left by an interrupted migration
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := migrateAndLog(logger, path, true); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range []string{twigsPath, nodesPath, mtree4YTPath} {
+		path := filepath.Join(dirName, name)
+		os.Remove(path + migratingSuffix)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := migrateAndLog(logger, path, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateAndLog(logger logging.Logger, path string, isSegment bool) error {
+	from, err := MigrateFile(path, isSegment)
+	if err != nil {
+		return err
+	}
+	if from != FormatVersion {
+		logger.Info("migrated", "file", path, "from", from, "to", FormatVersion)
+	}
+	return nil
+}
+
+// Read the record of twigID in a twig Merkle tree file before FormatVersion2
+func readTwigV1(hpf *HPFile, twigID int64, mtree [][32]byte) (firstEntryPos int64, err error) {
+	var buf [12]byte
+	off := twigID * twigMtSizeV1
+	if err = hpf.ReadAt(buf[:], off, true); err != nil {
+		return 0, err
+	}
+	h := meow.New32(0)
+	h.Write(buf[:8])
+	if !bytes.Equal(buf[8:], h.Sum(nil)) {
+		return 0, fmt.Errorf("Checksum error of twig %d", twigID)
+	}
+	for i := range mtree {
+		if err = hpf.ReadAt(mtree[i][:], off+12+int64(i)*32, true); err != nil {
+			return 0, err
+		}
+	}
+	return int64(binary.LittleEndian.Uint64(buf[:8])), nil
+}
+
+// The records of twig Merkle tree files change their size in FormatVersion2, so the twig at an
+// offset moves to another segment. This function writes the twigs into new segments in a
+// temporary directory, which then replaces dir. The segments in the cold tier are removed.
+func migrateTwigMtDir(dir string, logger logging.Logger, opts HPFileOptions) error {
+	oldDir, tmpDir := dir+oldDirSuffix, dir+migratingSuffix
+	if _, err := os.Stat(oldDir); err == nil { // interrupted when replacing dir
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			if err := os.Rename(tmpDir, dir); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(oldDir); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	fileInfoList, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	blockSize, upToDate := 0, true
+	for _, fileInfo := range fileInfoList {
+		if fileInfo.IsDir() { // the tail records of encryption
+			continue
+		}
+		var id int
+		_, err = fmt.Sscanf(fileInfo.Name(), "%d-%d", &id, &blockSize)
+		if err != nil {
+			return fmt.Errorf("%s does not match the pattern 'FileId-BlockSize'", fileInfo.Name())
+		}
+		version, err := FileFormatVersion(filepath.Join(dir, fileInfo.Name()), true)
+		if err != nil {
+			return err
+		}
+		upToDate = upToDate && version >= FormatVersion2
+	}
+	if upToDate {
+		return nil
+	}
+	bufferSize := BufferSize
+	for blockSize%bufferSize != 0 {
+		bufferSize /= 2
+	}
+	old, err := NewHPFileWithOptions(bufferSize, blockSize, dir, opts)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	old.InitPreReader()
+	minID := old.largestID
+	for id := range old.fileMap {
+		if id < minID {
+			minID = id
+		}
+	}
+	for id := range old.coldFiles {
+		if id < minID {
+			minID = id
+		}
+	}
+	first := (int64(minID)*int64(blockSize) + twigMtSizeV1 - 1) / twigMtSizeV1 // the first complete twig
+	last := old.Size() / twigMtSizeV1
+
+	// The new file begins at the first twig's offset, in the segment containing it
+	if err = os.Mkdir(tmpDir, 0700); err != nil {
+		return err
+	}
+	start := first * TwigMtSize
+	segID := start / int64(blockSize)
+	f, err := os.Create(fmt.Sprintf("%s/%d-%d", tmpDir, segID, blockSize))
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		return err
+	}
+	tf, err := NewTwigMtFileWithOptions(bufferSize, blockSize, tmpDir, HPFileOptions{Encryption: opts.Encryption})
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, bufferSize)
+	for remain := start - segID*int64(blockSize); remain > 0; remain -= int64(len(zeros)) {
+		if remain < int64(len(zeros)) {
+			zeros = zeros[:remain]
+		}
+		if _, err = tf.HPFile.Append([][]byte{zeros}); err != nil {
+			return err
+		}
+	}
+	mtree := make([][32]byte, TwigMtEntryCount)
+	for twigID := first; twigID < last; twigID++ {
+		firstEntryPos, err := readTwigV1(&old, twigID, mtree)
+		if err != nil {
+			tf.Close()
+			return err
+		}
+		tf.AppendTwig(mtree, firstEntryPos)
+	}
+	tf.Flush()
+	tf.Close()
+	if err = old.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(dir, oldDir); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpDir, dir); err != nil {
+		return err
+	}
+	if err = os.RemoveAll(oldDir); err != nil {
+		return err
+	}
+	if opts.ColdStore != nil {
+		names, err := opts.ColdStore.List(filepath.Base(dir))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err = opts.ColdStore.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	logger.Info("migrated", "dir", dir, "firstTwig", first, "twigs", last-first, "to", FormatVersion)
+	return nil
+}
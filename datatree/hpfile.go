@@ -1,9 +1,13 @@
 package datatree
 
 import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -11,6 +15,9 @@ import (
 	//"sync/atomic"
 
 	//"github.com/dterei/gotsc"
+
+	"github.com/coinexchain/onvakv/logging"
+	"github.com/coinexchain/onvakv/metrics"
 )
 
 var TotalWriteTime, TotalReadTime, TotalSyncTime uint64
@@ -21,9 +28,30 @@ const (
 	PreReadBufSize = 256*1024
 )
 
-// Head prune-able file
+// Head prune-able file. Its segments of FormatVersion1 begin with a header, which is not counted
+// in the offsets. The segments of FormatVersion0 may be mixed with them.
 type HPFile struct {
 	fileMap        map[int]*os.File
+	headerSizes    map[int]int64
+	aeads          map[int]cipher.AEAD // nil for plaintext segments
+	encryption     *Encryption
+	writtenSize    int64  // the bytes written to the latest segment, excluding the buffer
+	tail           []byte // the last partial chunk of the latest segment, if it is encrypted
+	tailDirty      bool   // whether tail is changed after the tail record is saved
+	coldStore      ColdStore
+	hotSegments    int
+	coldFiles      map[int]ColdFile
+	moving         bool // whether segments are being moved to coldStore
+	movingWG       sync.WaitGroup
+	movingMtx      sync.Mutex // serializes MoveColdSegments
+	directIO       bool
+	directFiles    map[int]*os.File // the segments opened with O_DIRECT, nil if unavailable
+	directMtx      sync.Mutex
+	ring           *uring
+	batchReadDepth int
+	mmapMode       bool
+	mmaps          map[int][]byte // the mapped segments, which are closed
+	retiredMmaps   map[int][]byte // the mappings of the segments moved to the cold tier
 	blockSize      int
 	dirName        string
 	largestID      int
@@ -32,19 +60,72 @@ type HPFile struct {
 	buffer         []byte
 	mtx            sync.RWMutex
 	preReader      PreReader
+
+	appendedBytes  metrics.Counter
+	preReadHits    metrics.Counter
+	preReadMisses  metrics.Counter
+	logger         logging.Logger
+}
+
+// The options of HPFiles. The zero value writes plaintext segments and keeps all of them in
+// the HPFile's directory.
+type HPFileOptions struct {
+	Encryption *Encryption
+	// When ColdStore is not nil, the segments older than the latest HotSegments ones are moved
+	// to it, and they are read from it transparently.
+	ColdStore   ColdStore
+	HotSegments int
+	// ReadBatch reads the segments with O_DIRECT if DirectIO is true, and submits the reads
+	// with io_uring if IOUring is true. Both fall back to ordinary preads where they are not
+	// supported, e.g. on other OSes or on file systems without O_DIRECT.
+	DirectIO bool
+	IOUring  bool
+	// The maximum number of reads in flight in ReadBatch, DefaultBatchReadDepth if it is 0
+	BatchReadDepth int
+	// Map the closed plaintext segments into memory, and read them without system calls. Then
+	// the raw bytes of entries are returned without copying.
+	Mmap bool
 }
 
 func NewHPFile(bufferSize, blockSize int, dirName string) (HPFile, error) {
+	return NewHPFileWithOptions(bufferSize, blockSize, dirName, HPFileOptions{})
+}
+
+func NewHPFileWithOptions(bufferSize, blockSize int, dirName string, opts HPFileOptions) (HPFile, error) {
 	res := HPFile{
-		fileMap:    make(map[int]*os.File),
-		blockSize:  blockSize,
+		fileMap:     make(map[int]*os.File),
+		headerSizes: make(map[int]int64),
+		aeads:       make(map[int]cipher.AEAD),
+		encryption:  opts.Encryption,
+		coldStore:   opts.ColdStore,
+		hotSegments: opts.HotSegments,
+		coldFiles:   make(map[int]ColdFile),
+		directIO:    opts.DirectIO,
+		directFiles: make(map[int]*os.File),
+		batchReadDepth: opts.BatchReadDepth,
+		mmapMode:    opts.Mmap,
+		mmaps:       make(map[int][]byte),
+		retiredMmaps: make(map[int][]byte),
+		blockSize:   blockSize,
 		dirName:    dirName,
 		bufferSize: bufferSize,
 		buffer:     make([]byte, 0, bufferSize),
 	}
+	res.SetMetrics(nil, "")
+	res.SetLogger(logging.Default())
 	if blockSize % bufferSize != 0 {
 		panic(fmt.Sprintf("Invalid blockSize 0x%x bufferSize 0x%x", blockSize, bufferSize))
 	}
+	if res.batchReadDepth <= 0 {
+		res.batchReadDepth = DefaultBatchReadDepth
+	}
+	if opts.IOUring {
+		var err error
+		res.ring, err = newURing(uint32(res.batchReadDepth))
+		if err != nil {
+			res.logger.Info("io_uring is unavailable", "err", err)
+		}
+	}
 	fileInfoList, err := ioutil.ReadDir(dirName)
 	if err != nil {
 		return res, err
@@ -76,15 +157,41 @@ func NewHPFile(bufferSize, blockSize int, dirName string) (HPFile, error) {
 		var err error
 		if id == res.largestID { // will write to this latest file
 			res.fileMap[id], err = os.OpenFile(fname, os.O_RDWR, 0700)
-			if err == nil {
-				res.latestFileSize, err = res.fileMap[id].Seek(0, os.SEEK_END)
-			}
 		} else {
 			res.fileMap[id], err = os.Open(fname)
 		}
 		if err != nil {
 			return res, err
 		}
+		var keyID uint32
+		_, res.headerSizes[id], keyID, err = readFormatHeader(res.fileMap[id], HPFileMagic)
+		if err == nil && keyID != 0 {
+			res.aeads[id], err = res.newAEAD(keyID)
+		}
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", fname, err)
+		}
+		if id == res.largestID {
+			res.latestFileSize, err = res.fileMap[id].Seek(0, os.SEEK_END)
+			if err != nil {
+				return res, err
+			}
+			if res.latestFileSize == 0 { // an empty segment can get a header
+				err = res.writeHeader(id)
+				res.latestFileSize = res.headerSizes[id]
+			}
+			res.latestFileSize -= res.headerSizes[id]
+			res.writtenSize = res.latestFileSize
+			if err == nil && res.aeads[id] != nil {
+				err = res.openTail(res.latestFileSize)
+				res.latestFileSize = res.writtenSize
+			}
+		} else {
+			err = res.mapSegment(id)
+		}
+		if err != nil {
+			return res, err
+		}
 	}
 	if len(idList) == 0 {
 		fname := fmt.Sprintf("%s/%d-%d", dirName, 0, blockSize)
@@ -93,10 +200,53 @@ func NewHPFile(bufferSize, blockSize int, dirName string) (HPFile, error) {
 		if err != nil {
 			return res, err
 		}
+		err = res.writeHeader(0)
+		if err != nil {
+			return res, err
+		}
+	}
+	if res.coldStore != nil {
+		return res, res.openColdSegments()
 	}
 	return res, nil
 }
 
+// Write the header of FormatVersion to the segment with id, which must be the latest one and be
+// empty. The segment is encrypted if the HPFile has an Encryption, and its empty tail record is
+// saved before the header.
+func (hpf *HPFile) writeHeader(id int) error {
+	header := FormatHeader(HPFileMagic, FormatVersion)
+	if hpf.encryption != nil {
+		if hpf.encryption.KeyID == 0 {
+			return errors.New("The key ID for encryption must not be 0")
+		}
+		aead, err := hpf.newAEAD(hpf.encryption.KeyID)
+		if err != nil {
+			return err
+		}
+		hpf.aeads[id] = aead
+		if err = hpf.saveTail(); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(header[12:16], hpf.encryption.KeyID)
+	}
+	_, err := hpf.fileMap[id].Write(header)
+	hpf.headerSizes[id] = FormatHeaderSize
+	return err
+}
+
+// The instruments are labeled with metrics.LabelFile=name, to distinguish different HPFiles
+func (hpf *HPFile) SetMetrics(reg metrics.Registry, name string) {
+	reg = metrics.OrNop(reg)
+	hpf.appendedBytes = reg.NewCounter(metrics.HPFileAppendedBytes, metrics.LabelFile, name)
+	hpf.preReadHits = reg.NewCounter(metrics.HPFilePreReadHits, metrics.LabelFile, name)
+	hpf.preReadMisses = reg.NewCounter(metrics.HPFilePreReadMisses, metrics.LabelFile, name)
+}
+
+func (hpf *HPFile) SetLogger(logger logging.Logger) {
+	hpf.logger = logging.OrNop(logger).With("module", "hpfile", "dir", hpf.dirName)
+}
+
 func (hpf *HPFile) InitPreReader() {
 	hpf.preReader.Init()
 }
@@ -106,9 +256,23 @@ func (hpf *HPFile) Size() int64 {
 }
 
 func (hpf *HPFile) Truncate(size int64) error {
+	hpf.movingMtx.Lock() // segments may be moved in background
+	defer hpf.movingMtx.Unlock()
+	hpf.mtx.Lock()
+	defer hpf.mtx.Unlock()
+	hpf.logger.Info("truncate", "oldSize", hpf.Size(), "newSize", size)
 	for size < int64(hpf.largestID)*int64(hpf.blockSize) {
-		f := hpf.fileMap[hpf.largestID]
+		f, ok := hpf.fileMap[hpf.largestID]
+		if !ok {
+			return fmt.Errorf("Can not truncate the segment %d in the cold tier", hpf.largestID)
+		}
 		err := f.Close()
+		if err == nil {
+			err = hpf.closeDirect(hpf.largestID)
+		}
+		if err == nil {
+			err = hpf.unmapSegment(hpf.largestID)
+		}
 		if err != nil {
 			return err
 		}
@@ -118,20 +282,47 @@ func (hpf *HPFile) Truncate(size int64) error {
 			return err
 		}
 		delete(hpf.fileMap, hpf.largestID)
+		delete(hpf.headerSizes, hpf.largestID)
+		delete(hpf.aeads, hpf.largestID)
 		hpf.largestID--
+		if hpf.aeads[hpf.largestID] != nil { // load the partial chunk of the closed segment
+			physSize, err := hpf.fileMap[hpf.largestID].Seek(0, io.SeekEnd)
+			var idx int64
+			if err == nil {
+				idx, hpf.tail, err = hpf.readLastChunk(hpf.largestID, physSize-hpf.headerSizes[hpf.largestID])
+			}
+			if err != nil {
+				return err
+			}
+			hpf.writtenSize = idx*EncryptionChunkSize + int64(len(hpf.tail))
+		}
+	}
+	err := hpf.unmapSegment(hpf.largestID) // it will be written again
+	if err != nil {
+		return err
 	}
 	size -= int64(hpf.largestID)*int64(hpf.blockSize)
-	err := hpf.fileMap[hpf.largestID].Close()
+	err = hpf.fileMap[hpf.largestID].Close()
 	if err != nil {
 		return err
 	}
 	fname := fmt.Sprintf("%s/%d-%d", hpf.dirName, hpf.largestID, hpf.blockSize)
-	hpf.fileMap[hpf.largestID], err = os.OpenFile(fname, os.O_RDWR, 0700)
+	f, err := os.OpenFile(fname, os.O_RDWR, 0700)
 	if err != nil {
 		return err
 	}
+	hpf.fileMap[hpf.largestID] = f
 	hpf.latestFileSize = size
-	return hpf.fileMap[hpf.largestID].Truncate(size)
+	if hpf.aeads[hpf.largestID] != nil {
+		return hpf.truncateEncrypted(size)
+	}
+	hpf.writtenSize = size
+	err = f.Truncate(size + hpf.headerSizes[hpf.largestID])
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, os.SEEK_END) // the following appending starts from the end
+	return err
 }
 
 func (hpf *HPFile) Flush() {
@@ -143,13 +334,18 @@ func (hpf *HPFile) Flush() {
 
 func (hpf *HPFile) flush() {
 	if len(hpf.buffer) != 0 {
-		_, err := hpf.fileMap[hpf.largestID].Write(hpf.buffer)
+		err := hpf.writeLatest(hpf.buffer)
 		if err != nil {
 			panic(err)
 		}
 		hpf.buffer = hpf.buffer[:0]
 	}
 	hpf.fileMap[hpf.largestID].Sync()
+	if hpf.tailDirty {
+		if err := hpf.saveTail(); err != nil {
+			panic(err)
+		}
+	}
 	//atomic.AddUint64(&TotalSyncTime, gotsc.BenchEnd() - start - tscOverhead)
 }
 
@@ -162,6 +358,7 @@ func (hpf *HPFile) FlushAsync() {
 }
 
 func (hpf *HPFile) Close() error {
+	hpf.movingWG.Wait()
 	hpf.mtx.Lock()
 	defer hpf.mtx.Unlock()
 	for _, file := range hpf.fileMap {
@@ -170,23 +367,51 @@ func (hpf *HPFile) Close() error {
 			return err
 		}
 	}
+	for _, file := range hpf.coldFiles {
+		err := file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	for id := range hpf.directFiles {
+		err := hpf.closeDirect(id)
+		if err != nil {
+			return err
+		}
+	}
+	for id := range hpf.mmaps {
+		err := hpf.unmapSegment(id)
+		if err != nil {
+			return err
+		}
+	}
+	if err := hpf.unmapRetired(math.MaxInt32); err != nil {
+		return err
+	}
+	if hpf.ring != nil {
+		return hpf.ring.Close()
+	}
 	return nil
 }
 
 func (hpf *HPFile) ReadAt(buf []byte, off int64, withBuf bool) (err error) {
 	hpf.mtx.RLock()
 	defer hpf.mtx.RUnlock()
+	if b, ok := hpf.mapped(off, len(buf)); ok {
+		copy(buf, b)
+		return nil
+	}
 	if withBuf {
 		return hpf.readAtWithBuf(buf, off)
 	}
 	//start := gotsc.BenchStart()
 	fileID := off / int64(hpf.blockSize)
 	pos := off % int64(hpf.blockSize)
-	f, ok := hpf.fileMap[int(fileID)]
+	f, ok := hpf.segmentReader(int(fileID))
 	if !ok {
 		return fmt.Errorf("Can not find the file with id=%d (%d/%d)", fileID, off, hpf.blockSize)
 	}
-	_, err = f.ReadAt(buf, pos)
+	_, err = hpf.readSegment(int(fileID), f, buf, pos)
 	//atomic.AddUint64(&TotalReadTime, gotsc.BenchEnd() - start - tscOverhead)
 	return
 }
@@ -194,21 +419,23 @@ func (hpf *HPFile) ReadAt(buf []byte, off int64, withBuf bool) (err error) {
 func (hpf *HPFile) readAtWithBuf(buf []byte, off int64) (err error) {
 	fileID := off / int64(hpf.blockSize)
 	pos := off % int64(hpf.blockSize)
-	f, ok := hpf.fileMap[int(fileID)]
+	f, ok := hpf.segmentReader(int(fileID))
 	if !ok {
 		return fmt.Errorf("Can not find the file with id=%d (%d/%d)", fileID, off, hpf.blockSize)
 	}
 
 	ok = hpf.preReader.TryRead(fileID, pos, buf)
 	if ok {
+		hpf.preReadHits.Add(1)
 		return nil
 	}
+	hpf.preReadMisses.Add(1)
 	if len(buf) >= PreReadBufSize || int(pos) + len(buf) > hpf.blockSize {
-		_, err = f.ReadAt(buf, pos)
+		_, err = hpf.readSegment(int(fileID), f, buf, pos)
 		return
 	}
 	part := hpf.preReader.GetToFill(fileID, pos, pos + PreReadBufSize)
-	n, err := f.ReadAt(part, pos)
+	n, err := hpf.readSegment(int(fileID), f, part, pos)
 	if err == io.EOF {
 		hpf.preReader.end = pos + int64(n)
 	} else if err != nil {
@@ -225,20 +452,19 @@ func (hpf *HPFile) Append(bufList [][]byte) (int64, error) {
 	//start := gotsc.BenchStart()
 	hpf.mtx.Lock()
 	defer hpf.mtx.Unlock()
-	f := hpf.fileMap[hpf.largestID]
 	startPos := int64(hpf.largestID*hpf.blockSize) + hpf.latestFileSize
 	for _, buf := range bufList {
 		if len(buf) > hpf.bufferSize {
 			panic("buf is too large")
 		}
+		hpf.appendedBytes.Add(float64(len(buf)))
 		hpf.latestFileSize += int64(len(buf))
 		extraBytes := len(hpf.buffer) + len(buf) - hpf.bufferSize
 		if extraBytes > 0 {
 			hpf.buffer = append(hpf.buffer, buf[:len(buf)-extraBytes]...)
 			buf = buf[len(buf)-extraBytes:]
 			//pos, _ := f.Seek(0, os.SEEK_END)
-			//fmt.Printf("Haha startPos %x: %x + %x > %x; real pos %x\n", startPos, len(hpf.buffer), len(buf), hpf.bufferSize, pos)
-			_, err := f.Write(hpf.buffer)
+			err := hpf.writeLatest(hpf.buffer)
 			if err != nil {
 				return 0, err
 			}
@@ -249,33 +475,81 @@ func (hpf *HPFile) Append(bufList [][]byte) (int64, error) {
 	overflowByteCount := hpf.latestFileSize - int64(hpf.blockSize)
 	if overflowByteCount >= 0 {
 		hpf.flush()
+		err := hpf.closeTail()
+		if err == nil {
+			err = hpf.mapSegment(hpf.largestID)
+		}
+		if err != nil {
+			return 0, err
+		}
 		hpf.largestID++
 		fname := fmt.Sprintf("%s/%d-%d", hpf.dirName, hpf.largestID, hpf.blockSize)
 		f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0700)
 		if err != nil {
 			return 0, err
 		}
+		hpf.fileMap[hpf.largestID] = f
+		hpf.writtenSize = 0
+		hpf.tail = nil
+		err = hpf.writeHeader(hpf.largestID)
+		if err != nil {
+			return 0, err
+		}
 		if overflowByteCount != 0 {
 			hpf.buffer = hpf.buffer[:overflowByteCount]
 			for i := 0; i < int(overflowByteCount); i++ {
 				hpf.buffer[i] = 0
 			}
 		}
-		hpf.fileMap[hpf.largestID] = f
 		hpf.latestFileSize = overflowByteCount
+		hpf.logger.Info("rotate", "fileID", hpf.largestID, "fileName", fname)
+		hpf.moveColdSegmentsAsync()
 	}
 	//atomic.AddUint64(&TotalWriteTime, gotsc.BenchEnd() - start - tscOverhead)
 	return startPos, nil
 }
 
 func (hpf *HPFile) PruneHead(off int64) error {
+	hpf.mtx.Lock()
+	defer hpf.mtx.Unlock()
 	fileID := off / int64(hpf.blockSize)
+	if err := hpf.unmapRetired(int(fileID)); err != nil {
+		return err
+	}
+	for id := range hpf.mmaps {
+		if id >= int(fileID) {
+			continue
+		}
+		err := hpf.unmapSegment(id)
+		if err != nil {
+			return err
+		}
+	}
+	for id, f := range hpf.coldFiles {
+		if id >= int(fileID) {
+			continue
+		}
+		err := f.Close()
+		if err == nil {
+			err = hpf.coldStore.Remove(hpf.coldName(id))
+		}
+		if err != nil {
+			return err
+		}
+		delete(hpf.coldFiles, id)
+		delete(hpf.headerSizes, id)
+		delete(hpf.aeads, id)
+		hpf.logger.Info("prune", "fileID", id, "coldName", hpf.coldName(id))
+	}
 	var idList []int
 	for id, f := range hpf.fileMap {
 		if id >= int(fileID) {
 			continue
 		}
 		err := f.Close()
+		if err == nil {
+			err = hpf.closeDirect(id)
+		}
 		if err != nil {
 			return err
 		}
@@ -283,11 +557,14 @@ func (hpf *HPFile) PruneHead(off int64) error {
 	}
 	for _, id := range idList {
 		delete(hpf.fileMap, id)
+		delete(hpf.headerSizes, id)
+		delete(hpf.aeads, id)
 		fname := fmt.Sprintf("%s/%d-%d", hpf.dirName, id, hpf.blockSize)
 		err := os.Remove(fname)
 		if err != nil {
 			return err
 		}
+		hpf.logger.Info("prune", "fileID", id, "fileName", fname)
 	}
 	return nil
 }
@@ -312,7 +589,7 @@ func (pr *PreReader) GetToFill(fileID, start, end int64) []byte {
 }
 
 func (pr *PreReader) TryRead(fileID, start int64, buf []byte) bool {
-	if fileID == pr.fileID && pr.start <= start && start + int64(len(buf)) < pr.end {
+	if fileID == pr.fileID && pr.start <= start && start + int64(len(buf)) <= pr.end {
 		copy(buf, pr.buf[start-pr.start:])
 		return true
 	}
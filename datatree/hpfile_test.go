@@ -1,8 +1,12 @@
 package datatree
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -133,3 +137,357 @@ func TestHPFile(t *testing.T) {
 
 
 
+
+func TestHPFileMixedVersions(t *testing.T) {
+	os.RemoveAll("./test")
+	os.Mkdir("./test", 0700)
+
+	hpfile, err := NewHPFile(64, 128, "./test")
+	assert.Equal(t, nil, err)
+	slice0 := newSlice(64, 1)
+	hpfile.Append([][]byte{slice0})
+	hpfile.Append([][]byte{slice0})
+	hpfile.Flush()
+	hpfile.Close()
+
+	// make the first segment a legacy one without header
+	bz, err := ioutil.ReadFile("./test/0-128")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 128+FormatHeaderSize, len(bz))
+	assert.Nil(t, ioutil.WriteFile("./test/0-128", bz[FormatHeaderSize:], 0700))
+
+	hpfile, err = NewHPFile(64, 128, "./test")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(128), hpfile.Size())
+	slice1 := newSlice(32, 2)
+	pos, err := hpfile.Append([][]byte{slice1})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(128), pos)
+	hpfile.Flush()
+
+	check := make([]byte, 64)
+	assert.Nil(t, hpfile.ReadAt(check, 64, false))
+	assert.Equal(t, slice0, check)
+	check = make([]byte, 32)
+	assert.Nil(t, hpfile.ReadAt(check, 128, false))
+	assert.Equal(t, slice1, check)
+	assert.Nil(t, hpfile.Truncate(136))
+	assert.Equal(t, int64(136), hpfile.Size())
+	pos, _ = hpfile.Append([][]byte{slice1[:8]})
+	assert.Equal(t, int64(136), pos)
+	hpfile.Flush()
+	check = make([]byte, 16)
+	assert.Nil(t, hpfile.ReadAt(check, 128, false))
+	assert.Equal(t, newSlice(16, 2), check)
+	hpfile.Close()
+
+	version, err := FileFormatVersion("./test/1-128", true)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint32(FormatVersion), version)
+	os.RemoveAll("./test")
+}
+
+func testEncryption(keyID uint32) *Encryption {
+	return &Encryption{
+		KeyID: keyID,
+		GetKey: func(keyID uint32) ([]byte, error) {
+			if keyID > 2 {
+				return nil, fmt.Errorf("Unknown key %d", keyID)
+			}
+			return bytes.Repeat([]byte{byte(keyID)}, 32), nil
+		},
+	}
+}
+
+func TestHPFileEncryption(t *testing.T) {
+	os.RemoveAll("./test")
+	os.Mkdir("./test", 0700)
+
+	opts := HPFileOptions{Encryption: testEncryption(1)}
+	hpfile, err := NewHPFileWithOptions(1024, 16*1024, "./test", opts)
+	assert.Equal(t, nil, err)
+	hpfile.InitPreReader()
+	var content []byte
+	var posList []int64
+	for i := 0; i < 100; i++ {
+		slice := newSlice(100+i*7%500, byte(i))
+		pos, err := hpfile.Append([][]byte{slice})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, int64(len(content)), pos)
+		posList = append(posList, pos)
+		content = append(content, slice...)
+	}
+	hpfile.Flush()
+	check := func(hpfile *HPFile, size int) {
+		assert.Equal(t, int64(size), hpfile.Size())
+		for i, pos := range posList {
+			end := len(content)
+			if i+1 < len(posList) {
+				end = int(posList[i+1])
+			}
+			if end > size {
+				break
+			}
+			buf := make([]byte, end-int(pos))
+			assert.Nil(t, hpfile.ReadAt(buf, pos, i%2 == 0 && end < size))
+			assert.Equal(t, content[pos:end], buf)
+		}
+	}
+	check(&hpfile, len(content))
+	hpfile.Close()
+
+	// the segments hold no plaintext
+	bz, err := ioutil.ReadFile("./test/0-16384")
+	assert.Equal(t, nil, err)
+	assert.False(t, bytes.Contains(bz, newSlice(100, 0)))
+
+	// a truncated segment is still readable and appendable
+	hpfile, err = NewHPFileWithOptions(1024, 16*1024, "./test", opts)
+	assert.Equal(t, nil, err)
+	hpfile.InitPreReader()
+	check(&hpfile, len(content))
+	size := int(posList[60]) + 5000
+	assert.Nil(t, hpfile.Truncate(int64(size)))
+	content = content[:size]
+	posList = posList[:61]
+	check(&hpfile, size)
+	for i := 0; i < 30; i++ {
+		slice := newSlice(300, byte(200+i))
+		pos, _ := hpfile.Append([][]byte{slice})
+		posList = append(posList, pos)
+		content = append(content, slice...)
+	}
+	hpfile.Flush()
+	check(&hpfile, len(content))
+	hpfile.Close()
+
+	// rotate the key: the new segments use the new key, and the old ones are still readable
+	opts = HPFileOptions{Encryption: testEncryption(2)}
+	hpfile, err = NewHPFileWithOptions(1024, 16*1024, "./test", opts)
+	assert.Equal(t, nil, err)
+	hpfile.InitPreReader()
+	for len(content) < 3*16*1024 {
+		slice := newSlice(800, byte(len(posList)))
+		pos, _ := hpfile.Append([][]byte{slice})
+		posList = append(posList, pos)
+		content = append(content, slice...)
+	}
+	hpfile.Flush()
+	check(&hpfile, len(content))
+	assert.Nil(t, hpfile.PruneHead(16*1024))
+	hpfile.Close()
+
+	_, err = NewHPFile(1024, 16*1024, "./test")
+	assert.NotNil(t, err)
+	// a wrong key fails the authentication
+	opts.Encryption.GetKey = func(keyID uint32) ([]byte, error) {
+		return make([]byte, 32), nil
+	}
+	_, err = NewHPFileWithOptions(1024, 16*1024, "./test", opts)
+	assert.NotNil(t, err)
+	os.RemoveAll("./test")
+}
+
+func TestHPFileEncryptionTornTail(t *testing.T) {
+	os.RemoveAll("./test")
+	os.Mkdir("./test", 0700)
+
+	opts := HPFileOptions{Encryption: testEncryption(1)}
+	hpfile, err := NewHPFileWithOptions(1024, 64*1024, "./test", opts)
+	assert.Equal(t, nil, err)
+	content := newSlice(1000, 1)
+	for i := 0; i < 10; i++ {
+		_, err = hpfile.Append([][]byte{content[i*100 : i*100+100]})
+		assert.Equal(t, nil, err)
+	}
+	hpfile.Flush()
+	check := func(hpfile *HPFile) {
+		assert.Equal(t, int64(len(content)), hpfile.Size())
+		buf := make([]byte, len(content))
+		assert.Nil(t, hpfile.ReadAt(buf, 0, false))
+		assert.Equal(t, content, buf)
+	}
+	check(&hpfile)
+	// the partial chunk is only in the tail record
+	fileInfo, err := os.Stat("./test/0-65536")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(FormatHeaderSize), fileInfo.Size())
+	tailName := "./test/" + encTailDir + "/" + encTailName
+	committedTail, err := ioutil.ReadFile(tailName)
+	assert.Equal(t, nil, err)
+
+	// crash when the chunks after the committed tail are half written, before the tail record
+	// is replaced
+	for i := 0; i < 50; i++ {
+		_, err = hpfile.Append([][]byte{newSlice(100, byte(i+2))})
+		assert.Equal(t, nil, err)
+	}
+	hpfile.Flush()
+	hpfile.Close()
+	assert.Nil(t, ioutil.WriteFile(tailName, committedTail, 0700))
+	f, err := os.OpenFile("./test/0-65536", os.O_RDWR, 0700)
+	assert.Equal(t, nil, err)
+	_, err = f.WriteAt(newSlice(encChunkPhysSize/2, 0), FormatHeaderSize+encChunkPhysSize/4)
+	assert.Equal(t, nil, err)
+	assert.Nil(t, f.Truncate(FormatHeaderSize+encChunkPhysSize*3/4))
+	f.Close()
+
+	hpfile, err = NewHPFileWithOptions(1024, 64*1024, "./test", opts)
+	assert.Equal(t, nil, err)
+	check(&hpfile)
+	for i := 0; i < 50; i++ {
+		slice := newSlice(100, byte(i+100))
+		_, err = hpfile.Append([][]byte{slice})
+		assert.Equal(t, nil, err)
+		content = append(content, slice...)
+	}
+	hpfile.Flush()
+	check(&hpfile)
+
+	// a segment written before the tail records, whose partial chunk is at its end
+	assert.Nil(t, hpfile.closeTail())
+	hpfile.Close()
+	os.RemoveAll("./test/" + encTailDir)
+	hpfile, err = NewHPFileWithOptions(1024, 64*1024, "./test", opts)
+	assert.Equal(t, nil, err)
+	check(&hpfile)
+	hpfile.Close()
+	hpfile, err = NewHPFileWithOptions(1024, 64*1024, "./test", opts)
+	assert.Equal(t, nil, err)
+	check(&hpfile)
+	hpfile.Close()
+	os.RemoveAll("./test")
+}
+
+func TestHPFileTiering(t *testing.T) {
+	os.RemoveAll("./test")
+	os.RemoveAll("./cold")
+	os.Mkdir("./test", 0700)
+
+	coldStore, err := NewDirColdStore("./cold")
+	assert.Equal(t, nil, err)
+	opts := HPFileOptions{Encryption: testEncryption(1), ColdStore: coldStore, HotSegments: 2}
+	hpfile, err := NewHPFileWithOptions(64, 128, "./test", opts)
+	assert.Equal(t, nil, err)
+	var content []byte
+	for i := 0; i < 40; i++ {
+		slice := newSlice(32, byte(i))
+		pos, err := hpfile.Append([][]byte{slice})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, int64(len(content)), pos)
+		content = append(content, slice...)
+	}
+	hpfile.Flush()
+	assert.Nil(t, hpfile.MoveColdSegments())
+	check := func(hpfile *HPFile, start int) {
+		for pos := start; pos < len(content); pos += 32 {
+			buf := make([]byte, 32)
+			assert.Nil(t, hpfile.ReadAt(buf, int64(pos), false))
+			assert.Equal(t, content[pos:pos+32], buf)
+		}
+	}
+	check(&hpfile, 0)
+	hot, _ := filepath.Glob("./test/*-128")
+	assert.Equal(t, 2, len(hot)) // the segments 9 and 10
+	cold, err := coldStore.List("test")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 9, len(cold))
+	hpfile.Close()
+
+	hpfile, err = NewHPFileWithOptions(64, 128, "./test", opts)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(len(content)), hpfile.Size())
+	check(&hpfile, 0)
+	assert.Nil(t, hpfile.PruneHead(3*128))
+	cold, _ = coldStore.List("test")
+	assert.Equal(t, 6, len(cold))
+	check(&hpfile, 3*128)
+	hpfile.Close()
+
+	// the cold segments can not be read without the cold store
+	hpfile, err = NewHPFileWithOptions(64, 128, "./test", HPFileOptions{Encryption: testEncryption(1)})
+	assert.Equal(t, nil, err)
+	assert.NotNil(t, hpfile.ReadAt(make([]byte, 32), 4*128, false))
+	check(&hpfile, 9*128)
+	hpfile.Close()
+	os.RemoveAll("./test")
+	os.RemoveAll("./cold")
+}
+
+func TestHPFileMmap(t *testing.T) {
+	os.RemoveAll("./test")
+	os.RemoveAll("./cold")
+	os.Mkdir("./test", 0700)
+
+	coldStore, err := NewDirColdStore("./cold")
+	assert.Equal(t, nil, err)
+	opts := HPFileOptions{Mmap: true, ColdStore: coldStore, HotSegments: 4}
+	hpfile, err := NewHPFileWithOptions(64, 128, "./test", opts)
+	hpfile.hotSegments = 100 // no segment is moved in background
+	assert.Equal(t, nil, err)
+	var content []byte
+	for i := 0; i < 40; i++ {
+		slice := newSlice(32, byte(i))
+		_, err := hpfile.Append([][]byte{slice})
+		assert.Equal(t, nil, err)
+		content = append(content, slice...)
+	}
+	hpfile.Flush()
+	check := func(hpfile *HPFile, start int) {
+		for pos := start; pos < len(content); pos += 32 {
+			buf := make([]byte, 32)
+			assert.Nil(t, hpfile.ReadAt(buf, int64(pos), false))
+			assert.Equal(t, content[pos:pos+32], buf)
+		}
+	}
+	check(&hpfile, 0)
+	assert.Equal(t, 10, len(hpfile.mmaps)) // all but the latest one
+	b, ok := hpfile.readMapped(5*128+32, 32)
+	assert.True(t, ok)
+	assert.Equal(t, content[5*128+32:5*128+64], b)
+	_, ok = hpfile.readMapped(10*128, 32)
+	assert.False(t, ok)
+
+	// the mappings of the segments moved to the cold tier are retired, and the slices returned
+	// before stay valid until PruneHead removes their segments
+	hpfile.hotSegments = 4
+	assert.Nil(t, hpfile.MoveColdSegments())
+	assert.Equal(t, 3, len(hpfile.mmaps)) // 7, 8 and 9
+	assert.Equal(t, 7, len(hpfile.retiredMmaps))
+	_, err = os.Stat("./test/5-128")
+	assert.True(t, os.IsNotExist(err))
+	_, ok = hpfile.readMapped(5*128+32, 32)
+	assert.False(t, ok)
+	assert.Equal(t, content[5*128+32:5*128+64], b)
+	check(&hpfile, 0)
+	assert.Nil(t, hpfile.PruneHead(3*128))
+	assert.Equal(t, 4, len(hpfile.retiredMmaps)) // 3, 4, 5 and 6
+	assert.Equal(t, content[5*128+32:5*128+64], b)
+	assert.Equal(t, 3, len(hpfile.mmaps))
+	_, ok = hpfile.readMapped(2*128, 32)
+	assert.False(t, ok)
+	check(&hpfile, 3*128)
+	assert.Nil(t, hpfile.PruneHead(6*128))
+	assert.Equal(t, 1, len(hpfile.retiredMmaps)) // 6
+	check(&hpfile, 6*128)
+
+	// a segment becoming the latest one again is unmapped
+	assert.Nil(t, hpfile.Truncate(9*128+64))
+	assert.Equal(t, 2, len(hpfile.mmaps))
+	content = content[:9*128+64]
+	slice := newSlice(32, 99)
+	_, err = hpfile.Append([][]byte{slice})
+	assert.Equal(t, nil, err)
+	content = append(content, slice...)
+	hpfile.Flush()
+	check(&hpfile, 6*128)
+	hpfile.Close()
+
+	hpfile, err = NewHPFileWithOptions(64, 128, "./test", opts)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(hpfile.mmaps)) // 7 and 8, while 6 is in the cold tier
+	check(&hpfile, 6*128)
+	hpfile.Close()
+	os.RemoveAll("./test")
+	os.RemoveAll("./cold")
+}
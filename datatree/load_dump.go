@@ -2,6 +2,7 @@ package datatree
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/mmcloughlin/meow"
 
+	"github.com/coinexchain/onvakv/logging"
 	"github.com/coinexchain/onvakv/types"
 )
 
@@ -204,6 +206,9 @@ func (tree *Tree) Flush() {
 		panic(err)
 	}
 	defer twigFile.Close()
+	if err = writeDumpHeader(twigFile); err != nil {
+		panic(err)
+	}
 	for _, twigID := range twigList {
 		tree.activeTwigs[twigID].Dump(twigID, twigFile)
 	}
@@ -213,6 +218,9 @@ func (tree *Tree) Flush() {
 		panic(err)
 	}
 	defer nodesFile.Close()
+	if err = writeDumpHeader(nodesFile); err != nil {
+		panic(err)
+	}
 	err = tree.DumpNodes(nodesFile)
 	if err != nil {
 		panic(err)
@@ -223,6 +231,9 @@ func (tree *Tree) Flush() {
 		panic(err)
 	}
 	defer mt4ytFile.Close()
+	if err = writeDumpHeader(mt4ytFile); err != nil {
+		panic(err)
+	}
 	err = tree.DumpMtree4YT(mt4ytFile)
 	if err != nil {
 		panic(err)
@@ -230,13 +241,18 @@ func (tree *Tree) Flush() {
 }
 
 func LoadTree(bufferSize, blockSize int, dirName string) *Tree {
+	return LoadTreeWithOptions(bufferSize, blockSize, dirName, HPFileOptions{})
+}
+
+// Like LoadTree, but the entry file and the twig Merkle tree file are opened with opts
+func LoadTreeWithOptions(bufferSize, blockSize int, dirName string, opts HPFileOptions) *Tree {
 	dirEntry := filepath.Join(dirName, entriesPath)
-	entryFile, err := NewEntryFile(bufferSize, blockSize, dirEntry)
+	entryFile, err := NewEntryFileWithOptions(bufferSize, blockSize, dirEntry, opts)
 	if err != nil {
 		panic(err)
 	}
 	dirTwigMt := filepath.Join(dirName, twigMtPath)
-	twigMtFile, err := NewTwigMtFile(bufferSize, blockSize, dirTwigMt)
+	twigMtFile, err := NewTwigMtFileWithOptions(bufferSize, blockSize, dirTwigMt, opts)
 	if err != nil {
 		panic(err)
 	}
@@ -260,6 +276,9 @@ func LoadTree(bufferSize, blockSize int, dirName string) *Tree {
 		panic(err)
 	}
 	defer twigFile.Close()
+	if _, err = readDumpHeader(twigFile); err != nil {
+		panic(err)
+	}
 	for {
 		twigID, twig, err := LoadTwigFromFile(twigFile)
 		if err == io.EOF {
@@ -268,7 +287,6 @@ func LoadTree(bufferSize, blockSize int, dirName string) *Tree {
 		if err != nil {
 			panic(err)
 		}
-		//fmt.Printf("Twig %d is loaded\n", twigID)
 		tree.activeTwigs[twigID] = &twig
 		if tree.youngestTwigID < twigID {
 			tree.youngestTwigID = twigID
@@ -280,6 +298,9 @@ func LoadTree(bufferSize, blockSize int, dirName string) *Tree {
 		panic(err)
 	}
 	defer nodesFile.Close()
+	if _, err = readDumpHeader(nodesFile); err != nil {
+		panic(err)
+	}
 	err = tree.LoadNodes(nodesFile)
 	if err != nil {
 		panic(err)
@@ -290,14 +311,30 @@ func LoadTree(bufferSize, blockSize int, dirName string) *Tree {
 		panic(err)
 	}
 	defer mt4ytFile.Close()
+	if _, err = readDumpHeader(mt4ytFile); err != nil {
+		panic(err)
+	}
 	err = tree.LoadMtree4YT(mt4ytFile)
 	if err != nil {
 		panic(err)
 	}
+	tree.SetMetrics(nil)
+	tree.SetLogger(logging.Default())
+	tree.logger.Info("load tree", "activeTwigs", len(tree.activeTwigs), "nodes", len(tree.nodes),
+		"youngestTwigID", tree.youngestTwigID)
 	return tree
 }
 
-func (tree *Tree) RecoverEntry(pos int64, entry *Entry, deactivedSNList []int64, oldestActiveTwigID int64) {
+// Recover the states of the entry whose raw bytes (with its list of deactived serial numbers)
+// are entryBz. The leaf is the hash of entryBz, so entries of any format can be recovered.
+func (tree *Tree) RecoverEntry(pos int64, entryBz []byte, oldestActiveTwigID int64) {
+	numberOfSN := int(entryBz[0])
+	snStart := len(entryBz) - 8*numberOfSN
+	deactivedSNList := make([]int64, numberOfSN)
+	for i := range deactivedSNList {
+		deactivedSNList[i] = int64(binary.LittleEndian.Uint64(entryBz[snStart+8*i:]))
+	}
+	serialNum := ExtractSerialNum(entryBz[:snStart])
 	// deactive some old entry
 	for _, sn := range deactivedSNList {
 		twigID := sn >> TwigShift
@@ -306,21 +343,20 @@ func (tree *Tree) RecoverEntry(pos int64, entry *Entry, deactivedSNList []int64,
 		}
 	}
 	//update youngestTwigID
-	twigID := entry.SerialNum >> TwigShift
+	twigID := serialNum >> TwigShift
 	tree.youngestTwigID = twigID
 	// mark this entry as valid
-	tree.ActiviateEntry(entry.SerialNum)
+	tree.ActiviateEntry(serialNum)
 	// record ChangeStart/ChangeEnd for endblock sync
-	position := int(entry.SerialNum & TwigMask)
+	position := int(serialNum & TwigMask)
 	if tree.mtree4YTChangeStart == -1 {
 		tree.mtree4YTChangeStart = position
 	}
 	tree.mtree4YTChangeEnd = position
 
 	// update the corresponding leaf of merkle tree
-	bz := EntryToBytes(*entry, deactivedSNList)
-	idx := entry.SerialNum & TwigMask
-	copy(tree.mtree4YoungestTwig[LeafCountInTwig+idx][:], hash(bz))
+	idx := serialNum & TwigMask
+	copy(tree.mtree4YoungestTwig[LeafCountInTwig+idx][:], hash(entryBz))
 
 	if idx == 0 { // when this is the first entry of current twig
 		tree.activeTwigs[twigID].FirstEntryPos = pos
@@ -335,48 +371,102 @@ func (tree *Tree) RecoverEntry(pos int64, entry *Entry, deactivedSNList []int64,
 }
 
 func (tree *Tree) ScanEntries(oldestActiveTwigID int64, outChan chan types.EntryX) {
+	tree.ScanEntriesCtx(context.Background(), oldestActiveTwigID, outChan)
+}
+
+// Send the entries starting from the oldest active twig to outChan, and close outChan at the end.
+// When ctx is cancelled, it closes outChan and returns ctx.Err() without sending the rest entries.
+func (tree *Tree) ScanEntriesCtx(ctx context.Context, oldestActiveTwigID int64, outChan chan types.EntryX) error {
+	defer close(outChan)
 	pos := tree.twigMtFile.GetFirstEntryPos(oldestActiveTwigID)
 	size := tree.entryFile.Size()
-	for pos < size {
-		//!! if pos > 108995312 {
-		//!! 	entryBz, nxt := tree.entryFile.ReadEntryRawBytes(pos)
-		//!! 	fmt.Printf("Fuck now pos %d %#v len=%d nxt=%d\n", pos, entryBz, len(entryBz), nxt)
-		//!! }
+	for pos < size && ctx.Err() == nil {
 		key, deactivedSNList, nextPos := tree.entryFile.ReadEntryAndSNList(pos)
-		outChan <- types.EntryX{key, pos, deactivedSNList}
+		select {
+		case outChan <- types.EntryX{key, pos, deactivedSNList}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		pos = nextPos
+	}
+	return ctx.Err()
+}
+
+type rawEntry struct {
+	pos     int64
+	entryBz []byte
+}
+
+// Like ScanEntriesCtx, but sends the raw bytes of entries with their lists of deactived serial numbers
+func (tree *Tree) scanRawEntriesCtx(ctx context.Context, oldestActiveTwigID int64, outChan chan rawEntry) error {
+	defer close(outChan)
+	pos := tree.twigMtFile.GetFirstEntryPos(oldestActiveTwigID)
+	size := tree.entryFile.Size()
+	for pos < size && ctx.Err() == nil {
+		entryBz, nextPos := tree.entryFile.ReadEntryRawBytesWithSNList(pos)
+		select {
+		case outChan <- rawEntry{pos, entryBz}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		pos = nextPos
 	}
-	close(outChan)
+	return ctx.Err()
 }
 
 func (tree *Tree) ScanEntriesLite(oldestActiveTwigID int64, outChan chan types.KeyAndPos) {
+	tree.ScanEntriesLiteCtx(context.Background(), oldestActiveTwigID, outChan)
+}
+
+// Like ScanEntriesCtx, but only sends the keys and the positions of entries
+func (tree *Tree) ScanEntriesLiteCtx(ctx context.Context, oldestActiveTwigID int64, outChan chan types.KeyAndPos) error {
+	defer close(outChan)
 	pos := tree.twigMtFile.GetFirstEntryPos(oldestActiveTwigID)
 	size := tree.entryFile.Size()
-	for pos < size {
+	for pos < size && ctx.Err() == nil {
 		entryBz, next := tree.entryFile.ReadEntryRawBytes(pos)
-		outChan <- types.KeyAndPos{ExtractKeyFromRawBytes(entryBz), pos}
+		select {
+		case outChan <- types.KeyAndPos{ExtractKeyFromRawBytes(entryBz), PackEntryPos(pos, int(next-pos))}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		pos = next
 	}
-	close(outChan)
+	return ctx.Err()
 }
 
 func (tree *Tree) RecoverActiveTwigs(oldestActiveTwigID int64) []int64 {
-	entryXChan := make(chan types.EntryX, 100)
-	go tree.ScanEntries(oldestActiveTwigID, entryXChan)
-	for e := range entryXChan {
-		tree.RecoverEntry(e.Pos, e.Entry, e.DeactivedSNList, oldestActiveTwigID)
+	nList, err := tree.RecoverActiveTwigsCtx(context.Background(), oldestActiveTwigID)
+	if err != nil {
+		panic(err)
 	}
+	return nList
+}
+
+func (tree *Tree) RecoverActiveTwigsCtx(ctx context.Context, oldestActiveTwigID int64) ([]int64, error) {
+	rawChan := make(chan rawEntry, 100)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- tree.scanRawEntriesCtx(ctx, oldestActiveTwigID, rawChan)
+	}()
+	count := 0
+	for e := range rawChan {
+		tree.RecoverEntry(e.pos, e.entryBz, oldestActiveTwigID)
+		count++
+	}
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+	tree.logger.Info("recover active twigs", "entries", count, "youngestTwigID", tree.youngestTwigID)
 	tree.syncMT4YoungestTwig()
-	//fmt.Printf("RecoverActiveTwigs touchedPosOf512b %v\n", tree.touchedPosOf512b)
 	idList := make([]int, 0, len(tree.activeTwigs))
 	for id := range tree.activeTwigs {
 		idList = append(idList, int(id))
 	}
 	sort.Ints(idList)
-	//fmt.Printf("RecoverActiveTwigs activeTwigs %v\n", idList)
 	nList := tree.syncMT4ActiveBits()
 	tree.touchedPosOf512b = make(map[int64]struct{}) // clear the list
-	return nList
+	return nList, nil
 }
 
 func (tree *Tree) RecoverUpperNodes(edgeNodes []*EdgeNode, nList []int64) {
@@ -384,9 +474,7 @@ func (tree *Tree) RecoverUpperNodes(edgeNodes []*EdgeNode, nList []int64) {
 		var buf [32]byte
 		copy(buf[:], edgeNode.Value)
 		tree.nodes[edgeNode.Pos] = &buf
-		//fmt.Printf("EdgeNode %d-%d\n", int64(edgeNode.Pos)>>56, (int64(edgeNode.Pos)<<8)>>8)
 	}
-	//fmt.Printf("syncUpperNodes %v\n", nList)
 	//if len(nList) > 0 && nList[0] >= 2438 {Debug = true}
 	tree.syncUpperNodes(nList)
 	//Debug = false
@@ -396,7 +484,10 @@ func (tree *Tree) RecoverInactiveTwigRoots(lastPrunedTwigID, oldestActiveTwigID
 	newList = make([]int64, 0, 1 + (oldestActiveTwigID-lastPrunedTwigID)/2)
 	for twigID := lastPrunedTwigID; twigID < oldestActiveTwigID; twigID++ {
 		var twigRoot [32]byte
-		leftRoot := tree.twigMtFile.GetHashNode(twigID, 1)
+		leftRoot, err := tree.twigMtFile.GetHashNode(twigID, 1)
+		if err != nil {
+			panic(err)
+		}
 		copy(twigRoot[:], hash2(11, leftRoot[:], NullTwig.activeBitsMTL3[:]))
 		pos := Pos(FirstLevelAboveTwig-1, twigID)
 		tree.nodes[pos] = &twigRoot
@@ -408,13 +499,32 @@ func (tree *Tree) RecoverInactiveTwigRoots(lastPrunedTwigID, oldestActiveTwigID
 }
 
 func RecoverTree(bufferSize, blockSize int, dirName string, edgeNodes []*EdgeNode, lastPrunedTwigID, oldestActiveTwigID, youngestTwigID int64) *Tree {
+	tree, err := RecoverTreeCtx(context.Background(), bufferSize, blockSize, dirName, edgeNodes,
+		lastPrunedTwigID, oldestActiveTwigID, youngestTwigID)
+	if err != nil {
+		panic(err)
+	}
+	return tree
+}
+
+// Like RecoverTree, but scanning the entry file can be aborted by cancelling ctx. In that case,
+// the opened files are closed and ctx.Err() is returned.
+func RecoverTreeCtx(ctx context.Context, bufferSize, blockSize int, dirName string, edgeNodes []*EdgeNode,
+	lastPrunedTwigID, oldestActiveTwigID, youngestTwigID int64) (*Tree, error) {
+	return RecoverTreeWithOptions(ctx, bufferSize, blockSize, dirName, edgeNodes,
+		lastPrunedTwigID, oldestActiveTwigID, youngestTwigID, HPFileOptions{})
+}
+
+// Like RecoverTreeCtx, but the entry file and the twig Merkle tree file are opened with opts
+func RecoverTreeWithOptions(ctx context.Context, bufferSize, blockSize int, dirName string, edgeNodes []*EdgeNode,
+	lastPrunedTwigID, oldestActiveTwigID, youngestTwigID int64, opts HPFileOptions) (*Tree, error) {
 	dirEntry := filepath.Join(dirName, entriesPath)
-	entryFile, err := NewEntryFile(bufferSize, blockSize, dirEntry)
+	entryFile, err := NewEntryFileWithOptions(bufferSize, blockSize, dirEntry, opts)
 	if err != nil {
 		panic(err)
 	}
 	dirTwigMt := filepath.Join(dirName, twigMtPath)
-	twigMtFile, err := NewTwigMtFile(bufferSize, blockSize, dirTwigMt)
+	twigMtFile, err := NewTwigMtFileWithOptions(bufferSize, blockSize, dirTwigMt, opts)
 	if err != nil {
 		panic(err)
 	}
@@ -433,6 +543,10 @@ func RecoverTree(bufferSize, blockSize int, dirName string, edgeNodes []*EdgeNod
 		touchedPosOf512b:    make(map[int64]struct{}),
 		deactivedSNList:     make([]int64, 0, 10),
 	}
+	tree.SetMetrics(nil)
+	tree.SetLogger(logging.Default())
+	tree.logger.Info("recover tree", "lastPrunedTwigID", lastPrunedTwigID,
+		"oldestActiveTwigID", oldestActiveTwigID, "youngestTwigID", youngestTwigID, "edgeNodes", len(edgeNodes))
 	tree.activeTwigs[oldestActiveTwigID] = CopyNullTwig()
 	tree.mtree4YoungestTwig = NullMT4Twig
 	startingInactiveTwigID := lastPrunedTwigID
@@ -440,9 +554,11 @@ func RecoverTree(bufferSize, blockSize int, dirName string, edgeNodes []*EdgeNod
 		startingInactiveTwigID--
 	}
 	nList0 := tree.RecoverInactiveTwigRoots(startingInactiveTwigID, oldestActiveTwigID)
-	//fmt.Printf("Here lastPrunedTwigID %d oldestActiveTwigID %d nList0:%v\n", lastPrunedTwigID, oldestActiveTwigID, nList0)
-	nList := tree.RecoverActiveTwigs(oldestActiveTwigID)
-	//fmt.Printf("Here nList:%v\n", nList)
+	nList, err := tree.RecoverActiveTwigsCtx(ctx, oldestActiveTwigID)
+	if err != nil {
+		tree.Close()
+		return nil, err
+	}
 	var newList []int64
 	if len(nList0) > 0 && len(nList) > 0 && nList0[len(nList0)-1] == nList[0] {
 		newList = append(nList0, nList[1:]...)
@@ -450,13 +566,12 @@ func RecoverTree(bufferSize, blockSize int, dirName string, edgeNodes []*EdgeNod
 		newList = append(nList0, nList...)
 	}
 	tree.RecoverUpperNodes(edgeNodes, newList)
-	return tree
+	return tree, nil
 }
 
 func CompareTreeTwigs(treeA, treeB *Tree) {
 	for twigID, a := range treeA.activeTwigs {
 		b := treeB.activeTwigs[twigID]
-		//!! fmt.Printf("twigID %d of %d\n", twigID, len(treeA.activeTwigs))
 		CompareTwig(twigID, a, b)
 	}
 }
@@ -465,16 +580,15 @@ func CompareTreeNodes(treeA, treeB *Tree) {
 	if len(treeA.nodes) != len(treeB.nodes) {
 		panic("Different nodes count")
 	}
-	allSame := true
+	var diffList []string
 	for pos, hashA := range treeA.nodes {
 		hashB := treeB.nodes[pos]
 		if !bytes.Equal(hashA[:], hashB[:]) {
-			fmt.Printf("Different Hash %d-%d", int64(pos)>>56, (int64(pos)<<8)>>8)
-			allSame = false
+			diffList = append(diffList, fmt.Sprintf("%d-%d", int64(pos)>>56, (int64(pos)<<8)>>8))
 		}
 	}
-	if !allSame {
-		panic("Nodes Differ")
+	if len(diffList) != 0 {
+		panic(fmt.Sprintf("Nodes Differ: %v", diffList))
 	}
 }
 
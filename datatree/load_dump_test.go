@@ -1,11 +1,18 @@
 package datatree
 
 import (
-	"os"
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/mmcloughlin/meow"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/coinexchain/onvakv/types"
 )
 
 
@@ -59,3 +66,349 @@ func TestLoadTree(t *testing.T) {
 
 	os.RemoveAll(dirName)
 }
+
+func TestScanCancel(t *testing.T) {
+	dirName := "./DataTree"
+	os.RemoveAll(dirName)
+	os.Mkdir(dirName, 0700)
+	tree, _, _ := buildTestTree(dirName, nil, TwigMask, 6)
+	tree.EndBlock()
+	tree.Flush()
+
+	// a complete scan returns nil
+	keyAndPosChan := make(chan types.KeyAndPos, 100)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- tree.ScanEntriesLiteCtx(context.Background(), 0, keyAndPosChan)
+	}()
+	count := 0
+	for range keyAndPosChan {
+		count++
+	}
+	assert.Equal(t, nil, <-errChan)
+	assert.Equal(t, true, count > 100)
+
+	// an abandoned consumer does not leak the producer
+	ctx, cancel := context.WithCancel(context.Background())
+	entryXChan := make(chan types.EntryX)
+	go func() {
+		errChan <- tree.ScanEntriesCtx(ctx, 0, entryXChan)
+	}()
+	<-entryXChan
+	cancel()
+	assert.Equal(t, context.Canceled, <-errChan)
+	for range entryXChan { // it must be closed
+	}
+
+	entryBzChan := make(chan []byte)
+	err := tree.GetActiveEntriesInTwigCtx(ctx, 0, entryBzChan)
+	assert.Equal(t, context.Canceled, err)
+	_, ok := <-entryBzChan
+	assert.Equal(t, false, ok)
+	tree.Close()
+
+	tree2, err := RecoverTreeCtx(ctx, SmallBufferSize, defaultFileSize, dirName, nil, 0, 0, 1)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, tree2)
+
+	os.RemoveAll(dirName)
+}
+
+func TestScanSortedRuns(t *testing.T) {
+	testScanSortedRuns(t, HPFileOptions{})
+	testScanSortedRuns(t, HPFileOptions{Encryption: testEncryption(1)})
+}
+
+func testScanSortedRuns(t *testing.T, opts HPFileOptions) {
+	dirName := "./DataTree"
+	os.RemoveAll(dirName)
+	os.Mkdir(dirName, 0700)
+	tree := NewEmptyTreeWithOptions(SmallBufferSize, 64*1024, dirName, opts)
+	entry := &Entry{
+		NextKey:    []byte("nextkey"),
+		Height:     100,
+		LastHeight: 99,
+	}
+	// the latest active position of each key
+	expected := make(map[string]int64)
+	for i := 0; i < 3*LeafCountInTwig+100; i++ {
+		entry.Key = []byte(fmt.Sprintf("key%d", i%1500))
+		entry.Value = bytes.Repeat([]byte("v"), i%300)
+		entry.SerialNum = int64(i)
+		pos := tree.AppendEntry(entry)
+		if i%7 != 0 || i < 1500 {
+			expected[string(entry.Key)] = pos
+		}
+	}
+	for i := 1505; i < 3*LeafCountInTwig+100; i += 7 {
+		tree.DeactiviateEntry(int64(i))
+	}
+	tree.EndBlock()
+	tree.Flush()
+
+	// return the number of runs
+	check := func(workers int) int {
+		runs, err := tree.ScanSortedRunsCtx(context.Background(), 0, workers)
+		assert.Nil(t, err)
+		runCount := len(runs.(*runMerger).runs)
+		var lastKey []byte
+		count := 0
+		for e, ok := runs.Next(); ok; e, ok = runs.Next() {
+			assert.Equal(t, true, bytes.Compare(lastKey, e.Key) < 0)
+			assert.Equal(t, expected[string(e.Key)], e.Pos)
+			lastKey = e.Key
+			count++
+		}
+		assert.Equal(t, len(expected), count)
+		if opts.Encryption != nil { // no plaintext keys are spilled
+			fnames, _ := filepath.Glob(filepath.Join(dirName, sortedRunsPath, "*"))
+			for _, fname := range fnames {
+				bz, err := ioutil.ReadFile(fname)
+				assert.Nil(t, err)
+				assert.Equal(t, false, bytes.Contains(bz, []byte("key1")))
+			}
+		}
+		runs.Close()
+		_, err = os.Stat(filepath.Join(dirName, sortedRunsPath))
+		assert.Equal(t, true, os.IsNotExist(err))
+		return runCount
+	}
+	for _, workers := range []int{1, 3, 8} {
+		runCount := check(workers)
+		if workers > 4 { // there are only 4 twigs
+			workers = 4
+		}
+		assert.Equal(t, workers, runCount) // nothing is spilled
+	}
+	// spill the runs into files
+	oldRunSize := rebuildRunSize
+	rebuildRunSize = 4096
+	for _, workers := range []int{1, 3} {
+		assert.Equal(t, true, check(workers) > 10)
+	}
+	rebuildRunSize = oldRunSize
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := tree.ScanSortedRunsCtx(ctx, 0, 2)
+	assert.Equal(t, context.Canceled, err)
+	tree.Close()
+	os.RemoveAll(dirName)
+}
+
+func TestRecoverWithEntryFormat(t *testing.T) {
+	dirName := "./DataTree"
+	os.RemoveAll(dirName)
+	os.Mkdir(dirName, 0700)
+	tree0 := NewEmptyTree(SmallBufferSize, defaultFileSize, dirName)
+	entry := &Entry{
+		Key:        []byte("key-prefix-0"),
+		Value:      bytes.Repeat([]byte("value"), 30),
+		NextKey:    []byte("key-prefix-1"),
+		Height:     100,
+		LastHeight: 99,
+	}
+	var pos int64
+	for i := 0; i < LeafCountInTwig+10; i++ {
+		if i == LeafCountInTwig/2 { // mix the two versions
+			tree0.SetEntryFormat(EntryFormat{Compression: types.CompressionSnappy, DeltaNextKey: true})
+		}
+		entry.SerialNum = int64(i)
+		pos = tree0.AppendEntry(entry)
+	}
+	tree0.EndBlock()
+	mtree4YoungestTwig0 := tree0.mtree4YoungestTwig
+	assert.Equal(t, *entry, *tree0.ReadEntry(pos))
+	tree0.Flush()
+	tree0.Close()
+
+	tree1 := RecoverTree(SmallBufferSize, defaultFileSize, dirName, nil, 0, 0, 1)
+	assert.Equal(t, mtree4YoungestTwig0, tree1.mtree4YoungestTwig)
+	tree1.Close()
+	os.RemoveAll(dirName)
+}
+
+func segmentPaths(dirName string) []string {
+	entries, _ := filepath.Glob(filepath.Join(dirName, entriesPath, "*"))
+	twigMts, _ := filepath.Glob(filepath.Join(dirName, twigMtPath, "*"))
+	return append(entries, twigMts...)
+}
+
+func dumpPaths(dirName string) []string {
+	return []string{
+		filepath.Join(dirName, twigsPath),
+		filepath.Join(dirName, nodesPath),
+		filepath.Join(dirName, mtree4YTPath),
+	}
+}
+
+// Remove the headers to get the files of FormatVersion0
+func stripFormatHeaders(t *testing.T, paths []string) {
+	for _, path := range paths {
+		bz, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(path, bz[FormatHeaderSize:], 0700))
+	}
+}
+
+// Rewrite the twig Merkle tree file into the layout before FormatVersion2, without headers
+func downgradeTwigMt(t *testing.T, dirName string, blockSize int) {
+	dir := filepath.Join(dirName, twigMtPath)
+	var data []byte
+	for id := 0; ; id++ {
+		path := fmt.Sprintf("%s/%d-%d", dir, id, blockSize)
+		bz, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			break
+		}
+		assert.Nil(t, err)
+		data = append(data, bz[FormatHeaderSize:]...)
+		assert.Nil(t, os.Remove(path))
+	}
+	var old []byte
+	for off := 0; off+TwigMtSize <= len(data); off += TwigMtSize {
+		h := meow.New32(0)
+		h.Write(data[off+8 : off+16])
+		old = append(old, data[off+8:off+16]...)
+		old = append(old, h.Sum(nil)...)
+		for i := 0; i < TwigMtEntryCount; i++ {
+			start := off + TwigMtHeaderSize + i*TwigMtNodeSize
+			old = append(old, data[start:start+32]...)
+		}
+	}
+	for id := 0; id == 0 || id*blockSize < len(old); id++ {
+		end := (id + 1) * blockSize
+		if end > len(old) {
+			end = len(old)
+		}
+		path := fmt.Sprintf("%s/%d-%d", dir, id, blockSize)
+		assert.Nil(t, ioutil.WriteFile(path, old[id*blockSize:end], 0700))
+	}
+}
+
+func TestMigrateDir(t *testing.T) {
+	dirName := "./DataTree"
+	os.RemoveAll(dirName)
+	os.Mkdir(dirName, 0700)
+	deactSNList := []int64{101, 999, 1002}
+	tree0, posList, _ := buildTestTree(dirName, deactSNList, TwigMask, 6)
+	tree0.EndBlock()
+	nodes0 := tree0.nodes
+	activeTwigs0 := tree0.activeTwigs
+	mtree4YoungestTwig0 := tree0.mtree4YoungestTwig
+	tree0.Flush()
+	hash0, err := tree0.twigMtFile.GetHashNode(0, 1)
+	assert.Nil(t, err)
+	tree0.Close()
+
+	entrySegments, _ := filepath.Glob(filepath.Join(dirName, entriesPath, "*"))
+	stripFormatHeaders(t, append(entrySegments, dumpPaths(dirName)...))
+	downgradeTwigMt(t, dirName, defaultFileSize)
+	twigsFile := filepath.Join(dirName, twigsPath)
+	version, err := FileFormatVersion(twigsFile, false)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(FormatVersion0), version)
+
+	// the old layout of the twig Merkle tree file can not be read
+	assert.Panics(t, func() { LoadTree(SmallBufferSize, defaultFileSize, dirName) })
+	assert.Nil(t, MigrateDir(dirName, nil))
+	twigMtFile, err := NewTwigMtFile(SmallBufferSize, defaultFileSize, filepath.Join(dirName, twigMtPath))
+	assert.Nil(t, err)
+	hash, err := twigMtFile.GetHashNode(0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, hash0, hash)
+	twigMtFile.Close()
+
+	// the files of version 0 can still be read, and the new segments get headers
+	tree1 := LoadTree(SmallBufferSize, defaultFileSize, dirName)
+	compareNodes(t, tree1.nodes, nodes0)
+	compareTwigs(t, tree1.activeTwigs, activeTwigs0)
+	assert.Equal(t, tree1.mtree4YoungestTwig, mtree4YoungestTwig0)
+	entry := tree1.ReadEntry(posList[len(posList)-1])
+	var pos int64
+	for i := 0; i < LeafCountInTwig; i++ {
+		entry.SerialNum++
+		pos = tree1.AppendEntry(entry)
+	}
+	tree1.EndBlock()
+	nodes1 := tree1.nodes
+	mtree4YoungestTwig1 := tree1.mtree4YoungestTwig
+	size1, _ := tree1.GetFileSizes()
+	tree1.Flush()
+	tree1.Close()
+	stripFormatHeaders(t, dumpPaths(dirName))
+
+	assert.Nil(t, MigrateDir(dirName, nil))
+	for _, path := range segmentPaths(dirName) {
+		version, err = FileFormatVersion(path, true)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(FormatVersion), version)
+	}
+	for _, path := range dumpPaths(dirName) {
+		version, err = FileFormatVersion(path, false)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(FormatVersion), version)
+	}
+	assert.Nil(t, MigrateDir(dirName, nil)) // nothing to do
+
+	tree2 := LoadTree(SmallBufferSize, defaultFileSize, dirName)
+	compareNodes(t, tree2.nodes, nodes1)
+	assert.Equal(t, tree2.mtree4YoungestTwig, mtree4YoungestTwig1)
+	size2, _ := tree2.GetFileSizes()
+	assert.Equal(t, size1, size2)
+	assert.Equal(t, *entry, *tree2.ReadEntry(pos))
+	tree2.Close()
+
+	// an unknown version is rejected
+	ioutil.WriteFile(twigsFile, FormatHeader(DumpFileMagic, FormatVersion+1), 0700)
+	_, err = FileFormatVersion(twigsFile, false)
+	assert.NotNil(t, err)
+	os.RemoveAll(dirName)
+}
+
+func TestTreeEncryption(t *testing.T) {
+	dirName := "./DataTree"
+	os.RemoveAll(dirName)
+	os.Mkdir(dirName, 0700)
+	deactSNList := []int64{101, 999, 1002}
+	tree0, _, _ := buildTestTree(dirName, deactSNList, TwigMask, 6)
+	root0 := tree0.EndBlock()
+	tree0.Close()
+	os.RemoveAll(dirName)
+	os.Mkdir(dirName, 0700)
+
+	// the hashes cover the plaintext, so the root does not change
+	opts := HPFileOptions{Encryption: testEncryption(1)}
+	tree1 := NewEmptyTreeWithOptions(SmallBufferSize, defaultFileSize, dirName, opts)
+	entry := &Entry{
+		Key:        []byte("key"),
+		Value:      []byte("value"),
+		NextKey:    []byte("nextkey"),
+		Height:     100,
+		LastHeight: 99,
+	}
+	for i := 0; i < TwigMask+6; i++ {
+		if i == TwigMask {
+			for _, sn := range deactSNList {
+				tree1.DeactiviateEntry(sn)
+			}
+		}
+		entry.SerialNum = int64(i)
+		tree1.AppendEntry(entry)
+	}
+	assert.Equal(t, root0, tree1.EndBlock())
+	mtree4YoungestTwig1 := tree1.mtree4YoungestTwig
+	tree1.Flush()
+	tree1.Close()
+
+	tree2 := LoadTreeWithOptions(SmallBufferSize, defaultFileSize, dirName, opts)
+	e := tree2.ReadEntry(tree2.activeTwigs[1].FirstEntryPos)
+	assert.Equal(t, int64(LeafCountInTwig), e.SerialNum)
+	assert.Equal(t, entry.Value, e.Value)
+	tree2.Close()
+	tree3, err := RecoverTreeWithOptions(context.Background(), SmallBufferSize, defaultFileSize, dirName, nil, 0, 0, 1, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, mtree4YoungestTwig1, tree3.mtree4YoungestTwig)
+	tree3.Close()
+	os.RemoveAll(dirName)
+}
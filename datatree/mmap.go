@@ -0,0 +1,85 @@
+package datatree
+
+// Map the segment with id into memory, if the mmap mode is on and the segment is a plaintext one
+// in the directory. The segment must not be written any more.
+func (hpf *HPFile) mapSegment(id int) error {
+	f, ok := hpf.fileMap[id]
+	if !hpf.mmapMode || !ok || hpf.aeads[id] != nil {
+		return nil
+	}
+	if _, ok := hpf.mmaps[id]; ok {
+		return nil
+	}
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fileInfo.Size() <= hpf.headerSizes[id] { // nothing to read
+		return nil
+	}
+	b, err := mmapFile(f, fileInfo.Size())
+	if err != nil { // it is still read by ReadAt
+		hpf.logger.Info("mmap is unavailable", "fileID", id, "err", err)
+		return nil
+	}
+	hpf.mmaps[id] = b
+	return nil
+}
+
+// Unmap the segment with id. The slices returned by readMapped for it become invalid.
+func (hpf *HPFile) unmapSegment(id int) error {
+	b, ok := hpf.mmaps[id]
+	if !ok {
+		return nil
+	}
+	delete(hpf.mmaps, id)
+	return munmapFile(b)
+}
+
+// Stop serving reads from the mapping of the segment with id, which is moved to the cold tier.
+// The slices returned for it may still be in use, so it is unmapped when PruneHead removes it.
+func (hpf *HPFile) retireMapping(id int) {
+	if b, ok := hpf.mmaps[id]; ok {
+		delete(hpf.mmaps, id)
+		hpf.retiredMmaps[id] = b
+	}
+}
+
+// Unmap the retired mappings of the segments whose ids are less than endID, which frees the disk
+// blocks of the removed segment files
+func (hpf *HPFile) unmapRetired(endID int) error {
+	for id, b := range hpf.retiredMmaps {
+		if id >= endID {
+			continue
+		}
+		if err := munmapFile(b); err != nil {
+			return err
+		}
+		delete(hpf.retiredMmaps, id)
+	}
+	return nil
+}
+
+// Return the n bytes at off in a mapped segment, or false if they are not mapped. It must be
+// called with hpf.mtx locked. The result must not be modified.
+func (hpf *HPFile) mapped(off int64, n int) ([]byte, bool) {
+	id := int(off / int64(hpf.blockSize))
+	m, ok := hpf.mmaps[id]
+	if !ok {
+		return nil, false
+	}
+	start := off%int64(hpf.blockSize) + hpf.headerSizes[id]
+	end := start + int64(n)
+	if end > int64(len(m)) {
+		return nil, false
+	}
+	return m[start:end:end], true
+}
+
+// Like mapped, but locks hpf.mtx. The result is valid until PruneHead removes its segment, even
+// if the segment is moved to the cold tier before.
+func (hpf *HPFile) readMapped(off int64, n int) ([]byte, bool) {
+	hpf.mtx.RLock()
+	defer hpf.mtx.RUnlock()
+	return hpf.mapped(off, n)
+}
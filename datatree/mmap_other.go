@@ -0,0 +1,15 @@
+// +build !linux
+
+package datatree
+
+import (
+	"os"
+)
+
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errNotLinux
+}
+
+func munmapFile(b []byte) error {
+	return errNotLinux
+}
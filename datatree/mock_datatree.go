@@ -1,8 +1,11 @@
 package datatree
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/coinexchain/onvakv/logging"
+	"github.com/coinexchain/onvakv/metrics"
 	"github.com/coinexchain/onvakv/types"
 )
 
@@ -24,7 +27,6 @@ func NewMockDataTree() *MockDataTree {
 }
 
 func (dt *MockDataTree) DeactiviateEntry(sn int64) int {
-	//fmt.Printf("Here DataTree.DeactiviateEntry(sn=%d)\n", sn)
 	twigID := sn >> TwigShift
 	dt.twigs[twigID].activeBits[sn&TwigMask] = false
 	return 0
@@ -56,6 +58,14 @@ func (dt *MockDataTree) ReadEntry(pos int64) *Entry {
 	return &entry
 }
 
+func (dt *MockDataTree) ReadEntries(positions []int64) []*Entry {
+	entries := make([]*Entry, len(positions))
+	for i, pos := range positions {
+		entries[i] = dt.ReadEntry(pos)
+	}
+	return entries
+}
+
 func (dt *MockDataTree) GetActiveBit(sn int64) bool {
 	twigID := sn >> TwigShift
 	return dt.twigs[twigID].activeBits[sn&TwigMask]
@@ -67,16 +77,24 @@ func (dt *MockDataTree) EvictTwig(twigID int64) {
 
 func (dt *MockDataTree) GetActiveEntriesInTwig(twigID int64) chan []byte {
 	res := make(chan []byte, 100)
-	go func() {
-		twig := dt.twigs[twigID]
-		for i, active := range twig.activeBits {
-			if active {
-				entry := twig.entries[i]
-				res <- EntryToBytes(entry, nil)
+	go dt.GetActiveEntriesInTwigCtx(context.Background(), twigID, res)
+	return res
+}
+
+func (dt *MockDataTree) GetActiveEntriesInTwigCtx(ctx context.Context, twigID int64, outChan chan []byte) error {
+	defer close(outChan)
+	twig := dt.twigs[twigID]
+	for i, active := range twig.activeBits {
+		if active {
+			entry := twig.entries[i]
+			select {
+			case outChan <- EntryToBytes(entry, nil):
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 		}
-	}()
-	return res
+	}
+	return nil
 }
 
 func (dt *MockDataTree) ScanEntries(oldestActiveTwigID int64, outChan chan types.EntryX) {
@@ -87,6 +105,22 @@ func (dt *MockDataTree) ScanEntriesLite(oldestActiveTwigID int64, outChan chan t
 	panic(fmt.Sprintf("ScanEntriesLite not implemented. oldestActiveTwigID=%d", oldestActiveTwigID))
 }
 
+func (dt *MockDataTree) ScanEntriesCtx(ctx context.Context, oldestActiveTwigID int64, outChan chan types.EntryX) error {
+	panic(fmt.Sprintf("ScanEntriesCtx not implemented. oldestActiveTwigID=%d", oldestActiveTwigID))
+}
+
+func (dt *MockDataTree) ScanEntriesLiteCtx(ctx context.Context, oldestActiveTwigID int64, outChan chan types.KeyAndPos) error {
+	panic(fmt.Sprintf("ScanEntriesLiteCtx not implemented. oldestActiveTwigID=%d", oldestActiveTwigID))
+}
+
+func (dt *MockDataTree) ScanSortedRunsCtx(ctx context.Context, oldestActiveTwigID int64, workers int) (types.SortedRuns, error) {
+	panic(fmt.Sprintf("ScanSortedRunsCtx not implemented. oldestActiveTwigID=%d", oldestActiveTwigID))
+}
+
+func (dt *MockDataTree) GetProofBytes(pos int64) (entryBz, proofBz []byte, err error) {
+	panic(fmt.Sprintf("GetProofBytes not implemented. pos=%d", pos))
+}
+
 func (dt *MockDataTree) TwigCanBePruned(twigID int64) bool {
 	_, ok := dt.twigs[twigID]
 	return !ok
@@ -100,6 +134,9 @@ func (dt *MockDataTree) GetFileSizes() (int64, int64) {
 	return 0, 0
 }
 
+func (dt *MockDataTree) SetEntryFormat(format types.EntryFormat) {
+}
+
 func (dt *MockDataTree) EndBlock() []byte {
 	return nil
 }
@@ -109,3 +146,9 @@ func (dt *MockDataTree) Close() {
 
 func (dt *MockDataTree) Flush() {
 }
+
+func (dt *MockDataTree) SetMetrics(reg metrics.Registry) {
+}
+
+func (dt *MockDataTree) SetLogger(logger logging.Logger) {
+}
@@ -108,7 +108,6 @@ func (pp *ProofPath) Check(complete bool) error {
 			copy(pp.RightOfTwig[i+1].SelfHash[:], res)
 		} else {
 			if !bytes.Equal(res, pp.RightOfTwig[i+1].SelfHash[:]) {
-				fmt.Printf("here %#v\n", pp.RightOfTwig[i])
 				return fmt.Errorf("Mismatch at right path, level: %d", i)
 			}
 		}
@@ -156,7 +155,67 @@ func (pp *ProofPath) Check(complete bool) error {
 
 // ===================================================================
 
+// Return the raw bytes of the entry at pos and the proof of its existence in the Merkle tree.
+// The proof is nil if it can not be generated, and err is returned if the twig Merkle tree file
+// is corrupted. It must not be called during EndBlock.
+func (tree *Tree) GetProofBytes(pos int64) (entryBz, proofBz []byte, err error) {
+	entryBz, _ = tree.entryFile.ReadEntryRawBytesWithSNList(pos)
+	if tree.entryFile.mmapMode { // the caller may keep it after pruning
+		entryBz = append([]byte{}, entryBz...)
+	}
+	entry, _ := EntryAndSNListFromRawBytes(entryBz)
+	path, err := tree.TryGetProof(entry.SerialNum)
+	if path == nil {
+		return entryBz, nil, err
+	}
+	return entryBz, path.ToBytes(), nil
+}
+
+// Check that the entry is active and belongs to the Merkle tree with the given root, and return the entry
+func VerifyEntryProof(entryBz, proofBz, root []byte) (*Entry, error) {
+	if len(entryBz) < 4 {
+		return nil, fmt.Errorf("Invalid entry length: %d", len(entryBz))
+	}
+	path, err := BytesToProofPath(proofBz)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hash(entryBz), path.LeftOfTwig[0].SelfHash[:]) {
+		return nil, fmt.Errorf("Mismatch at leaf")
+	}
+	if !bytes.Equal(root, path.Root[:]) {
+		return nil, fmt.Errorf("Mismatch with the given root")
+	}
+	if len(path.UpperPath) == 0 {
+		return nil, fmt.Errorf("Empty upper path")
+	}
+	if err = path.Check(true); err != nil {
+		return nil, err
+	}
+	entry, _ := EntryAndSNListFromRawBytes(entryBz)
+	if entry.SerialNum != path.SerialNum {
+		return nil, fmt.Errorf("Mismatch of serial number: %d vs %d", entry.SerialNum, path.SerialNum)
+	}
+	n := int(entry.SerialNum & TwigMask) % 256 // offset in the 32-byte slice of active bits
+	if (path.RightOfTwig[0].SelfHash[n/8] >> (n%8)) & 1 == 0 {
+		return nil, fmt.Errorf("Entry is not active")
+	}
+	return entry, nil
+}
+
+// GetProof panics if the twig Merkle tree file is corrupted
 func (tree *Tree) GetProof(sn int64) *ProofPath {
+	path, err := tree.TryGetProof(sn)
+	if err != nil {
+		panic(err)
+	}
+	return path
+}
+
+// Return the proof path of the entry with sn, or nil if it can not be generated. A corrupted
+// twig Merkle tree file must not produce invalid proofs, so its error, which wraps
+// ErrTwigChecksum on a checksum mismatch, is returned.
+func (tree *Tree) TryGetProof(sn int64) (*ProofPath, error) {
 	twigID := sn >> TwigShift
 	path := &ProofPath{}
 	path.SerialNum = sn
@@ -165,12 +224,17 @@ func (tree *Tree) GetProof(sn int64) *ProofPath {
 	}
 	path.UpperPath, path.Root = tree.getUpperPathAndRoot(twigID)
 	if path.UpperPath == nil {
-		return nil
+		return nil, nil
 	}
 	if twigID == tree.youngestTwigID {
 		path.LeftOfTwig = getLeftPathInMem(tree.mtree4YoungestTwig, sn)
 	} else {
-		path.LeftOfTwig = getLeftPathOnDisk(tree.twigMtFile, twigID, sn)
+		var err error
+		path.LeftOfTwig, err = getLeftPathOnDisk(tree.twigMtFile, twigID, sn)
+		if err != nil {
+			tree.logger.Error("read the twig Merkle tree file", "twigID", twigID, "err", err)
+			return nil, err
+		}
 	}
 	twig, ok := tree.activeTwigs[twigID]
 	if ok {
@@ -178,7 +242,7 @@ func (tree *Tree) GetProof(sn int64) *ProofPath {
 	} else {
 		path.RightOfTwig = getRightPath(&NullTwig, sn)
 	}
-	return path
+	return path, nil
 }
 
 func (tree *Tree) getUpperPathAndRoot(twigID int64) (upperPath []ProofNode, root [32]byte) {
@@ -198,7 +262,6 @@ func (tree *Tree) getUpperPathAndRoot(twigID int64) (upperPath []ProofNode, root
 		PeerAtLeft: (twigID & 1) != 0,
 	})
 	for level, n := FirstLevelAboveTwig, twigID/2; level < maxLevel; level, n = level+1, n/2 {
-		//fmt.Printf("level: %d  n: %d maxLevel: %d ok:%v\n", level, n, maxLevel, ok)
 		upperPath = append(upperPath, ProofNode {
 			SelfHash:   *tree.nodes[Pos(level, n)],
 			PeerHash:   *tree.nodes[Pos(level, n^1)],
@@ -250,10 +313,15 @@ func getLeftPathInMem(mt4twig [4096][32]byte, sn int64) (left [11]ProofNode) {
 	})
 }
 
-func getLeftPathOnDisk(tf *TwigMtFile, twigID int64, sn int64) (left [11]ProofNode) {
-	return getLeftPath(sn, func(i int) (res [32]byte) {
-		copy(res[:], tf.GetHashNode(twigID, i))
+func getLeftPathOnDisk(tf *TwigMtFile, twigID int64, sn int64) (left [11]ProofNode, err error) {
+	left = getLeftPath(sn, func(i int) (res [32]byte) {
+		node, e := tf.GetHashNode(twigID, i)
+		if e != nil && err == nil {
+			err = e
+		}
+		copy(res[:], node)
 		return
 	})
+	return
 }
 
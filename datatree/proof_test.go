@@ -2,8 +2,10 @@ package datatree
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -61,7 +63,7 @@ func TestTreeProof(t *testing.T) {
 		deactSNList = append(deactSNList, int64(i))
 	}
 	deactSNList = append(deactSNList, []int64{5000, 5500, 5700, 5813, 6001}...)
-	tree, _, _ := buildTestTree(dirName, deactSNList, TwigMask*4, 1600)
+	tree, posList, _ := buildTestTree(dirName, deactSNList, TwigMask*4, 1600)
 	fmt.Printf("build finished\n")
 	tree.EvictTwig(0)
 	tree.EndBlock()
@@ -88,6 +90,23 @@ func TestTreeProof(t *testing.T) {
 		require.Nil(t, err)
 	}
 
+	// corrupt the leaf of entry 2048 in the twig Merkle tree file
+	tree.Flush()
+	fnames, err := filepath.Glob(filepath.Join(dirName, twigMtPath, "0-*"))
+	require.Nil(t, err)
+	f, err := os.OpenFile(fnames[0], os.O_RDWR, 0700)
+	require.Nil(t, err)
+	off := int64(FormatHeaderSize) + TwigMtSize + TwigMtHeaderSize + 2047*TwigMtNodeSize
+	_, err = f.WriteAt([]byte{0xFF, 0xFF}, off)
+	require.Nil(t, err)
+	f.Close()
+	_, err = tree.TryGetProof(2048)
+	require.True(t, errors.Is(err, ErrTwigChecksum))
+	require.Panics(t, func() { tree.GetProof(2048) })
+	_, proofBz, err := tree.GetProofBytes(posList[2048])
+	require.Nil(t, proofBz)
+	require.True(t, errors.Is(err, ErrTwigChecksum))
+
 	tree.Close()
 	os.RemoveAll(dirName)
 }
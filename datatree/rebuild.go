@@ -0,0 +1,422 @@
+package datatree
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/coinexchain/onvakv/types"
+)
+
+// The bytes read at a time by each worker of ScanSortedRunsCtx
+const rebuildReadSize = 4 * 1024 * 1024
+
+// The bytes of the records a worker of ScanSortedRunsCtx keeps in memory before spilling them
+var rebuildRunSize = 64 * 1024 * 1024
+
+// The bytes taken by a record in a run besides its key
+const keyAndPosOverhead = 32
+
+// The buffer size for writing and reading a spilled run
+const spillBufSize = 64 * 1024
+
+// The ID of a spilled run is its worker's ID shifted by spillRunIDShift, plus its index
+const spillRunIDShift = 24
+
+// Return the position of the first entry of twigID, or the entry file's size if it has none
+func (tree *Tree) getFirstEntryPos(twigID int64) int64 {
+	if twig, ok := tree.activeTwigs[twigID]; ok {
+		if twig.FirstEntryPos < 0 {
+			return tree.entryFile.Size()
+		}
+		return twig.FirstEntryPos
+	}
+	return tree.twigMtFile.GetFirstEntryPos(twigID)
+}
+
+// Whether the entry with sn is active. The evicted twigs have no active entries.
+func (tree *Tree) isActiveSN(sn int64) bool {
+	twig, ok := tree.activeTwigs[sn>>TwigShift]
+	return ok && twig.getBit(int(sn&TwigMask))
+}
+
+// Scan the active entries in the twigs since oldestActiveTwigID with up to workers goroutines.
+// Each worker reads the entries of a contiguous range of twigs with large sequential reads, and
+// sorts their keys into runs. When the records of a run take more than rebuildRunSize bytes, the
+// run is spilled into a file under the sortedruns directory, so the memory taken by the runs is
+// bounded. If the entry file is encrypted, the spilled files are sealed with the same key. Each run only keeps the latest position of a key. The returned SortedRuns merges the
+// runs in the order of keys, and removes the spilled files when it is closed. Unlike
+// ScanEntriesLiteCtx, the deactivated entries are skipped, so the deleted keys do not come back
+// into the index. The entry file must have been flushed.
+func (tree *Tree) ScanSortedRunsCtx(ctx context.Context, oldestActiveTwigID int64, workers int) (types.SortedRuns, error) {
+	twigCount := tree.youngestTwigID - oldestActiveTwigID + 1
+	if int64(workers) > twigCount {
+		workers = int(twigCount)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	bounds := make([]int64, workers+1)
+	for i := 0; i < workers; i++ {
+		bounds[i] = tree.getFirstEntryPos(oldestActiveTwigID + twigCount*int64(i)/int64(workers))
+	}
+	bounds[workers] = tree.entryFile.Size()
+	var aead cipher.AEAD
+	if hpf := &tree.entryFile.HPFile; hpf.encryption != nil {
+		var err error
+		if aead, err = hpf.newAEAD(hpf.encryption.KeyID); err != nil {
+			return nil, err
+		}
+	}
+	dir := filepath.Join(tree.dirName, sortedRunsPath)
+	os.RemoveAll(dir) // left by a rebuilding which was interrupted
+	runs := make([][]*sortedRun, workers)
+	errs := make([]error, workers)
+	ParrallelRun(workers, func(workerID int) {
+		runs[workerID], errs[workerID] = tree.scanSortedRuns(ctx, dir, aead, workerID, bounds[workerID], bounds[workerID+1])
+	})
+	m := &runMerger{dir: dir}
+	for _, r := range runs {
+		m.runs = append(m.runs, r...)
+	}
+	for _, err := range errs {
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	m.init()
+	return m, nil
+}
+
+// Read the keys of the entries in [start, end) and sort them into runs, in the order of positions.
+// The spilled runs are sealed with aead if it is not nil.
+func (tree *Tree) scanSortedRuns(ctx context.Context, dir string, aead cipher.AEAD, workerID int, start, end int64) (runs []*sortedRun, err error) {
+	defer func() {
+		if err != nil {
+			for _, r := range runs {
+				r.close()
+			}
+			runs = nil
+		}
+	}()
+	var recs []types.KeyAndPos
+	recsSize := 0
+	buf := make([]byte, rebuildReadSize)
+	bufStart, bufEnd := int64(0), int64(0) // the positions of the valid bytes in buf
+	fill := func(pos int64) error {
+		reqs := []ReadReq{{Off: pos, Buf: buf}}
+		if err := tree.entryFile.HPFile.ReadBatch(reqs); err != nil {
+			return err
+		}
+		bufStart, bufEnd = pos, pos+int64(reqs[0].N)
+		return nil
+	}
+	for pos := start; pos < end; {
+		if err := ctx.Err(); err != nil {
+			return runs, err
+		}
+		if pos+12 > bufEnd {
+			if err := fill(pos); err != nil {
+				return runs, err
+			}
+			if pos+12 > bufEnd {
+				return runs, fmt.Errorf("Can not read the entry at %d(0x%x)", pos, pos)
+			}
+		}
+		length, numberOfSN := parseMagicBytesAndLength(pos, buf[pos-bufStart:])
+		next := getNextPos(pos, length+8*int64(numberOfSN))
+		if pos+12+length > bufEnd {
+			if 12+int(length) > len(buf) {
+				buf = make([]byte, 12+int(length))
+			}
+			if err := fill(pos); err != nil {
+				return runs, err
+			}
+			if pos+12+length > bufEnd {
+				return runs, fmt.Errorf("Can not read the entry at %d(0x%x)", pos, pos)
+			}
+		}
+		entryBz := buf[pos-bufStart+8 : pos-bufStart+12+length]
+		if tree.isActiveSN(ExtractSerialNum(entryBz)) {
+			key := ExtractKeyFromRawBytes(entryBz)
+			recs = append(recs, types.KeyAndPos{Key: key, Pos: PackEntryPos(pos, int(next-pos))})
+			recsSize += len(key) + keyAndPosOverhead
+			if recsSize >= rebuildRunSize {
+				fname := filepath.Join(dir, fmt.Sprintf("%d-%d", workerID, len(runs)))
+				r, err := spillRun(fname, aead, workerID<<spillRunIDShift|len(runs), sortRun(recs))
+				if err != nil {
+					return runs, err
+				}
+				runs = append(runs, r)
+				recs, recsSize = nil, 0
+			}
+		}
+		pos = next
+	}
+	if len(recs) != 0 || len(runs) == 0 { // the last run stays in memory
+		runs = append(runs, &sortedRun{recs: sortRun(recs)})
+	}
+	return runs, nil
+}
+
+// Sort the records by keys, and only keep the last record of each key
+func sortRun(run []types.KeyAndPos) []types.KeyAndPos {
+	// The records of a key stay in the order of their positions
+	sort.SliceStable(run, func(i, j int) bool {
+		return bytes.Compare(run[i].Key, run[j].Key) < 0
+	})
+	n := 0 // keep the last record of each key, which has the largest position
+	for i := range run {
+		if i+1 < len(run) && bytes.Equal(run[i].Key, run[i+1].Key) {
+			continue
+		}
+		run[n] = run[i]
+		n++
+	}
+	return run[:n]
+}
+
+// A run of records sorted by keys, kept in memory or spilled into a file
+type sortedRun struct {
+	recs  []types.KeyAndPos // the remaining records in memory
+	file  *os.File
+	rd    *bufio.Reader
+	count int // the remaining records in file
+	head  types.KeyAndPos
+}
+
+// Write the records into a new file, each as the uvarint length of its key, the key and the
+// 8-byte position, and return a run reading them from the beginning. If aead is not nil, the
+// file is sealed, and id is used as the segment ID in the additional data of its chunks.
+func spillRun(fname string, aead cipher.AEAD, id int, recs []types.KeyAndPos) (*sortedRun, error) {
+	if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(fname)
+	if err != nil {
+		return nil, err
+	}
+	var w interface {
+		io.Writer
+		Flush() error
+	}
+	if aead == nil {
+		w = bufio.NewWriterSize(f, spillBufSize)
+	} else {
+		w = &sealedWriter{w: f, aead: aead, id: id}
+	}
+	var lenBuf [binary.MaxVarintLen64]byte
+	var posBuf [8]byte
+	for _, rec := range recs {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(rec.Key)))
+		w.Write(lenBuf[:n]) // the errors are kept by w and returned by Flush
+		w.Write(rec.Key)
+		binary.LittleEndian.PutUint64(posBuf[:], uint64(rec.Pos))
+		w.Write(posBuf[:])
+	}
+	err = w.Flush()
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var r io.Reader = f
+	if aead != nil {
+		r = &sealedReader{r: f, aead: aead, id: id}
+	}
+	return &sortedRun{file: f, rd: bufio.NewReaderSize(r, spillBufSize), count: len(recs)}, nil
+}
+
+// Seal the bytes written to a spilled run in chunks of spillBufSize bytes. Each chunk is sealed
+// like a chunk of an encrypted segment, and stored with its 4-byte length.
+type sealedWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	id   int
+	idx  int64 // the index of the next chunk
+	buf  []byte
+}
+
+func (sw *sealedWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) != 0 {
+		m := spillBufSize - len(sw.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		sw.buf = append(sw.buf, p[:m]...)
+		p = p[m:]
+		if len(sw.buf) == spillBufSize {
+			if err := sw.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (sw *sealedWriter) Flush() error {
+	if len(sw.buf) == 0 {
+		return nil
+	}
+	c, err := sealChunk(sw.aead, sw.id, sw.idx, sw.buf)
+	if err != nil {
+		return err
+	}
+	var lenBuf [4]byte
+	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(c)))
+	if _, err = sw.w.Write(lenBuf[:]); err == nil {
+		_, err = sw.w.Write(c)
+	}
+	sw.idx++
+	sw.buf = sw.buf[:0]
+	return err
+}
+
+// Read the chunks written by sealedWriter
+type sealedReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	id    int
+	idx   int64 // the index of the next chunk
+	plain []byte
+}
+
+func (sr *sealedReader) Read(p []byte) (int, error) {
+	if len(sr.plain) == 0 {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(sr.r, lenBuf[:]); err != nil {
+			return 0, err
+		}
+		c := make([]byte, binary.LittleEndian.Uint32(lenBuf[:]))
+		if _, err := io.ReadFull(sr.r, c); err != nil {
+			return 0, err
+		}
+		plain, err := openChunk(sr.aead, sr.id, sr.idx, c)
+		if err != nil {
+			return 0, err
+		}
+		sr.idx++
+		sr.plain = plain
+	}
+	n := copy(p, sr.plain)
+	sr.plain = sr.plain[n:]
+	return n, nil
+}
+
+// Load the next record into head, or return false if there are no more records
+func (r *sortedRun) advance() bool {
+	if r.file == nil {
+		if len(r.recs) == 0 {
+			return false
+		}
+		r.head, r.recs = r.recs[0], r.recs[1:]
+		return true
+	}
+	if r.count == 0 {
+		return false
+	}
+	r.count--
+	length, err := binary.ReadUvarint(r.rd)
+	if err == nil {
+		r.head.Key = make([]byte, length)
+		_, err = io.ReadFull(r.rd, r.head.Key)
+	}
+	var posBuf [8]byte
+	if err == nil {
+		_, err = io.ReadFull(r.rd, posBuf[:])
+	}
+	if err != nil {
+		panic(err)
+	}
+	r.head.Pos = int64(binary.LittleEndian.Uint64(posBuf[:]))
+	return true
+}
+
+func (r *sortedRun) close() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	r.recs, r.count = nil, 0
+}
+
+// Merge the runs of ScanSortedRunsCtx. It is a heap of the runs with remaining records, ordered
+// by their head keys. For the same key, the later run comes first.
+type runMerger struct {
+	dir  string
+	runs []*sortedRun
+	ids  []int
+}
+
+var _ types.SortedRuns = (*runMerger)(nil)
+
+func (m *runMerger) Len() int { return len(m.ids) }
+func (m *runMerger) Less(i, j int) bool {
+	a, b := m.ids[i], m.ids[j]
+	if c := bytes.Compare(m.runs[a].head.Key, m.runs[b].head.Key); c != 0 {
+		return c < 0
+	}
+	return a > b
+}
+func (m *runMerger) Swap(i, j int)      { m.ids[i], m.ids[j] = m.ids[j], m.ids[i] }
+func (m *runMerger) Push(x interface{}) { m.ids = append(m.ids, x.(int)) }
+func (m *runMerger) Pop() interface{} {
+	id := m.ids[len(m.ids)-1]
+	m.ids = m.ids[:len(m.ids)-1]
+	return id
+}
+
+func (m *runMerger) init() {
+	for id, r := range m.runs {
+		if r.advance() {
+			m.ids = append(m.ids, id)
+		}
+	}
+	heap.Init(m)
+}
+
+// Remove and return the smallest record
+func (m *runMerger) popHead() types.KeyAndPos {
+	r := m.runs[m.ids[0]]
+	res := r.head
+	if r.advance() {
+		heap.Fix(m, 0)
+	} else {
+		heap.Pop(m)
+	}
+	return res
+}
+
+// Return the records in the ascending order of keys. When a key is in several runs, only its
+// record in the latest run is returned.
+func (m *runMerger) Next() (res types.KeyAndPos, ok bool) {
+	if m.Len() == 0 {
+		return
+	}
+	res = m.popHead()
+	for m.Len() != 0 && bytes.Equal(m.runs[m.ids[0]].head.Key, res.Key) {
+		m.popHead() // the same key in an earlier run
+	}
+	return res, true
+}
+
+// Close the spilled runs and remove their files
+func (m *runMerger) Close() {
+	for _, r := range m.runs {
+		r.close()
+	}
+	m.runs, m.ids = nil, nil
+	os.RemoveAll(m.dir)
+}
@@ -5,19 +5,34 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	sha256 "github.com/minio/sha256-simd"
 	"github.com/coinexchain/randsrc"
+
+	"github.com/coinexchain/onvakv/datatree"
 )
 
 const (
 	ReadCount = 20*10000
 	PageSize = 4096
+	Goroutines = 64
+	BatchSize = 1024
+	HPFileDir = "a.hpf"
+	HPFileBlockSize = 1024*1024*1024
 )
 
+// The modes except "pread" read an HPFile in HPFileDir with datatree.HPFile.ReadBatch
+var batchModes = map[string]datatree.HPFileOptions{
+	"batch":              {},
+	"batch-direct":       {DirectIO: true},
+	"batch-uring":        {IOUring: true},
+	"batch-direct-uring": {DirectIO: true, IOUring: true},
+}
+
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Printf("Usage: %s <rand-source-file> <page-count>\n", os.Args[0])
+	if len(os.Args) != 3 && len(os.Args) != 4 {
+		fmt.Printf("Usage: %s <rand-source-file> <page-count> [pread|batch|batch-direct|batch-uring|batch-direct-uring]\n", os.Args[0])
 		return
 	}
 	randFilename := os.Args[1]
@@ -25,15 +40,30 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	mode := "pread"
+	if len(os.Args) == 4 {
+		mode = os.Args[3]
+	}
 
 	//RandWriteFile(pageCount, randFilename)
 
-	var wg sync.WaitGroup
-	for i := 0; i < 64; i++ {
-		wg.Add(1)
-		go RandRead(pageCount, randFilename, byte(i), &wg)
+	start := time.Now()
+	if opts, ok := batchModes[mode]; ok {
+		BatchRandRead(pageCount, randFilename, opts)
+	} else if mode == "pread" {
+		var wg sync.WaitGroup
+		for i := 0; i < Goroutines; i++ {
+			wg.Add(1)
+			go RandRead(pageCount, randFilename, byte(i), &wg)
+		}
+		wg.Wait()
+	} else {
+		fmt.Printf("Unknown mode %s\n", mode)
+		return
 	}
-	wg.Wait()
+	elapsed := time.Since(start)
+	fmt.Printf("%s: %d reads in %s, %.0f IOPS\n", mode, Goroutines*ReadCount, elapsed,
+		float64(Goroutines*ReadCount)/elapsed.Seconds())
 }
 
 func RandWriteFile(pageCount int, randFilename string) {
@@ -71,3 +101,65 @@ func RandRead(pageCount int, randFilename string, seed byte, wg *sync.WaitGroup)
 	wg.Done()
 	return res
 }
+
+// Copy a.dat into an HPFile in HPFileDir, if it does not exist
+func prepareHPFile(pageCount int) {
+	if _, err := os.Stat(HPFileDir); err == nil {
+		return
+	}
+	os.Mkdir(HPFileDir, 0700)
+	hpf, err := datatree.NewHPFile(datatree.BufferSize, HPFileBlockSize, HPFileDir)
+	if err != nil {
+		panic(err)
+	}
+	datFile, err := os.Open("a.dat")
+	if err != nil {
+		panic(err)
+	}
+	defer datFile.Close()
+	var buf [PageSize]byte
+	for i := 0; i < pageCount; i++ {
+		_, err = datFile.ReadAt(buf[:], int64(i)*int64(PageSize))
+		if err != nil {
+			panic(err)
+		}
+		_, err = hpf.Append([][]byte{buf[:]})
+		if err != nil {
+			panic(err)
+		}
+	}
+	hpf.Flush()
+	hpf.Close()
+}
+
+// Read as many pages as RandRead does in all the goroutines, BatchSize pages at a time
+func BatchRandRead(pageCount int, randFilename string, opts datatree.HPFileOptions) (res byte) {
+	prepareHPFile(pageCount)
+	opts.BatchReadDepth = Goroutines
+	hpf, err := datatree.NewHPFileWithOptions(datatree.BufferSize, HPFileBlockSize, HPFileDir, opts)
+	if err != nil {
+		panic(err)
+	}
+	defer hpf.Close()
+	rs := randsrc.NewRandSrcFromFile(randFilename)
+	reqs := make([]datatree.ReadReq, BatchSize)
+	for i := range reqs {
+		reqs[i].Buf = make([]byte, PageSize)
+	}
+	for i := 0; i < Goroutines*ReadCount; i += BatchSize {
+		for j := range reqs {
+			n := int(rs.GetUint32())%pageCount
+			reqs[j].Off = int64(n)*int64(PageSize)
+		}
+		err = hpf.ReadBatch(reqs)
+		if err != nil {
+			panic(err)
+		}
+		for _, req := range reqs {
+			for _, b := range req.Buf[:req.N] {
+				res += b
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,221 @@
+package datatree
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A segment in the cold tier, which only supports positional reads
+type ColdFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// ColdStore keeps the old segments moved out of the directories of HPFiles. It can be backed by
+// a slower disk or by an object store supporting ranged reads. The names of segments look like
+// "entries/12-1073741824".
+type ColdStore interface {
+	Put(name string, r io.Reader) error
+	Open(name string) (ColdFile, error)
+	Remove(name string) error
+	// Return the names beginning with prefix+"/"
+	List(prefix string) ([]string, error)
+}
+
+// DirColdStore is a ColdStore in a local directory
+type DirColdStore struct {
+	Dir string
+}
+
+var _ ColdStore = DirColdStore{}
+
+func NewDirColdStore(dir string) (DirColdStore, error) {
+	return DirColdStore{Dir: dir}, os.MkdirAll(dir, 0700)
+}
+
+func (s DirColdStore) Put(name string, r io.Reader) error {
+	path := filepath.Join(s.Dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (s DirColdStore) Open(name string) (ColdFile, error) {
+	return os.Open(filepath.Join(s.Dir, name))
+}
+
+func (s DirColdStore) Remove(name string) error {
+	return os.Remove(filepath.Join(s.Dir, name))
+}
+
+func (s DirColdStore) List(prefix string) ([]string, error) {
+	fileInfoList, err := ioutil.ReadDir(filepath.Join(s.Dir, prefix))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fileInfo := range fileInfoList {
+		if !fileInfo.IsDir() && !strings.HasSuffix(fileInfo.Name(), ".tmp") {
+			names = append(names, prefix+"/"+fileInfo.Name())
+		}
+	}
+	return names, nil
+}
+
+func (hpf *HPFile) coldName(id int) string {
+	return fmt.Sprintf("%s/%d-%d", filepath.Base(hpf.dirName), id, hpf.blockSize)
+}
+
+// Return the reader of the segment with id, in either tier
+func (hpf *HPFile) segmentReader(id int) (io.ReaderAt, bool) {
+	if f, ok := hpf.fileMap[id]; ok {
+		return f, true
+	}
+	if f, ok := hpf.coldFiles[id]; ok {
+		return f, true
+	}
+	return nil, false
+}
+
+// Open the segments in the cold tier which are not in the directory
+func (hpf *HPFile) openColdSegments() error {
+	names, err := hpf.coldStore.List(filepath.Base(hpf.dirName))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		var id, blockSize int
+		_, err = fmt.Sscanf(filepath.Base(name), "%d-%d", &id, &blockSize)
+		if err != nil || blockSize != hpf.blockSize {
+			return fmt.Errorf("Invalid segment in the cold tier: %s", name)
+		}
+		if _, ok := hpf.fileMap[id]; ok { // an interrupted moving, the one in directory is used
+			continue
+		}
+		if id >= hpf.largestID {
+			return fmt.Errorf("The latest segment %s can not be in the cold tier", name)
+		}
+		f, err := hpf.coldStore.Open(name)
+		if err != nil {
+			return err
+		}
+		hpf.coldFiles[id] = f
+		var keyID uint32
+		_, hpf.headerSizes[id], keyID, err = readFormatHeader(f, HPFileMagic)
+		if err == nil && keyID != 0 {
+			hpf.aeads[id], err = hpf.newAEAD(keyID)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Start moving the old segments to the cold tier in background, unless it is already running
+func (hpf *HPFile) moveColdSegmentsAsync() {
+	if hpf.coldStore == nil || hpf.moving {
+		return
+	}
+	hpf.moving = true
+	hpf.movingWG.Add(1)
+	go func() {
+		defer hpf.movingWG.Done()
+		if err := hpf.MoveColdSegments(); err != nil {
+			hpf.logger.Error("move segments to the cold tier", "err", err)
+		}
+		hpf.mtx.Lock()
+		hpf.moving = false
+		hpf.mtx.Unlock()
+	}()
+}
+
+// Move the segments older than the latest HotSegments ones to the cold tier. The segments are
+// copied without blocking the readers, and then the copies replace them.
+func (hpf *HPFile) MoveColdSegments() error {
+	if hpf.coldStore == nil {
+		return nil
+	}
+	hpf.movingMtx.Lock()
+	defer hpf.movingMtx.Unlock()
+	hpf.mtx.RLock()
+	var idList []int
+	for id := range hpf.fileMap {
+		if id <= hpf.largestID-hpf.hotSegments && id != hpf.largestID {
+			idList = append(idList, id)
+		}
+	}
+	hpf.mtx.RUnlock()
+	sort.Ints(idList)
+	for _, id := range idList {
+		if err := hpf.moveColdSegment(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hpf *HPFile) moveColdSegment(id int) error {
+	hpf.mtx.RLock()
+	f, ok := hpf.fileMap[id]
+	var size int64
+	var err error
+	if ok {
+		size, err = f.Seek(0, io.SeekEnd) // a closed segment is not written any more
+	}
+	hpf.mtx.RUnlock()
+	if !ok || err != nil { // pruned in the meantime
+		return err
+	}
+	name := hpf.coldName(id)
+	err = hpf.coldStore.Put(name, io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return err
+	}
+	cf, err := hpf.coldStore.Open(name)
+	if err != nil {
+		return err
+	}
+	hpf.mtx.Lock()
+	defer hpf.mtx.Unlock()
+	if _, ok := hpf.fileMap[id]; !ok {
+		cf.Close()
+		return hpf.coldStore.Remove(name)
+	}
+	hpf.coldFiles[id] = cf
+	delete(hpf.fileMap, id)
+	hpf.retireMapping(id)
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := hpf.closeDirect(id); err != nil {
+		return err
+	}
+	fname := fmt.Sprintf("%s/%d-%d", hpf.dirName, id, hpf.blockSize)
+	hpf.logger.Info("move to the cold tier", "fileID", id, "fileName", fname)
+	return os.Remove(fname)
+}
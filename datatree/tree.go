@@ -1,6 +1,7 @@
 package datatree
 
 import (
+	"context"
 	"fmt"
 	"math/bits"
 	"os"
@@ -11,6 +12,9 @@ import (
 
 	"github.com/dterei/gotsc"
 	sha256 "github.com/minio/sha256-simd"
+
+	"github.com/coinexchain/onvakv/logging"
+	"github.com/coinexchain/onvakv/metrics"
 )
 
 //var Debug bool
@@ -24,6 +28,7 @@ const (
 	nodesPath = "nodes.dat"
 	mtree4YTPath = "mtree4YT.dat"
 	twigsPath = "twigs.dat"
+	sortedRunsPath = "sortedruns"
 	DeactivedSNListMaxLen = 64
 )
 
@@ -207,18 +212,33 @@ type Tree struct {
 	twigsToBeDeleted    []int64
 	touchedPosOf512b    map[int64]struct{}
 	deactivedSNList     []int64
+
+	entryFormat EntryFormat
+
+	entriesAppended    metrics.Counter
+	entriesDeactivated metrics.Counter
+	twigsEvicted       metrics.Counter
+	twigsPruned        metrics.Counter
+	entryFileSize      metrics.Gauge
+	twigMtFileSize     metrics.Gauge
+	logger             logging.Logger
 }
 
 func NewEmptyTree(bufferSize, blockSize int, dirName string) *Tree {
+	return NewEmptyTreeWithOptions(bufferSize, blockSize, dirName, HPFileOptions{})
+}
+
+// Like NewEmptyTree, but the entry file and the twig Merkle tree file are opened with opts
+func NewEmptyTreeWithOptions(bufferSize, blockSize int, dirName string, opts HPFileOptions) *Tree {
 	dirEntry := filepath.Join(dirName, entriesPath)
 	os.Mkdir(dirEntry, 0700)
-	entryFile, err := NewEntryFile(bufferSize, blockSize, dirEntry)
+	entryFile, err := NewEntryFileWithOptions(bufferSize, blockSize, dirEntry, opts)
 	if err != nil {
 		panic(err)
 	}
 	dirTwigMt := filepath.Join(dirName, twigMtPath)
 	os.Mkdir(dirTwigMt, 0700)
-	twigMtFile, err := NewTwigMtFile(bufferSize, blockSize, dirTwigMt)
+	twigMtFile, err := NewTwigMtFileWithOptions(bufferSize, blockSize, dirTwigMt, opts)
 	if err != nil {
 		panic(err)
 	}
@@ -241,9 +261,30 @@ func NewEmptyTree(bufferSize, blockSize int, dirName string) *Tree {
 	tree.nodes[Pos(FirstLevelAboveTwig, 0)] = &zero
 	tree.mtree4YoungestTwig = NullMT4Twig
 	tree.activeTwigs[0] = CopyNullTwig()
+	tree.SetMetrics(nil)
+	tree.SetLogger(logging.Default())
 	return tree
 }
 
+func (tree *Tree) SetMetrics(reg metrics.Registry) {
+	reg = metrics.OrNop(reg)
+	tree.entriesAppended = reg.NewCounter(metrics.EntriesAppended)
+	tree.entriesDeactivated = reg.NewCounter(metrics.EntriesDeactivated)
+	tree.twigsEvicted = reg.NewCounter(metrics.TwigsEvicted)
+	tree.twigsPruned = reg.NewCounter(metrics.TwigsPruned)
+	tree.entryFileSize = reg.NewGauge(metrics.EntryFileSize)
+	tree.twigMtFileSize = reg.NewGauge(metrics.TwigMtFileSize)
+	tree.entryFile.SetMetrics(reg, entriesPath)
+	tree.twigMtFile.SetMetrics(reg, twigMtPath)
+}
+
+func (tree *Tree) SetLogger(logger logging.Logger) {
+	logger = logging.OrNop(logger)
+	tree.logger = logger.With("module", "datatree")
+	tree.entryFile.SetLogger(logger)
+	tree.twigMtFile.SetLogger(logger)
+}
+
 func (tree *Tree) Close() {
 	tree.entryFile.Close()
 	tree.twigMtFile.Close()
@@ -264,6 +305,12 @@ func (tree *Tree) GetFileSizes() (int64, int64) {
 	return tree.entryFile.Size(), tree.twigMtFile.Size()
 }
 
+// Change the format of the entries appended afterwards. Entries already in the file keep
+// their own format.
+func (tree *Tree) SetEntryFormat(format EntryFormat) {
+	tree.entryFormat = format
+}
+
 func (tree *Tree) TruncateFiles(entryFileSize, twigMtFileSize int64) {
 	tree.entryFile.Truncate(entryFileSize)
 	tree.twigMtFile.Truncate(twigMtFileSize)
@@ -274,6 +321,10 @@ func (tree *Tree) ReadEntry(pos int64) (entry *Entry) {
 	return
 }
 
+func (tree *Tree) ReadEntries(positions []int64) []*Entry {
+	return tree.entryFile.ReadEntries(positions)
+}
+
 func (tree *Tree) GetActiveBit(sn int64) bool {
 	twigID := sn >> TwigShift
 	return tree.activeTwigs[twigID].getBit(int(sn & TwigMask))
@@ -295,16 +346,14 @@ func (tree *Tree) ActiviateEntry(sn int64) {
 }
 
 func (tree *Tree) DeactiviateEntry(sn int64) int {
-	//if sn >> TwigShift == 50 {
-	//	fmt.Printf("DeactiviateEntry sn %d twig %d\n", sn, sn >> TwigShift)
-	//}
 	tree.setEntryActiviation(sn, false)
+	tree.entriesDeactivated.Add(1)
 	return len(tree.deactivedSNList)
 }
 
 func (tree *Tree) AppendEntry(entry *Entry) int64 {
 	// write the entry while flushing deactivedSNList
-	bz := EntryToBytes(*entry, tree.deactivedSNList)
+	bz := EncodeEntry(*entry, tree.deactivedSNList, tree.entryFormat)
 	tree.deactivedSNList = tree.deactivedSNList[:0] // clear its content
 	return tree.appendEntry([2][]byte{bz, nil}, entry.SerialNum)
 }
@@ -331,16 +380,12 @@ func (tree *Tree) appendEntry(bzTwo [2][]byte, sn int64) int64 {
 	tree.mtree4YTChangeEnd = position
 
 	pos := tree.entryFile.Append(bzTwo)
+	tree.entriesAppended.Add(1)
 	// update the corresponding leaf of merkle tree
 	//copy(tree.mtree4YoungestTwig[LeafCountInTwig+position][:], hash(bz))
 	tree.leave4YoungestTwig[position] = bzTwo
 
-	//!! if bzTwo[1] != nil {
-	//!! 	fmt.Printf("Fuck bzTwo pos %d %#v\n", pos, bzTwo)
-	//!! }
-
 	if position == 0 { // when this is the first entry of current twig
-		//fmt.Printf("Here FirstEntryPos of %d : %d\n", twigID, pos)
 		tree.activeTwigs[twigID].FirstEntryPos = pos
 	} else if position == TwigMask { // when this is the last entry of current twig
 		// write the merkle tree of youngest twig to twigMtFile
@@ -353,7 +398,8 @@ func (tree *Tree) appendEntry(bzTwo [2][]byte, sn int64) int64 {
 		tree.mtree4YoungestTwig = NullMT4Twig
 		tree.touchedPosOf512b[(sn+1)/512] = struct{}{}
 	}
-	return pos
+	length := len(bzTwo[0]) + len(bzTwo[1])
+	return PackEntryPos(pos, 8+length+getPaddingSize(length))
 }
 
 //!! func (tree *Tree) GetActiveEntriesInTwigOld(twigID int64) chan *Entry {
@@ -366,6 +412,11 @@ func (tree *Tree) GetActiveEntriesInTwig(twigID int64) chan []byte {
 	return tree.entryFile.GetActiveEntriesInTwig(twig)
 }
 
+func (tree *Tree) GetActiveEntriesInTwigCtx(ctx context.Context, twigID int64, outChan chan []byte) error {
+	twig := tree.activeTwigs[twigID]
+	return tree.entryFile.GetActiveEntriesInTwigCtx(ctx, twig, outChan)
+}
+
 func (tree *Tree) TwigCanBePruned(twigID int64) bool {
 	// Can not prune an active twig
 	_, ok := tree.activeTwigs[twigID]
@@ -379,6 +430,8 @@ func (tree *Tree) PruneTwigs(startID, endID int64) []byte {
 	}
 	tree.entryFile.PruneHead(tree.twigMtFile.GetFirstEntryPos(endID))
 	tree.twigMtFile.PruneHead(endID * TwigMtSize)
+	tree.twigsPruned.Add(float64(endID - startID))
+	tree.logger.Info("prune twigs", "startID", startID, "endID", endID)
 	return tree.ReapNodes(startID, endID)
 }
 
@@ -425,6 +478,7 @@ func (tree *Tree) getEdgeNodes(end int64) (newEdgeNodes []*EdgeNode) {
 
 func (tree *Tree) EvictTwig(twigID int64) {
 	tree.twigsToBeDeleted = append(tree.twigsToBeDeleted, twigID)
+	tree.twigsEvicted.Add(1)
 }
 
 func (tree *Tree) EndBlock() (rootHash []byte) {
@@ -440,8 +494,6 @@ func (tree *Tree) EndBlock() (rootHash []byte) {
 		tree.nodes[pos] = &twig.twigRoot
 		//leftRoot := tree.twigMtFile.GetHashNode(twigID, 1)
 		//twigRoot := hash2(11, leftRoot[:], NullTwig.activeBitsMTL3[:])
-		//fmt.Printf("Here delete activeTwig %d-%d twigRoot: %v\n", FirstLevelAboveTwig-1, twigID, twig.twigRoot)
-		//fmt.Printf("calculated twigRoot: %v\n", twigRoot)
 		delete(tree.activeTwigs, twigID)
 	}
 	tree.twigsToBeDeleted = tree.twigsToBeDeleted[:0] // clear its content
@@ -449,6 +501,8 @@ func (tree *Tree) EndBlock() (rootHash []byte) {
 	//start = gotsc.BenchStart()
 	tree.entryFile.FlushAsync()
 	tree.twigMtFile.FlushAsync()
+	tree.entryFileSize.Set(float64(tree.entryFile.Size()))
+	tree.twigMtFileSize.Set(float64(tree.twigMtFile.Size()))
 	//Phase2Time += gotsc.BenchEnd() - start - tscOverhead
 	return
 }
@@ -458,9 +512,6 @@ func (tree *Tree) syncMT() []byte {
 	maxLevel := calcMaxLevel(tree.youngestTwigID)
 	tree.syncMT4YoungestTwig()
 	nList := tree.syncMT4ActiveBits()
-	//if Debug {
-	//	fmt.Printf("nList: %v\n", nList)
-	//}
 	tree.syncUpperNodes(nList)
 	tree.touchedPosOf512b = make(map[int64]struct{}) // clear the list
 	hash := tree.nodes[Pos(maxLevel, 0)]
@@ -470,9 +521,6 @@ func (tree *Tree) syncMT() []byte {
 func (tree *Tree) syncUpperNodes(nList []int64) {
 	maxLevel := calcMaxLevel(tree.youngestTwigID)
 	for level := FirstLevelAboveTwig; level <= maxLevel; level++ {
-		//if Debug {
-		//	fmt.Printf("syncNodesByLevel: %d %v\n", level, nList)
-		//}
 		nList = tree.syncNodesByLevel(level, nList)
 	}
 }
@@ -507,7 +555,6 @@ func (tree *Tree) syncNodesByLevel(level int, nList []int64) []int64 {
 	for _, i := range nList {
 		nodePos := Pos(level, i)
 		if _, ok := tree.nodes[nodePos]; !ok {
-			//if Debug {fmt.Printf("Now create parent node %d-%d\n", level, i)}
 			var zeroHash [32]byte
 			tree.nodes[nodePos] = &zeroHash
 		}
@@ -522,8 +569,6 @@ func (tree *Tree) syncNodesByLevel(level int, nList []int64) []int64 {
 			}
 			parentNode := tree.nodes[nodePos]
 			h.Add(byte(level-1), (*parentNode)[:], left[:], right[:])
-			//if Debug {fmt.Printf("left: %#v right: %#v\n", left, right)}
-			//if Debug {fmt.Printf("New Job: %d-%d %d- %d %d\n", level, i, level-1, 2*i, 2*i+1)}
 		} else {
 			nodePosL := Pos(level-1, 2*i)
 			nodePosR := Pos(level-1, 2*i+1)
@@ -533,20 +578,15 @@ func (tree *Tree) syncNodesByLevel(level int, nList []int64) []int64 {
 			if _, ok := tree.nodes[nodePosR]; !ok {
 				var h [32]byte
 				copy(h[:], NullNodeInHigherTree[level][:])
-				//if Debug {fmt.Printf("Here we create a node %d-%d\n", level-1, 2*i+1)}
 				tree.nodes[nodePosR] = &h
 				if 2*i != maxN && 2*i+1 != maxN {
-					s := fmt.Sprintf("Not at the right edge, bug here. %d vs %d", 2*i, maxN)
-					fmt.Println(s)
-					panic(s)
+					panic(fmt.Sprintf("Not at the right edge, bug here. %d vs %d", 2*i, maxN))
 				}
 			}
 			parentNode := tree.nodes[nodePos]
 			nodeL := tree.nodes[nodePosL]
 			nodeR := tree.nodes[nodePosR]
 			h.Add(byte(level-1), (*parentNode)[:], (*nodeL)[:], (*nodeR)[:])
-			//if Debug {fmt.Printf("left: %#v right: %#v\n", (*nodeL)[:], (*nodeR)[:])}
-			//if Debug {fmt.Printf("New Job: %d-%d %d- %d %d\n", level, i, level-1, 2*i, 2*i+1)}
 		}
 		if len(newList) == 0 || newList[len(newList)-1] != i/2 {
 			newList = append(newList, i/2)
@@ -562,9 +602,6 @@ func (tree *Tree) syncMT4ActiveBits() []int64 {
 		nList = append(nList, i)
 	}
 	sort.Slice(nList, func(i, j int) bool {return nList[i] < nList[j]})
-	//if Debug {
-	//	fmt.Printf("nList from touchedPosOf512b: %#v\n", nList)
-	//}
 
 	newList := make([]int64, 0, len(nList))
 	var h Hasher
@@ -577,9 +614,6 @@ func (tree *Tree) syncMT4ActiveBits() []int64 {
 	}
 	h.Run()
 	nList = newList
-	//if Debug {
-	//	fmt.Printf("nList after syncL1: %#v\n", nList)
-	//}
 	newList = make([]int64, 0, len(nList))
 	for _, i := range nList {
 		twigID := int64(i >> 1)
@@ -590,9 +624,6 @@ func (tree *Tree) syncMT4ActiveBits() []int64 {
 	}
 	h.Run()
 	nList = newList
-	//if Debug {
-	//	fmt.Printf("nList after syncL2: %#v\n", nList)
-	//}
 	newList = make([]int64, 0, len(nList))
 	for _, twigID := range nList {
 		tree.activeTwigs[twigID].syncL3(&h)
@@ -605,9 +636,6 @@ func (tree *Tree) syncMT4ActiveBits() []int64 {
 		}
 	}
 	h.Run()
-	//if Debug {
-	//	fmt.Printf("nList after syncTop: %#v\n", newList)
-	//}
 	return newList
 }
 
@@ -648,7 +676,6 @@ func (tree *Tree) syncMT4YoungestTwig() {
 	level := byte(0)
 	start, end := tree.mtree4YTChangeStart, tree.mtree4YTChangeEnd
 	for base := LeafCountInTwig; base >= 2; base >>= 1 {
-		//fmt.Printf("base: %d\n", base)
 		endRound := end
 		if end%2 == 1 {
 			endRound++
@@ -656,7 +683,6 @@ func (tree *Tree) syncMT4YoungestTwig() {
 		for j := (start &^ 1); j <= endRound && j+1 < base; j += 2 {
 			i := base + j
 			h.Add(level, tree.mtree4YoungestTwig[i/2][:], tree.mtree4YoungestTwig[i][:], tree.mtree4YoungestTwig[i+1][:])
-			//fmt.Printf("Now job: %d-%d(%d) %d(%d) %d(%d)\n", level, j/2, i/2, j, i, j+1, i+1)
 		}
 		h.Run()
 		start >>= 1
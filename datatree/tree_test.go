@@ -8,6 +8,8 @@ import (
 
 	sha256 "github.com/minio/sha256-simd"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/coinexchain/onvakv/metrics"
 )
 
 // test the init function in tree.go
@@ -529,3 +531,40 @@ func TestTreeAppendEntry(t *testing.T) {
 	os.RemoveAll(dirName)
 }
 
+
+func TestTreeMetrics(t *testing.T) {
+	dirName := "./DataTree"
+	os.RemoveAll(dirName)
+	os.Mkdir(dirName, 0700)
+	tree, _, maxSerialNum := buildTestTree(dirName, nil, TwigMask, 6)
+	reg := metrics.NewMemRegistry()
+	tree.SetMetrics(reg)
+	entry := &Entry{
+		Key:        []byte("key"),
+		Value:      []byte("value"),
+		NextKey:    []byte("nextkey"),
+		Height:     100,
+		LastHeight: 99,
+		SerialNum:  maxSerialNum,
+	}
+	for i := 0; i < 10; i++ {
+		entry.SerialNum++
+		tree.AppendEntry(entry)
+	}
+	tree.DeactiviateEntry(3)
+	tree.DeactiviateEntry(5)
+	tree.EvictTwig(0)
+	tree.EndBlock()
+	tree.Flush()
+
+	assert.Equal(t, float64(10), reg.Value(metrics.EntriesAppended))
+	assert.Equal(t, float64(2), reg.Value(metrics.EntriesDeactivated))
+	assert.Equal(t, float64(1), reg.Value(metrics.TwigsEvicted))
+	assert.Equal(t, float64(tree.entryFile.Size()), reg.Value(metrics.EntryFileSize))
+	assert.Equal(t, float64(tree.twigMtFile.Size()), reg.Value(metrics.TwigMtFileSize))
+	assert.Equal(t, true, reg.Value(metrics.HPFileAppendedBytes, metrics.LabelFile, entriesPath) > 0)
+	assert.Equal(t, float64(0), reg.Value(metrics.HPFileAppendedBytes, metrics.LabelFile, twigMtPath))
+
+	tree.Close()
+	os.RemoveAll(dirName)
+}
@@ -3,23 +3,59 @@ package datatree
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/mmcloughlin/meow"
 )
 
+// ErrTwigChecksum is wrapped by the errors of the nodes whose checksums mismatch
+var ErrTwigChecksum = errors.New("Checksum error")
+
 type TwigMtFile struct {
 	HPFile
 }
 
 func NewTwigMtFile(bufferSize, blockSize int, dirName string) (res TwigMtFile, err error) {
-	res.HPFile, err = NewHPFile(bufferSize, blockSize, dirName)
+	return NewTwigMtFileWithOptions(bufferSize, blockSize, dirName, HPFileOptions{})
+}
+
+func NewTwigMtFileWithOptions(bufferSize, blockSize int, dirName string, opts HPFileOptions) (res TwigMtFile, err error) {
+	res.HPFile, err = NewHPFileWithOptions(bufferSize, blockSize, dirName, opts)
+	if err != nil {
+		return
+	}
+	version, err := res.HPFile.minFormatVersion()
+	if err == nil && version < FormatVersion2 {
+		err = fmt.Errorf("The twig Merkle tree file in %s has format version %d, please run onvakv-migrate", dirName, version)
+	}
 	return
 }
 
-const TwigMtEntryCount = 4095
-const TwigMtSize = 12 + TwigMtEntryCount*32
+// Since FormatVersion2, a twig's record begins with a TwigMtHeaderSize-byte header: 8-byte twig ID,
+// 8-byte first entry position, 4-byte checksum of the previous 16 bytes and 4 zero bytes. Then
+// the 4095 nodes follow, each with a 32-byte hash and a 4-byte checksum of the twig ID, the
+// node's ID and the hash, so a node read from a wrong place is detected, too.
+const (
+	TwigMtEntryCount = 4095
+	TwigMtHeaderSize = 24
+	TwigMtNodeSize   = 36
+	TwigMtSize       = TwigMtHeaderSize + TwigMtEntryCount*TwigMtNodeSize
+
+	twigMtSizeV1 = 12 + TwigMtEntryCount*32 // the record without checksums of nodes
+)
+
+func twigMtNodeChecksum(twigID int64, hashID int, hash []byte) []byte {
+	var buf [12]byte
+	binary.LittleEndian.PutUint64(buf[:8], uint64(twigID))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(hashID))
+	h := meow.New32(0)
+	h.Write(buf[:])
+	h.Write(hash)
+	return h.Sum(nil)
+}
 
+// Append the Merkle tree of the next twig, whose ID is decided by the file's size
 func (tf *TwigMtFile) AppendTwig(mtree [][32]byte, firstEntryPos int64) {
 	if firstEntryPos < 0 {
 		panic(fmt.Sprintf("Invalid first entry position: %d", firstEntryPos))
@@ -27,16 +63,20 @@ func (tf *TwigMtFile) AppendTwig(mtree [][32]byte, firstEntryPos int64) {
 	if len(mtree) != TwigMtEntryCount {
 		panic(fmt.Sprintf("len(mtree) != %d", TwigMtEntryCount))
 	}
-	var buf [8]byte
-	binary.LittleEndian.PutUint64(buf[:], uint64(firstEntryPos))
+	twigID := tf.HPFile.Size() / TwigMtSize
+	var buf [TwigMtHeaderSize]byte
+	binary.LittleEndian.PutUint64(buf[:8], uint64(twigID))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(firstEntryPos))
 	h := meow.New32(0)
-	h.Write(buf[:])
-	_, err := tf.HPFile.Append([][]byte{buf[:], h.Sum(nil)}) // 8+4 bytes
+	h.Write(buf[:16])
+	copy(buf[16:20], h.Sum(nil))
+	_, err := tf.HPFile.Append([][]byte{buf[:]})
 	if err != nil {
 		panic(err)
 	}
 	for i := 0; i < len(mtree); i++ { // 4095 iterations
-		_, err := tf.HPFile.Append([][]byte{mtree[i][:]}) // 32 bytes
+		sum := twigMtNodeChecksum(twigID, i+1, mtree[i][:])
+		_, err := tf.HPFile.Append([][]byte{mtree[i][:], sum}) // 32+4 bytes
 		if err != nil {
 			panic(err)
 		}
@@ -44,30 +84,38 @@ func (tf *TwigMtFile) AppendTwig(mtree [][32]byte, firstEntryPos int64) {
 }
 
 func (tf *TwigMtFile) GetFirstEntryPos(twigID int64) int64 {
-	var buf [12]byte
+	var buf [TwigMtHeaderSize]byte
 	err := tf.HPFile.ReadAt(buf[:], twigID*TwigMtSize, false)
 	if err != nil {
 		panic(err)
 	}
 	h := meow.New32(0)
-	h.Write(buf[:8])
-	if !bytes.Equal(buf[8:], h.Sum(nil)) {
+	h.Write(buf[:16])
+	if !bytes.Equal(buf[16:20], h.Sum(nil)) {
 		panic("Checksum Error!")
 	}
-	return int64(binary.LittleEndian.Uint64(buf[:8]))
+	if id := int64(binary.LittleEndian.Uint64(buf[:8])); id != twigID {
+		panic(fmt.Sprintf("Found twig %d at the place of twig %d", id, twigID))
+	}
+	return int64(binary.LittleEndian.Uint64(buf[8:16]))
 }
 
-func (tf *TwigMtFile) GetHashNode(twigID int64, hashID int) []byte {
-	var buf [32]byte
+// Return the hash of the node with hashID in the twig's Merkle tree, or an error if its checksum
+// mismatches.
+func (tf *TwigMtFile) GetHashNode(twigID int64, hashID int) ([]byte, error) {
+	var buf [TwigMtNodeSize]byte
 	if hashID <= 0 || hashID >= 4096 {
 		panic(fmt.Sprintf("Invalid hashID: %d", hashID))
 	}
-	offset := twigID*int64(TwigMtSize) + 12 + (int64(hashID)-1)*32
+	offset := twigID*int64(TwigMtSize) + TwigMtHeaderSize + (int64(hashID)-1)*TwigMtNodeSize
 	err := tf.HPFile.ReadAt(buf[:], offset, false)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if !bytes.Equal(buf[32:], twigMtNodeChecksum(twigID, hashID, buf[:32])) {
+		return nil, fmt.Errorf("%w of node %d in twig %d", ErrTwigChecksum, hashID, twigID)
 	}
-	return buf[:]
+	return buf[:32], nil
 }
 
 func (tf *TwigMtFile) Size() int64 {
@@ -1,6 +1,9 @@
 package datatree
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
 	"encoding/binary"
@@ -45,12 +48,60 @@ func TestTwimMtFile(t *testing.T) {
 	assert.Equal(t, int64(2000789), tf.GetFirstEntryPos(2))
 
 	for i := 0; i<TwigMtEntryCount; i++ {
-		assert.Equal(t, twig0[i][:], tf.GetHashNode(0, i+1))
-		assert.Equal(t, twig1[i][:], tf.GetHashNode(1, i+1))
-		assert.Equal(t, twig2[i][:], tf.GetHashNode(2, i+1))
+		for j, twig := range [][][32]byte{twig0, twig1, twig2} {
+			node, err := tf.GetHashNode(int64(j), i+1)
+			assert.Nil(t, err)
+			assert.Equal(t, twig[i][:], node)
+		}
 	}
 
 	tf.Close()
 
 	os.RemoveAll("./twig")
 }
+
+func TestTwigMtFileChecksum(t *testing.T) {
+	os.RemoveAll("./twig")
+	os.Mkdir("./twig", 0700)
+
+	tf, err := NewTwigMtFile(64*1024, 1*1024*1024/*1MB*/, "./twig")
+	assert.Equal(t, nil, err)
+	tf.AppendTwig(generateTwig(1000), 789)
+	tf.AppendTwig(generateTwig(1111111), 1000789)
+	tf.Flush()
+	tf.Close()
+
+	// corrupt a hash node of twig 1
+	path := fmt.Sprintf("./twig/0-%d", 1*1024*1024)
+	f, err := os.OpenFile(path, os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	off := int64(FormatHeaderSize) + TwigMtSize + TwigMtHeaderSize + 9*TwigMtNodeSize + 3
+	_, err = f.WriteAt([]byte{0xFF}, off)
+	assert.Nil(t, err)
+	f.Close()
+
+	tf, err = NewTwigMtFile(64*1024, 1*1024*1024/*1MB*/, "./twig")
+	assert.Equal(t, nil, err)
+	_, err = tf.GetHashNode(0, 10)
+	assert.Nil(t, err)
+	_, err = tf.GetHashNode(1, 9)
+	assert.Nil(t, err)
+	_, err = tf.GetHashNode(1, 10)
+	assert.Equal(t, "Checksum error of node 10 in twig 1", err.Error())
+	assert.True(t, errors.Is(err, ErrTwigChecksum))
+	tf.Close()
+
+	// a record at the place of another twig is detected by its twig ID
+	bz, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	copy(bz[FormatHeaderSize:], bz[FormatHeaderSize+TwigMtSize:FormatHeaderSize+2*TwigMtSize])
+	assert.Nil(t, ioutil.WriteFile(path, bz, 0700))
+	tf, err = NewTwigMtFile(64*1024, 1*1024*1024/*1MB*/, "./twig")
+	assert.Equal(t, nil, err)
+	assert.Panics(t, func() { tf.GetFirstEntryPos(0) })
+	_, err = tf.GetHashNode(0, 9)
+	assert.NotNil(t, err)
+	tf.Close()
+
+	os.RemoveAll("./twig")
+}
@@ -0,0 +1,217 @@
+package onvakv
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/coinexchain/onvakv/types"
+)
+
+// The entries in a range are read by ReadEntries in batches of this size
+const deleteRangeReadBatch = 1024
+
+// [start, end) deleted by DeleteRange, and the keys in it with their positions and serial numbers
+type keyRange struct {
+	start      []byte
+	end        []byte
+	keys       [][]byte
+	positions  []int64
+	serialNums []int64
+}
+
+// Check whether the keys in [start, end) can be deleted. start must be larger than the start
+// guard key, and end (nil means the end guard key) must not be larger than the end guard key.
+// The range must not contain the entries of KeySpaces, including their guards. Like Exists of
+// KeySpace, it must not be called between BeginWrite and EndWrite.
+func (okv *OnvaKV) CheckRange(start, end []byte) error {
+	if err := okv.limits.CheckKV(start, nil); err != nil {
+		return err
+	}
+	if c := bytes.Compare(start, okv.startKey); c == 0 {
+		return types.NewKVError(types.ErrGuardKey, start, 0, 0)
+	} else if c < 0 {
+		return types.NewKVError(types.ErrKeyOutOfRange, start, 0, 0)
+	}
+	if end != nil && bytes.Compare(end, okv.endKey) > 0 {
+		return types.NewKVError(types.ErrKeyOutOfRange, end, 0, 0)
+	}
+	if end == nil {
+		end = okv.endKey
+	}
+	// the entries of KeySpaces are in [{KeySpaceMark}, {KeySpaceMark+1})
+	s, e := start, end
+	if bytes.Compare(s, []byte{KeySpaceMark}) < 0 {
+		s = []byte{KeySpaceMark}
+	}
+	if bytes.Compare(e, []byte{KeySpaceMark + 1}) > 0 {
+		e = []byte{KeySpaceMark + 1}
+	}
+	if bytes.Compare(s, e) >= 0 {
+		return nil
+	}
+	iter := okv.idxTree.Iterator(s, e)
+	defer iter.Close()
+	if iter.Valid() {
+		return types.NewKVError(types.ErrKeySpaceKey, iter.Key(), 0, 0)
+	}
+	return nil
+}
+
+// Collect the keys in [start, end) before BeginWrite, since idxTree cannot be iterated while
+// writing. nil end means the end guard key. The entry before the range is loaded as a hot
+// entry, and the key after it as a next key, like what PrepareForDeletion does for a key. It
+// panics with *types.KVError on an invalid range. Use CheckRange to validate it in advance.
+func (okv *OnvaKV) PrepareForDeleteRange(start, end []byte) {
+	if err := okv.CheckRange(start, end); err != nil {
+		panic(err)
+	}
+	if end == nil {
+		end = okv.endKey
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return
+	}
+	r := &keyRange{
+		start: append([]byte{}, start...),
+		end:   append([]byte{}, end...),
+	}
+	iter := okv.idxTree.Iterator(r.start, r.end)
+	for ; iter.Valid(); iter.Next() {
+		r.keys = append(r.keys, append([]byte{}, iter.Key()...))
+		r.positions = append(r.positions, int64(iter.Value()))
+	}
+	iter.Close()
+	// the serial numbers are read here, so update() does not read the entries one by one
+	r.serialNums = make([]int64, 0, len(r.positions))
+	for i := 0; i < len(r.positions); i += deleteRangeReadBatch {
+		end := i + deleteRangeReadBatch
+		if end > len(r.positions) {
+			end = len(r.positions)
+		}
+		for _, entry := range okv.datTree.ReadEntries(r.positions[i:end]) {
+			r.serialNums = append(r.serialNums, entry.SerialNum)
+		}
+	}
+
+	prevEntry := okv.getPrevEntry(r.start)
+	okv.k2heMap.Store(string(prevEntry.Key), &HotEntry{
+		EntryPtr:  prevEntry,
+		Operation: types.OpNone,
+	})
+	nextKey := okv.endKey
+	if !bytes.Equal(r.end, okv.endKey) {
+		iter := okv.idxTree.Iterator(r.end, okv.endKey)
+		if iter.Valid() {
+			nextKey = append([]byte{}, iter.Key()...)
+		}
+		iter.Close()
+	}
+	okv.k2nkMap.Store(string(nextKey), nil)
+
+	okv.rangeMtx.Lock()
+	defer okv.rangeMtx.Unlock()
+	if okv.preparedRanges == nil {
+		okv.preparedRanges = make(map[[2]string]*keyRange)
+	}
+	okv.preparedRanges[[2]string{string(r.start), string(r.end)}] = r
+}
+
+// Delete all the keys in [start, end), which must have been passed to PrepareForDeleteRange.
+// Like Delete, it must be called between BeginWrite and EndWrite. The ranges are deleted before
+// the Set and Delete operations in the same block, no matter in which order they are called.
+func (okv *OnvaKV) DeleteRange(start, end []byte) {
+	if end == nil {
+		end = okv.endKey
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return
+	}
+	okv.rangeMtx.Lock()
+	defer okv.rangeMtx.Unlock()
+	r, ok := okv.preparedRanges[[2]string{string(start), string(end)}]
+	if !ok {
+		panic("The range is not prepared")
+	}
+	okv.deletedRanges = append(okv.deletedRanges, r)
+}
+
+// Sort the ranges and merge the overlapping ones. The keys of the merged ranges are not used.
+func mergeRanges(ranges []*keyRange) []keyRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+	var res []keyRange
+	for _, r := range ranges {
+		if len(res) != 0 && bytes.Compare(r.start, res[len(res)-1].end) <= 0 {
+			last := &res[len(res)-1]
+			if bytes.Compare(r.end, last.end) > 0 {
+				last.end = r.end
+			}
+			continue
+		}
+		res = append(res, keyRange{start: r.start, end: r.end})
+	}
+	return res
+}
+
+// Apply the deleted ranges before update() processes the hot entries. The entries which are not
+// hot are removed from idxTree and deactivated directly by the serial numbers read in
+// PrepareForDeleteRange, without being loaded into k2heMap. The hot entries in the ranges are
+// marked as deleted, unless they are changed in this block. The entries which are next keys of
+// others are loaded as deleted hot entries, so the NextKey fields pointing to them are handled by
+// update().
+func (okv *OnvaKV) applyDeletedRanges() []keyRange {
+	if len(okv.deletedRanges) == 0 {
+		return nil
+	}
+	done := make(map[string]struct{}) // the ranges may overlap
+	for _, r := range okv.deletedRanges {
+		for i, key := range r.keys {
+			if _, ok := done[string(key)]; ok {
+				continue
+			}
+			done[string(key)] = struct{}{}
+			if hotEntry, ok := okv.k2heMap.Load(string(key)); ok && hotEntry != nil {
+				if hotEntry.Operation == types.OpNone {
+					hotEntry.Operation = types.OpDelete
+				}
+				continue
+			}
+			if _, ok := okv.k2nkMap.Load(string(key)); ok { // only a few entries are read here
+				okv.k2heMap.Store(string(key), &HotEntry{
+					EntryPtr:  okv.datTree.ReadEntry(r.positions[i]),
+					Operation: types.OpDelete,
+				})
+				continue
+			}
+			okv.idxTree.Delete(key)
+			okv.DeactiviateEntry(r.serialNums[i])
+		}
+	}
+	return mergeRanges(okv.deletedRanges)
+}
+
+// After the NextKey fields are set for insertions and deletions, make the live entries before
+// and in the deleted ranges point to their new next entries
+func (okv *OnvaKV) fixNextKeys(ranges []keyRange) {
+	for _, r := range ranges {
+		i := sort.Search(len(okv.cachedEntries), func(i int) bool {
+			return bytes.Compare(okv.cachedEntries[i].EntryPtr.Key, r.start) >= 0
+		})
+		// the entry before the range is live and hot, because the ranges do not overlap
+		for i = getPrev(okv.cachedEntries, i); i < len(okv.cachedEntries); i++ {
+			hotEntry := okv.cachedEntries[i]
+			if bytes.Compare(hotEntry.EntryPtr.Key, r.end) >= 0 {
+				break
+			}
+			if hotEntry.Operation == types.OpDelete || isFakeInserted(hotEntry) || isHintHotEntry(hotEntry) {
+				continue
+			}
+			nextKey := okv.cachedEntries[getNext(okv.cachedEntries, i)].EntryPtr.Key
+			if !bytes.Equal(hotEntry.EntryPtr.NextKey, nextKey) {
+				hotEntry.EntryPtr.NextKey = nextKey
+				hotEntry.IsTouchedByNext = true
+			}
+		}
+	}
+}
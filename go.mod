@@ -5,6 +5,7 @@ go 1.14
 require (
 	github.com/coinexchain/randsrc v0.2.0
 	github.com/dterei/gotsc v0.0.0-20160722215413-e78f872945c6
+	github.com/golang/snappy v0.0.1
 	github.com/minio/sha256-simd v0.1.1
 	github.com/mmcloughlin/meow v0.0.0-20181112033425-871e50784daf
 	github.com/pkg/profile v1.5.0
@@ -2,7 +2,7 @@ package b
 
 import (
 	"bytes"
-	//"fmt"
+	"fmt"
 	"io"
 	"testing"
 
@@ -105,3 +105,55 @@ func TestBTree(t *testing.T) {
 	bt.Close()
 }
 
+
+func TestLoadSorted(t *testing.T) {
+	for _, count := range []int{0, 1, 64, 65, 5000, 100000} {
+		bt := TreeNew(bytes.Compare)
+		keys := make([][]byte, count)
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("key%08d", i*2))
+		}
+		i := 0
+		bt.LoadSorted(func() ([]byte, uint64, bool) {
+			if i == len(keys) {
+				return nil, 0, false
+			}
+			i++
+			return keys[i-1], uint64(i - 1), true
+		})
+		assert.Equal(t, count, bt.Len())
+		for i, key := range keys {
+			assert.Equal(t, uint64(i), mustGet(t, bt, key))
+		}
+		iter, err := bt.SeekFirst()
+		for i := 0; i < count; i++ {
+			k, v, err := iter.Next()
+			assert.Nil(t, err)
+			assert.Equal(t, keys[i], k)
+			assert.Equal(t, uint64(i), v)
+		}
+		if err == nil {
+			_, _, err = iter.Next()
+			iter.Close()
+		}
+		assert.Equal(t, io.EOF, err)
+
+		// the loaded tree can still be modified
+		for i := range keys {
+			bt.Set([]byte(fmt.Sprintf("key%08d", i*2+1)), uint64(i))
+			if i%3 == 0 {
+				bt.Delete(keys[i])
+			}
+		}
+		assert.Equal(t, 2*count-(count+2)/3, bt.Len())
+		for i, key := range keys {
+			v, ok := bt.Get(key)
+			assert.Equal(t, i%3 != 0, ok)
+			if ok {
+				assert.Equal(t, uint64(i), v)
+			}
+			assert.Equal(t, uint64(i), mustGet(t, bt, []byte(fmt.Sprintf("key%08d", i*2+1))))
+		}
+		bt.Close()
+	}
+}
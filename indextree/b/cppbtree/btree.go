@@ -50,6 +50,17 @@ func (tree *Tree) Set(key []byte, value uint64) {
 	C.cppbtree_set(tree.ptr, keydata, C.int(len(key)), C.uint64_t(value))
 }
 
+// Fill an empty tree with the K/V pairs in ascending order of keys
+func (tree *Tree) LoadSorted(next func() (k []byte, v uint64, ok bool)) {
+	for {
+		k, v, ok := next()
+		if !ok {
+			return
+		}
+		tree.Set(k, v)
+	}
+}
+
 func (tree *Tree) Delete(key []byte) {
 	keydata := (*C.char)(unsafe.Pointer(&key[0]))
 	C.cppbtree_erase(tree.ptr, keydata, C.int(len(key)))
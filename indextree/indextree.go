@@ -2,6 +2,7 @@ package indextree
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
 	"math"
@@ -10,6 +11,8 @@ import (
 	dbm "github.com/tendermint/tm-db"
 
 	"github.com/coinexchain/onvakv/indextree/b"
+	"github.com/coinexchain/onvakv/logging"
+	"github.com/coinexchain/onvakv/metrics"
 	"github.com/coinexchain/onvakv/types"
 )
 
@@ -116,6 +119,8 @@ type NVTreeMem struct {
 	rocksdb    *RocksDB
 	batch      dbm.Batch
 	currHeight [8]byte
+	btreeSize  metrics.Gauge
+	logger     logging.Logger
 }
 
 var _ types.IndexTree = (*NVTreeMem)(nil)
@@ -123,11 +128,22 @@ var _ types.IndexTree = (*NVTreeMem)(nil)
 func NewNVTreeMem(rocksdb *RocksDB) *NVTreeMem {
 	btree := b.TreeNew(bytes.Compare)
 	return &NVTreeMem{
-		bt:      btree,
-		rocksdb: rocksdb,
+		bt:        btree,
+		rocksdb:   rocksdb,
+		btreeSize: metrics.NopRegistry{}.NewGauge(metrics.IndexTreeSize),
+		logger:    logging.Default().With("module", "indextree"),
 	}
 }
 
+func (tree *NVTreeMem) SetMetrics(reg metrics.Registry) {
+	tree.btreeSize = metrics.OrNop(reg).NewGauge(metrics.IndexTreeSize)
+	tree.btreeSize.Set(float64(tree.bt.Len()))
+}
+
+func (tree *NVTreeMem) SetLogger(logger logging.Logger) {
+	tree.logger = logging.OrNop(logger).With("module", "indextree")
+}
+
 func (tree *NVTreeMem) Close() {
 	tree.bt.Close()
 }
@@ -139,16 +155,29 @@ func (tree *NVTreeMem) ActiveCount() int {
 // Load the RocksDB and use its up-to-date records to initialize the in-memory B-Tree.
 // RocksDB's historical records are ignored.
 func (tree *NVTreeMem) Init(repFn func([]byte)) (err error) {
+	return tree.InitCtx(context.Background(), repFn)
+}
+
+// Like Init, but returns ctx.Err() if ctx is cancelled before all the records are loaded.
+// repFn can be nil.
+func (tree *NVTreeMem) InitCtx(ctx context.Context, repFn func([]byte)) (err error) {
 	iter := tree.rocksdb.Iterator([]byte{}, []byte(nil))
 	defer iter.Close()
-	for iter.Valid() {
+	for ; iter.Valid(); iter.Next() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		k := iter.Key()
 		v := iter.Value()
 		if k[0] != 0 {
 			continue // the first byte must be zero
 		}
 		k = k[1:]
-		repFn(k) // to report the progress
+		if repFn != nil {
+			repFn(k) // to report the progress
+		}
 		if len(k) < 8 {
 			panic("key length is too short")
 		}
@@ -159,11 +188,24 @@ func (tree *NVTreeMem) Init(repFn func([]byte)) (err error) {
 			//write the up-to-date value
 			tree.bt.Set(k[:len(k)-8], binary.LittleEndian.Uint64(v))
 		}
-		iter.Next()
 	}
+	tree.logger.Info("init from rocksdb", "activeCount", tree.bt.Len())
 	return nil
 }
 
+// Fill the empty B-Tree with the key-position records returned by next, whose keys must be in
+// strictly ascending order. It is used to rebuild the index of a tree without RocksDB, because
+// no historical record is written.
+func (tree *NVTreeMem) LoadSorted(next func() (k []byte, v uint64, ok bool)) {
+	if tree.rocksdb != nil {
+		panic("LoadSorted can not write the historical records to RocksDB")
+	}
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	tree.bt.LoadSorted(next)
+	tree.btreeSize.Set(float64(tree.bt.Len()))
+}
+
 // Begin the write phase of block execution
 func (tree *NVTreeMem) BeginWrite(currHeight int64) {
 	tree.mtx.Lock()
@@ -180,6 +222,7 @@ func (tree *NVTreeMem) EndWrite() {
 		panic("tree.isWriting cannot be false! bug here...")
 	}
 	tree.isWriting = false
+	tree.btreeSize.Set(float64(tree.bt.Len()))
 	tree.mtx.Unlock()
 }
 
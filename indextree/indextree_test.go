@@ -1,6 +1,9 @@
 package indextree
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
 
@@ -145,3 +148,95 @@ func Test1(t *testing.T) {
 
 	os.RemoveAll("./idxtree.db")
 }
+
+func TestInitCtx(t *testing.T) {
+	dirName := "./initctx"
+	os.RemoveAll(dirName)
+	os.Mkdir(dirName, 0700)
+	rocksdb, tree := createNVTreeMem(dirName)
+	tree.BeginWrite(0)
+	rocksdb.OpenNewBatch()
+	tree.Set([]byte("ABcd1234"), 1)
+	tree.Set([]byte("ABcd1235"), 2)
+	rocksdb.CloseOldBatch()
+	tree.EndWrite()
+	tree.Close()
+	rocksdb.Close()
+
+	rocksdb, tree = createNVTreeMem(dirName)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := tree.InitCtx(ctx, nil)
+	assert.Equal(t, context.Canceled, err)
+	tree.Close()
+
+	tree = NewNVTreeMem(rocksdb)
+	var keys []string
+	err = tree.InitCtx(context.Background(), func(k []byte) {
+		keys = append(keys, string(k))
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, len(keys) >= 2)
+	assert.Equal(t, 2, tree.ActiveCount())
+	assert.Equal(t, uint64(2), mustGet(tree, []byte("ABcd1235")))
+	tree.Close()
+	rocksdb.Close()
+	os.RemoveAll(dirName)
+}
+
+func TestSnapshot(t *testing.T) {
+	dirName := "./snapshot"
+	os.RemoveAll(dirName)
+	os.Mkdir(dirName, 0700)
+	fname := dirName + "/index.snapshot"
+	tree := NewNVTreeMem(nil)
+	tree.BeginWrite(0)
+	for i := 0; i < 5000; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%d", i*7)), uint64(i)<<40|uint64(i))
+	}
+	tree.Set([]byte{}, 1)
+	tree.Delete([]byte("key7"))
+	tree.EndWrite()
+	assert.Nil(t, tree.SaveSnapshot(fname, 100))
+
+	tree2 := NewNVTreeMem(nil)
+	count := 0
+	assert.Nil(t, tree2.LoadSnapshot(fname, 100, func([]byte) { count++ }))
+	assert.Equal(t, tree.ActiveCount(), count)
+	assert.Equal(t, tree.ActiveCount(), tree2.ActiveCount())
+	iter, iter2 := tree.Iterator([]byte{}, []byte("l")), tree2.Iterator([]byte{}, []byte("l"))
+	for ; iter.Valid(); iter.Next() {
+		assert.Equal(t, iter.Key(), iter2.Key())
+		assert.Equal(t, iter.Value(), iter2.Value())
+		iter2.Next()
+	}
+	assert.Equal(t, false, iter2.Valid())
+	iter.Close()
+	iter2.Close()
+	tree2.Close()
+
+	// a stale snapshot is not loaded
+	tree2 = NewNVTreeMem(nil)
+	assert.Equal(t, ErrStaleSnapshot, tree2.LoadSnapshot(fname, 101, nil))
+	assert.Equal(t, 0, tree2.ActiveCount())
+
+	// a corrupted snapshot leaves the tree empty
+	bz, err := ioutil.ReadFile(fname)
+	assert.Nil(t, err)
+	bz[len(bz)/2] ^= 1
+	assert.Nil(t, ioutil.WriteFile(fname, bz, 0700))
+	assert.NotNil(t, tree2.LoadSnapshot(fname, 100, nil))
+	assert.Equal(t, 0, tree2.ActiveCount())
+	_, ok := tree2.Get([]byte("key14"))
+	assert.Equal(t, false, ok)
+	tree2.Close()
+
+	// an empty tree
+	tree.Close()
+	tree = NewNVTreeMem(nil)
+	assert.Nil(t, tree.SaveSnapshot(fname, 0))
+	assert.Nil(t, tree.LoadSnapshot(fname, 0, nil))
+	assert.Equal(t, 0, tree.ActiveCount())
+	tree.Close()
+	os.RemoveAll(dirName)
+}
@@ -2,9 +2,12 @@ package indextree
 
 import (
 	"bytes"
+	"context"
 	"io"
 
 	"github.com/coinexchain/onvakv/indextree/b"
+	"github.com/coinexchain/onvakv/logging"
+	"github.com/coinexchain/onvakv/metrics"
 )
 
 type MockIndexTree struct {
@@ -25,6 +28,16 @@ func (it *MockIndexTree) Init(repFn func([]byte)) error {
 	return nil
 }
 
+func (it *MockIndexTree) InitCtx(ctx context.Context, repFn func([]byte)) error {
+	return nil
+}
+
+func (it *MockIndexTree) SetMetrics(reg metrics.Registry) {
+}
+
+func (it *MockIndexTree) SetLogger(logger logging.Logger) {
+}
+
 func (it *MockIndexTree) BeginWrite(height int64) {
 	return
 }
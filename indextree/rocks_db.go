@@ -9,12 +9,15 @@ import (
 
 	"github.com/tecbot/gorocksdb"
 	dbm "github.com/tendermint/tm-db"
+
+	"github.com/coinexchain/onvakv/logging"
 )
 
 // We use rocksdb's customizable compact filter to prune old records
 type HeightCompactionFilter struct {
 	pruneHeight uint64
 	pruneEnable bool
+	logger      logging.Logger
 }
 
 func (f *HeightCompactionFilter) Name() string {
@@ -32,6 +35,9 @@ func (f *HeightCompactionFilter) Filter(level int, key, val []byte) (remove bool
 	start := len(key) - 8
 	h := binary.BigEndian.Uint64(key[start:])
 	if f.pruneEnable && f.pruneHeight > h {
+		if f.logger.Enabled(logging.DebugLevel) {
+			f.logger.Debug("remove expired record", "level", level, "key", key, "height", h)
+		}
 		return true, nil
 	} else {
 		return false, val
@@ -83,7 +89,7 @@ func NewRocksDB(name string, dir string) (*RocksDB, error) {
 
 func NewRocksDBWithOptions(name string, dir string, opts *gorocksdb.Options) (*RocksDB, error) {
 	dbPath := filepath.Join(dir, name+".db")
-	filter := HeightCompactionFilter{}
+	filter := HeightCompactionFilter{logger: logging.Default().With("module", "rocksdb")}
 	opts.SetCompactionFilter(&filter) // use a customized compaction filter
 	db, err := gorocksdb.OpenDb(opts, dbPath)
 	if err != nil {
@@ -103,9 +109,16 @@ func NewRocksDBWithOptions(name string, dir string, opts *gorocksdb.Options) (*R
 	return database, nil
 }
 
+// The compaction filter is invoked by rocksdb's background threads, so the logger
+// should be set before the first compaction, e.g. right after opening the database.
+func (db *RocksDB) SetLogger(logger logging.Logger) {
+	db.filter.logger = logging.OrNop(logger).With("module", "rocksdb")
+}
+
 func (db *RocksDB) SetPruneHeight(h uint64) {
 	if db.filter.pruneHeight < h {
 		db.filter.pruneHeight = h
+		db.filter.logger.Debug("set prune height", "height", h)
 	}
 	db.filter.pruneEnable = true
 }
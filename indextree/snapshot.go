@@ -0,0 +1,200 @@
+package indextree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mmcloughlin/meow"
+
+	"github.com/coinexchain/onvakv/indextree/b"
+)
+
+// A snapshot file begins with a header: 8-byte magic, 32b-version, 32b-zero, 64b-height and
+// 64b-count. Then the records follow in the order of keys. Each record has the length of the
+// common prefix with the previous key, the length and bytes of the remaining suffix, and the
+// position, all the integers in uvarint. The file ends with the meow64 checksum of the bytes
+// before it.
+const (
+	SnapshotVersion    = 1
+	snapshotHeaderSize = 32
+	snapshotBufSize    = 1024 * 1024
+)
+
+var (
+	SnapshotMagic = [8]byte{'O', 'N', 'V', 'A', 'I', 'D', 'X', 0}
+
+	ErrStaleSnapshot = errors.New("The index snapshot is taken at another height")
+)
+
+// Write the up-to-date key-position records of the B-Tree into the snapshot file fname, which
+// is taken at height. A temporary file is renamed to fname at last, so fname is never partial.
+func (tree *NVTreeMem) SaveSnapshot(fname string, height int64) (err error) {
+	tree.mtx.RLock()
+	defer tree.mtx.RUnlock()
+	tmpName := fname + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmpName)
+		}
+	}()
+	h := meow.New64(0)
+	w := bufio.NewWriterSize(io.MultiWriter(f, h), snapshotBufSize)
+	var header [snapshotHeaderSize]byte
+	copy(header[:8], SnapshotMagic[:])
+	binary.LittleEndian.PutUint32(header[8:12], SnapshotVersion)
+	binary.LittleEndian.PutUint64(header[16:24], uint64(height))
+	binary.LittleEndian.PutUint64(header[24:32], uint64(tree.bt.Len()))
+	if _, err = w.Write(header[:]); err != nil {
+		return err
+	}
+	if tree.bt.Len() != 0 {
+		e, err := tree.bt.SeekFirst()
+		if err != nil {
+			return err
+		}
+		defer e.Close()
+		var prev []byte
+		var buf [3 * binary.MaxVarintLen64]byte
+		for {
+			k, v, err := e.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			shared := 0
+			for shared < len(prev) && shared < len(k) && prev[shared] == k[shared] {
+				shared++
+			}
+			n := binary.PutUvarint(buf[:], uint64(shared))
+			n += binary.PutUvarint(buf[n:], uint64(len(k)-shared))
+			w.Write(buf[:n])
+			w.Write(k[shared:])
+			n = binary.PutUvarint(buf[:], v)
+			if _, err = w.Write(buf[:n]); err != nil {
+				return err
+			}
+			prev = append(prev[:0], k...)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if _, err = f.Write(h.Sum(nil)); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fname)
+}
+
+// Fill the empty B-Tree with the records in the snapshot file fname. ErrStaleSnapshot is
+// returned if it is not taken at height. If it is corrupted, an error is returned and the
+// B-Tree is left empty. repFn can be nil.
+func (tree *NVTreeMem) LoadSnapshot(fname string, height int64, repFn func([]byte)) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < snapshotHeaderSize+8 {
+		return fmt.Errorf("The index snapshot %s is too short", fname)
+	}
+	h := meow.New64(0)
+	r := bufio.NewReaderSize(io.TeeReader(io.LimitReader(f, info.Size()-8), h), snapshotBufSize)
+	var header [snapshotHeaderSize]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:8], SnapshotMagic[:]) {
+		return fmt.Errorf("%s is not an index snapshot", fname)
+	}
+	if version := binary.LittleEndian.Uint32(header[8:12]); version != SnapshotVersion {
+		return fmt.Errorf("Unknown version %d of the index snapshot", version)
+	}
+	if int64(binary.LittleEndian.Uint64(header[16:24])) != height {
+		return ErrStaleSnapshot
+	}
+	count := binary.LittleEndian.Uint64(header[24:32])
+
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	var prev []byte
+	loaded := uint64(0)
+	tree.bt.LoadSorted(func() ([]byte, uint64, bool) {
+		if err != nil || loaded == count {
+			return nil, 0, false
+		}
+		var key []byte
+		var v uint64
+		key, v, err = readSnapshotRecord(r, prev)
+		if err != nil {
+			return nil, 0, false
+		}
+		if repFn != nil {
+			repFn(key)
+		}
+		prev = key
+		loaded++
+		return key, v, true
+	})
+	if err == nil {
+		var sum [8]byte
+		if _, err = r.Read(sum[:1]); err != io.EOF {
+			err = fmt.Errorf("The index snapshot %s has extra bytes", fname)
+		} else if _, err = io.ReadFull(f, sum[:]); err == nil && !bytes.Equal(sum[:], h.Sum(nil)) {
+			err = fmt.Errorf("Checksum error of the index snapshot %s", fname)
+		}
+	}
+	if err != nil {
+		tree.bt.Close()
+		tree.bt = b.TreeNew(bytes.Compare)
+		return err
+	}
+	tree.btreeSize.Set(float64(tree.bt.Len()))
+	tree.logger.Info("load the snapshot", "activeCount", tree.bt.Len(), "height", height)
+	return nil
+}
+
+// Read the record following the one of prev
+func readSnapshotRecord(r *bufio.Reader, prev []byte) (key []byte, v uint64, err error) {
+	shared, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	suffixLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if shared > uint64(len(prev)) || shared+suffixLen > MaxKeyLength {
+		return nil, 0, errors.New("Invalid key length in the index snapshot")
+	}
+	key = make([]byte, int(shared+suffixLen))
+	copy(key, prev[:shared])
+	if _, err = io.ReadFull(r, key[shared:]); err != nil {
+		return nil, 0, err
+	}
+	if prev != nil && bytes.Compare(prev, key) >= 0 {
+		return nil, 0, errors.New("The keys in the index snapshot are not sorted")
+	}
+	v, err = binary.ReadUvarint(r)
+	return key, v, err
+}
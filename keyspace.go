@@ -0,0 +1,271 @@
+package onvakv
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/coinexchain/onvakv/types"
+)
+
+const MaxKeySpaceNameLength = 64
+
+// The first byte of all the keys in KeySpaces. The plain keys can not start with it.
+const KeySpaceMark = byte(0xFE)
+
+// KeySpace is a named range of keys in OnvaKV. A key written through a KeySpace is stored
+// with the KeySpace's prefix, and the range is bounded by two guard entries of its own, so
+// the NextKey chain of a KeySpace starts and ends inside its range: an absence proof of one
+// KeySpace never involves the entries of other KeySpaces. All the KeySpaces share the entry
+// file and the Merkle tree with the plain keys.
+//
+// The prefix is KeySpaceMark+name+0x00, which is also the start guard, and the end guard is
+// KeySpaceMark+name+0x01. Since names only contain printable ASCII characters, the ranges of
+// KeySpaces do not overlap. And since the plain keys can not start with KeySpaceMark, they can
+// never get into a KeySpace or collide with its guards, whether it is registered or not.
+type KeySpace struct {
+	okv      *OnvaKV
+	name     string
+	prefix   []byte
+	endGuard []byte
+	created  int32 // 1 after we find the guard entries in okv
+}
+
+func checkKeySpaceName(name string) error {
+	if len(name) == 0 || len(name) > MaxKeySpaceNameLength {
+		return fmt.Errorf("Invalid length of KeySpace name: %d", len(name))
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 0x20 || name[i] > 0x7e {
+			return fmt.Errorf("Invalid character in KeySpace name: %#v", name)
+		}
+	}
+	return nil
+}
+
+// Get a KeySpace by name. If the KeySpace has not been created, use PrepareForCreation and
+// Create to create it.
+func (okv *OnvaKV) KeySpace(name string) (*KeySpace, error) {
+	if err := checkKeySpaceName(name); err != nil {
+		return nil, err
+	}
+	okv.keySpaceMtx.Lock()
+	defer okv.keySpaceMtx.Unlock()
+	if ks, ok := okv.keySpaces[name]; ok {
+		return ks, nil
+	}
+	ks := &KeySpace{
+		okv:      okv,
+		name:     name,
+		prefix:   keySpacePrefix(name),
+		endGuard: append(append([]byte{KeySpaceMark}, name...), 1),
+	}
+	if bytes.Compare(ks.prefix, okv.startKey) <= 0 || bytes.Compare(ks.endGuard, okv.endKey) >= 0 {
+		return nil, fmt.Errorf("KeySpace %s is not between the guard keys of OnvaKV", name)
+	}
+	if okv.keySpaces == nil {
+		okv.keySpaces = make(map[string]*KeySpace)
+	}
+	okv.keySpaces[name] = ks
+	return ks, nil
+}
+
+func keySpacePrefix(name string) []byte {
+	return append(append([]byte{KeySpaceMark}, name...), 0)
+}
+
+func isKeySpaceKey(key []byte) bool {
+	return len(key) != 0 && key[0] == KeySpaceMark
+}
+
+// Find a plain key starting with KeySpaceMark, which could be written before KeySpaceMark was
+// reserved, and can not be updated or deleted now. The KeySpaces are skipped over from their
+// start guards to their end guards, so only the guards are visited.
+func (okv *OnvaKV) findReservedPlainKey() []byte {
+	start := []byte{KeySpaceMark}
+	for {
+		iter := okv.idxTree.Iterator(start, []byte{KeySpaceMark + 1})
+		if !iter.Valid() {
+			iter.Close()
+			return nil
+		}
+		key := append([]byte{}, iter.Key()...)
+		iter.Close()
+		n := len(key)
+		if bytes.Equal(key, okv.startKey) || bytes.Equal(key, okv.endKey) {
+			start = append(key, 0)
+			continue
+		}
+		if n < 3 || key[n-1] != 0 || checkKeySpaceName(string(key[1:n-1])) != nil {
+			return key
+		}
+		endGuard := append(append([]byte{}, key[:n-1]...), 1)
+		if _, ok := okv.idxTree.Get(endGuard); !ok {
+			return key
+		}
+		start = append(endGuard, 0)
+	}
+}
+
+func (ks *KeySpace) Name() string {
+	return ks.name
+}
+
+func (ks *KeySpace) Prefix() []byte {
+	return append([]byte{}, ks.prefix...)
+}
+
+// Whether the guard entries exist. It must not be called between BeginWrite and EndWrite.
+func (ks *KeySpace) Exists() bool {
+	if atomic.LoadInt32(&ks.created) != 0 {
+		return true
+	}
+	_, okS := ks.okv.idxTree.Get(ks.prefix)
+	_, okE := ks.okv.idxTree.Get(ks.endGuard)
+	if okS && okE {
+		atomic.StoreInt32(&ks.created, 1)
+		return true
+	}
+	return false
+}
+
+// Creating a KeySpace follows the same phases as writing normal keys: call PrepareForCreation
+// before OnvaKV.BeginWrite, and call Create after it. The KeySpace can be used after EndWrite.
+func (ks *KeySpace) PrepareForCreation() {
+	if ks.Exists() {
+		panic(fmt.Sprintf("KeySpace %s already exists", ks.name))
+	}
+	ks.okv.prepareForUpdate(ks.prefix)
+	ks.okv.prepareForUpdate(ks.endGuard)
+}
+
+func (ks *KeySpace) Create() {
+	ks.okv.set(ks.prefix, []byte{})
+	ks.okv.set(ks.endGuard, []byte{})
+}
+
+func (ks *KeySpace) fullKey(key []byte) []byte {
+	res := make([]byte, len(ks.prefix)+len(key))
+	copy(res, ks.prefix)
+	copy(res[len(ks.prefix):], key)
+	return res
+}
+
+// Check whether key and value can be written to this KeySpace. When value is nil, only key is checked.
+// Like Exists, it must not be called between BeginWrite and EndWrite.
+func (ks *KeySpace) CheckKV(key, value []byte) error {
+	if !ks.Exists() {
+		return types.NewKVError(types.ErrNoKeySpace, []byte(ks.name), 0, 0)
+	}
+	return ks.checkSize(key, value)
+}
+
+func (ks *KeySpace) checkSize(key, value []byte) error {
+	if len(key) == 0 {
+		return types.NewKVError(types.ErrEmptyKey, key, 0, 0)
+	}
+	return ks.okv.limits.CheckKV(ks.fullKey(key), value)
+}
+
+// The following functions are the counterparts of OnvaKV's functions with the same names.
+// The keys passed to them and returned by them do not contain the prefix.
+
+func (ks *KeySpace) PrepareForUpdate(key []byte) {
+	if err := ks.CheckKV(key, nil); err != nil {
+		panic(err)
+	}
+	ks.okv.prepareForUpdate(ks.fullKey(key))
+}
+
+func (ks *KeySpace) PrepareForDeletion(key []byte) (findIt bool) {
+	if err := ks.CheckKV(key, nil); err != nil {
+		panic(err)
+	}
+	return ks.okv.prepareForDeletion(ks.fullKey(key))
+}
+
+// The existence of KeySpace has been checked by PrepareForUpdate
+func (ks *KeySpace) Set(key, value []byte) {
+	if err := ks.checkSize(key, value); err != nil {
+		panic(err)
+	}
+	ks.okv.set(ks.fullKey(key), value)
+}
+
+func (ks *KeySpace) Delete(key []byte) {
+	if err := ks.checkSize(key, nil); err != nil {
+		panic(err)
+	}
+	ks.okv.delete(ks.fullKey(key))
+}
+
+func (ks *KeySpace) GetEntry(key []byte) *Entry {
+	return ks.okv.GetEntry(ks.fullKey(key))
+}
+
+// nil start means the beginning of this KeySpace, and nil end means the end of it
+func (ks *KeySpace) Iterator(start, end []byte) dbm.Iterator {
+	s, e := ks.fullRange(start, end)
+	return &keySpaceIterator{Iterator: ks.okv.Iterator(s, e), prefixLen: len(ks.prefix), start: start, end: end}
+}
+
+func (ks *KeySpace) ReverseIterator(start, end []byte) dbm.Iterator {
+	s, e := ks.fullRange(start, end)
+	return &keySpaceIterator{Iterator: ks.okv.ReverseIterator(s, e), prefixLen: len(ks.prefix), start: start, end: end}
+}
+
+func (ks *KeySpace) fullRange(start, end []byte) ([]byte, []byte) {
+	s := append(ks.Prefix(), 0) // skip the start guard
+	if len(start) != 0 {
+		s = ks.fullKey(start)
+	}
+	e := ks.endGuard
+	if end != nil {
+		e = ks.fullKey(end)
+	}
+	return s, e
+}
+
+// Get the proof of key's existence or absence in this KeySpace
+func (ks *KeySpace) GetProof(key []byte) (*Proof, error) {
+	if len(key) == 0 {
+		return nil, types.NewKVError(types.ErrEmptyKey, key, 0, 0)
+	}
+	return ks.okv.GetProof(ks.fullKey(key))
+}
+
+// Like VerifyProof, but also checks the proof is generated by the KeySpace named name,
+// i.e., the proven entry is inside the KeySpace.
+func VerifyKeySpaceProof(name string, key []byte, proof *Proof, root []byte) (exists bool, value []byte, err error) {
+	if err = checkKeySpaceName(name); err != nil {
+		return
+	}
+	prefix := keySpacePrefix(name)
+	entry, exists, err := verifyProof(append(append([]byte{}, prefix...), key...), proof, root)
+	if err != nil {
+		return false, nil, err
+	}
+	if !bytes.HasPrefix(entry.Key, prefix) {
+		return false, nil, fmt.Errorf("The proven entry is not in KeySpace %s", name)
+	}
+	if !exists {
+		return false, nil, nil
+	}
+	return true, entry.Value, nil
+}
+
+type keySpaceIterator struct {
+	dbm.Iterator
+	prefixLen  int
+	start, end []byte
+}
+
+func (iter *keySpaceIterator) Domain() (start []byte, end []byte) {
+	return iter.start, iter.end
+}
+
+func (iter *keySpaceIterator) Key() []byte {
+	return iter.Iterator.Key()[iter.prefixLen:]
+}
@@ -0,0 +1,193 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	Disabled
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error", "disabled"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > Disabled {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return Disabled, fmt.Errorf("Unknown log level: %s", s)
+}
+
+// Logger records leveled events. Every event has a message and a list of
+// alternating keys and values, such as: Info("twig pruned", "start", 3, "end", 9)
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+	// With returns a child logger which adds keyvals to every event
+	With(keyvals ...interface{}) Logger
+	Enabled(level Level) bool
+}
+
+// ===========================================================================
+
+type NopLogger struct{}
+
+var _ Logger = NopLogger{}
+
+func (NopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (NopLogger) Info(msg string, keyvals ...interface{})  {}
+func (NopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (NopLogger) Error(msg string, keyvals ...interface{}) {}
+func (l NopLogger) With(keyvals ...interface{}) Logger     { return l }
+func (NopLogger) Enabled(level Level) bool                 { return false }
+
+// ===========================================================================
+
+// JSONLogger writes one JSON object per line, which is easy for log aggregators
+// to parse. Its level can be changed at runtime with SetLevel, and the change also
+// takes effect on the children created by With.
+type JSONLogger struct {
+	out    *syncWriter
+	level  *int32
+	prefix []byte // the encoded keyvals added by With
+}
+
+var _ Logger = (*JSONLogger)(nil)
+
+type syncWriter struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+func NewJSONLogger(w io.Writer, level Level) *JSONLogger {
+	lvl := int32(level)
+	return &JSONLogger{
+		out:   &syncWriter{w: w},
+		level: &lvl,
+	}
+}
+
+func (l *JSONLogger) SetLevel(level Level) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+func (l *JSONLogger) GetLevel() Level {
+	return Level(atomic.LoadInt32(l.level))
+}
+
+func (l *JSONLogger) Enabled(level Level) bool {
+	return level >= l.GetLevel() && level < Disabled
+}
+
+func (l *JSONLogger) With(keyvals ...interface{}) Logger {
+	var buf bytes.Buffer
+	buf.Write(l.prefix)
+	appendKeyvals(&buf, keyvals)
+	return &JSONLogger{out: l.out, level: l.level, prefix: buf.Bytes()}
+}
+
+func (l *JSONLogger) Debug(msg string, keyvals ...interface{}) { l.log(DebugLevel, msg, keyvals) }
+func (l *JSONLogger) Info(msg string, keyvals ...interface{})  { l.log(InfoLevel, msg, keyvals) }
+func (l *JSONLogger) Warn(msg string, keyvals ...interface{})  { l.log(WarnLevel, msg, keyvals) }
+func (l *JSONLogger) Error(msg string, keyvals ...interface{}) { l.log(ErrorLevel, msg, keyvals) }
+
+func (l *JSONLogger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"ts":`)
+	writeJSON(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, msg)
+	buf.Write(l.prefix)
+	appendKeyvals(&buf, keyvals)
+	buf.WriteString("}\n")
+	l.out.mtx.Lock()
+	defer l.out.mtx.Unlock()
+	l.out.w.Write(buf.Bytes()) //nolint
+}
+
+func appendKeyvals(buf *bytes.Buffer, keyvals []interface{}) {
+	if len(keyvals)%2 != 0 {
+		keyvals = append(keyvals, "(MISSING)")
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		buf.WriteByte(',')
+		writeJSON(buf, fmt.Sprint(keyvals[i]))
+		buf.WriteByte(':')
+		writeJSON(buf, keyvals[i+1])
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	switch x := v.(type) {
+	case error:
+		v = x.Error()
+	case []byte:
+		v = fmt.Sprintf("%X", x)
+	case fmt.Stringer:
+		v = x.String()
+	}
+	bz, err := json.Marshal(v)
+	if err != nil {
+		bz, _ = json.Marshal(fmt.Sprintf("%+v", v))
+	}
+	buf.Write(bz)
+}
+
+// ===========================================================================
+
+var defaultLogger atomic.Value
+
+func init() {
+	defaultLogger.Store(loggerHolder{NopLogger{}})
+}
+
+// atomic.Value requires all the stored values to have the same concrete type
+type loggerHolder struct {
+	l Logger
+}
+
+// SetDefault changes the logger which is used by the objects created afterwards.
+// Objects created earlier can be changed with their own SetLogger methods.
+func SetDefault(l Logger) {
+	defaultLogger.Store(loggerHolder{OrNop(l)})
+}
+
+func Default() Logger {
+	return defaultLogger.Load().(loggerHolder).l
+}
+
+// OrNop returns NopLogger when l is nil
+func OrNop(l Logger) Logger {
+	if l == nil {
+		return NopLogger{}
+	}
+	return l
+}
@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var res []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		m := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal([]byte(line), &m))
+		res = append(res, m)
+	}
+	return res
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewJSONLogger(&buf, InfoLevel)
+	child := l.With("module", "datatree")
+	child.Debug("hidden", "a", 1)
+	child.Info("prune twigs", "startID", 3, "endID", 9)
+	l.Warn("odd", "bz", []byte{0xAB}, "err", errors.New("boom"), "lonely")
+
+	lines := decodeLines(t, &buf)
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, "info", lines[0]["level"])
+	assert.Equal(t, "prune twigs", lines[0]["msg"])
+	assert.Equal(t, "datatree", lines[0]["module"])
+	assert.Equal(t, 3.0, lines[0]["startID"])
+	assert.Equal(t, 9.0, lines[0]["endID"])
+	assert.Equal(t, "warn", lines[1]["level"])
+	assert.Equal(t, "AB", lines[1]["bz"])
+	assert.Equal(t, "boom", lines[1]["err"])
+	assert.Equal(t, "(MISSING)", lines[1]["lonely"])
+	_, ok := lines[1]["module"]
+	assert.False(t, ok)
+
+	// the level is shared by the children
+	buf.Reset()
+	l.SetLevel(DebugLevel)
+	assert.True(t, child.Enabled(DebugLevel))
+	child.Debug("shown")
+	lines = decodeLines(t, &buf)
+	assert.Equal(t, 1, len(lines))
+	assert.Equal(t, "debug", lines[0]["level"])
+
+	buf.Reset()
+	l.SetLevel(Disabled)
+	child.Error("dropped")
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestParseLevel(t *testing.T) {
+	lvl, err := ParseLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, WarnLevel, lvl)
+	_, err = ParseLevel("verbose")
+	assert.NotNil(t, err)
+	assert.Equal(t, "level(9)", Level(9).String())
+}
+
+func TestDefault(t *testing.T) {
+	assert.Equal(t, NopLogger{}, Default())
+	var buf bytes.Buffer
+	SetDefault(NewJSONLogger(&buf, DebugLevel))
+	Default().Info("hello")
+	assert.Equal(t, 1, len(decodeLines(t, &buf)))
+	SetDefault(nil)
+	assert.Equal(t, NopLogger{}, Default())
+	assert.Equal(t, NopLogger{}, OrNop(nil))
+}
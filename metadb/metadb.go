@@ -1,11 +1,11 @@
 package metadb
 
 import (
-	"fmt"
 	"encoding/binary"
 
 	"github.com/coinexchain/onvakv/indextree"
 	"github.com/coinexchain/onvakv/datatree"
+	"github.com/coinexchain/onvakv/logging"
 	"github.com/coinexchain/onvakv/types"
 )
 
@@ -30,12 +30,20 @@ type MetaDBWithTMDB struct {
 	maxSerialNum       int64
 	oldestActiveTwigID int64
 	//activeEntryCount   int64
+
+	logger logging.Logger
 }
 
 var _ types.MetaDB = (*MetaDBWithTMDB)(nil)
 
 func NewMetaDB(kvdb *indextree.RocksDB) *MetaDBWithTMDB {
-	return &MetaDBWithTMDB{kvdb: kvdb}
+	db := &MetaDBWithTMDB{kvdb: kvdb}
+	db.SetLogger(logging.Default())
+	return db
+}
+
+func (db *MetaDBWithTMDB) SetLogger(logger logging.Logger) {
+	db.logger = logging.OrNop(logger).With("module", "metadb")
 }
 
 func (db *MetaDBWithTMDB) Close() {
@@ -227,12 +235,13 @@ func (db *MetaDBWithTMDB) Init() {
 }
 
 func (db *MetaDBWithTMDB) PrintInfo() {
-	fmt.Printf("CurrHeight         %v\n", db.GetCurrHeight())
-	fmt.Printf("TwigMtFileSize     %v\n", db.GetTwigMtFileSize())
-	fmt.Printf("EntryFileSize      %v\n", db.GetEntryFileSize())
-	fmt.Printf("LastPrunedTwig     %v\n", db.GetLastPrunedTwig())
-	fmt.Printf("EdgeNodes          %v\n", db.GetEdgeNodes())
-	fmt.Printf("MaxSerialNum       %v\n", db.GetMaxSerialNum())
-	fmt.Printf("OldestActiveTwigID %v\n", db.GetOldestActiveTwigID())
-	fmt.Printf("IsRunning          %v\n", db.GetIsRunning())
+	db.logger.Info("meta info",
+		"CurrHeight", db.GetCurrHeight(),
+		"TwigMtFileSize", db.GetTwigMtFileSize(),
+		"EntryFileSize", db.GetEntryFileSize(),
+		"LastPrunedTwig", db.GetLastPrunedTwig(),
+		"EdgeNodes", db.GetEdgeNodes(),
+		"MaxSerialNum", db.GetMaxSerialNum(),
+		"OldestActiveTwigID", db.GetOldestActiveTwigID(),
+		"IsRunning", db.GetIsRunning())
 }
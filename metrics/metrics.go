@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// The names of the metrics reported by OnvaKV and its sub-systems. They follow
+// Prometheus' naming conventions, so an adapter can register them directly.
+const (
+	BlockUpdateSeconds      = "onvakv_block_update_seconds"   // phase 1&2: sort the hot entries and append them
+	BlockReapSeconds        = "onvakv_block_reap_seconds"     // phase 3: reap the oldest active twigs
+	BlockEndSeconds         = "onvakv_block_end_seconds"      // phase 4: sync up the merkle tree
+	CompactionBytes         = "onvakv_compaction_bytes_total" // bytes re-appended when reaping old twigs
+	EntriesAppended         = "onvakv_entries_appended_total"
+	EntriesDeactivated      = "onvakv_entries_deactivated_total"
+	TwigsEvicted            = "onvakv_twigs_evicted_total"
+	TwigsPruned             = "onvakv_twigs_pruned_total"
+	EntryFileSize           = "onvakv_entry_file_size_bytes"
+	TwigMtFileSize          = "onvakv_twigmt_file_size_bytes"
+	HPFileAppendedBytes     = "onvakv_hpfile_appended_bytes_total"
+	HPFilePreReadHits       = "onvakv_hpfile_preread_hits_total"
+	HPFilePreReadMisses     = "onvakv_hpfile_preread_misses_total"
+	IndexTreeSize           = "onvakv_index_btree_size"
+	RootStoreCacheHits      = "onvakv_rootstore_cache_hits_total"
+	RootStoreCacheMisses    = "onvakv_rootstore_cache_misses_total"
+	RootStoreCacheEvictions = "onvakv_rootstore_cache_evictions_total"
+	RootStoreCacheBytes     = "onvakv_rootstore_cache_bytes"
+	TrunkWriteBackSecs      = "onvakv_trunk_writeback_seconds"
+)
+
+// The names of the labels
+const (
+	LabelFile = "file" // which HPFile reports the HPFile* metrics, "entries" or "twigmt"
+)
+
+type Counter interface {
+	Add(delta float64)
+}
+
+type Gauge interface {
+	Set(value float64)
+}
+
+type Histogram interface {
+	Observe(value float64)
+}
+
+// Registry creates the instruments which the sub-systems report to. The labels are
+// given as name/value pairs, such as (LabelFile, "entries"), and a metric is always
+// requested with the same label names in the same order. The same name may be
+// requested more than once (e.g. by the entry file and the twig file, with different
+// label values), so implementations must return a usable instrument for it.
+// A Prometheus adapter can implement Registry with CounterVec/GaugeVec/HistogramVec,
+// which are created with the even elements of labels and then picked with the odd ones.
+type Registry interface {
+	NewCounter(name string, labels ...string) Counter
+	NewGauge(name string, labels ...string) Gauge
+	NewHistogram(name string, labels ...string) Histogram
+}
+
+// ===========================================================================
+
+type nopInstrument struct{}
+
+func (nopInstrument) Add(delta float64)     {}
+func (nopInstrument) Set(value float64)     {}
+func (nopInstrument) Observe(value float64) {}
+
+// NopRegistry discards everything. It is the default registry of all sub-systems.
+type NopRegistry struct{}
+
+var _ Registry = NopRegistry{}
+
+func (NopRegistry) NewCounter(name string, labels ...string) Counter     { return nopInstrument{} }
+func (NopRegistry) NewGauge(name string, labels ...string) Gauge         { return nopInstrument{} }
+func (NopRegistry) NewHistogram(name string, labels ...string) Histogram { return nopInstrument{} }
+
+// OrNop returns NopRegistry when reg is nil
+func OrNop(reg Registry) Registry {
+	if reg == nil {
+		return NopRegistry{}
+	}
+	return reg
+}
+
+// ===========================================================================
+
+// MemRegistry keeps the values in memory. It is useful for unit tests and for
+// exposing the metrics through a debug endpoint.
+type MemRegistry struct {
+	mtx    sync.Mutex
+	values map[string]*memValue
+}
+
+var _ Registry = (*MemRegistry)(nil)
+
+func NewMemRegistry() *MemRegistry {
+	return &MemRegistry{values: make(map[string]*memValue)}
+}
+
+// memValue stores a float64's bits in an uint64 so that it can be updated atomically
+type memValue struct {
+	bits  uint64
+	count int64
+}
+
+func (v *memValue) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		nw := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, nw) {
+			break
+		}
+	}
+	atomic.AddInt64(&v.count, 1)
+}
+
+func (v *memValue) Set(value float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(value))
+	atomic.AddInt64(&v.count, 1)
+}
+
+// For histograms we only keep the sum and the count of observations
+func (v *memValue) Observe(value float64) {
+	v.Add(value)
+}
+
+func fullName(name string, labels []string) string {
+	if len(labels)%2 != 0 {
+		panic("The labels are not name/value pairs")
+	}
+	for i := 0; i < len(labels); i += 2 {
+		name += "/" + labels[i] + "=" + labels[i+1]
+	}
+	return name
+}
+
+func (reg *MemRegistry) get(name string, labels []string) *memValue {
+	reg.mtx.Lock()
+	defer reg.mtx.Unlock()
+	name = fullName(name, labels)
+	v, ok := reg.values[name]
+	if !ok {
+		v = &memValue{}
+		reg.values[name] = v
+	}
+	return v
+}
+
+func (reg *MemRegistry) NewCounter(name string, labels ...string) Counter {
+	return reg.get(name, labels)
+}
+
+func (reg *MemRegistry) NewGauge(name string, labels ...string) Gauge {
+	return reg.get(name, labels)
+}
+
+func (reg *MemRegistry) NewHistogram(name string, labels ...string) Histogram {
+	return reg.get(name, labels)
+}
+
+// Value returns the current value (for counters and gauges) or the sum of all the
+// observations (for histograms). Each label pair is joined to name as '/name=value'.
+func (reg *MemRegistry) Value(name string, labels ...string) float64 {
+	return math.Float64frombits(atomic.LoadUint64(&reg.get(name, labels).bits))
+}
+
+// Count returns how many times the instrument was updated
+func (reg *MemRegistry) Count(name string, labels ...string) int64 {
+	return atomic.LoadInt64(&reg.get(name, labels).count)
+}
+
+// Names returns the sorted names of all the instruments, with labels joined
+func (reg *MemRegistry) Names() []string {
+	reg.mtx.Lock()
+	defer reg.mtx.Unlock()
+	res := make([]string, 0, len(reg.values))
+	for name := range reg.values {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemRegistry(t *testing.T) {
+	reg := NewMemRegistry()
+	c := reg.NewCounter(EntriesAppended)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			for j := 0; j < 1000; j++ {
+				c.Add(1)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, float64(8000), reg.Value(EntriesAppended))
+	assert.Equal(t, int64(8000), reg.Count(EntriesAppended))
+
+	// the same name returns the same instrument
+	reg.NewCounter(EntriesAppended).Add(0.5)
+	assert.Equal(t, 8000.5, reg.Value(EntriesAppended))
+
+	g := reg.NewGauge(HPFileAppendedBytes, LabelFile, "entries")
+	g.Set(10)
+	g.Set(20)
+	assert.Equal(t, float64(20), reg.Value(HPFileAppendedBytes, LabelFile, "entries"))
+	assert.Equal(t, float64(0), reg.Value(HPFileAppendedBytes, LabelFile, "twigmt"))
+	assert.Panics(t, func() { reg.NewGauge(HPFileAppendedBytes, "entries") })
+
+	h := reg.NewHistogram(BlockEndSeconds)
+	h.Observe(1.5)
+	h.Observe(2.5)
+	assert.Equal(t, float64(4), reg.Value(BlockEndSeconds))
+	assert.Equal(t, int64(2), reg.Count(BlockEndSeconds))
+
+	assert.Equal(t, []string{BlockEndSeconds, EntriesAppended,
+		HPFileAppendedBytes + "/file=entries", HPFileAppendedBytes + "/file=twigmt"}, reg.Names())
+}
+
+func TestNopRegistry(t *testing.T) {
+	reg := OrNop(nil)
+	reg.NewCounter(EntriesAppended).Add(1)
+	reg.NewGauge(EntryFileSize).Set(1)
+	reg.NewHistogram(BlockEndSeconds).Observe(1)
+	assert.Equal(t, NopRegistry{}, reg)
+}
@@ -2,20 +2,25 @@ package onvakv
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"math"
 	"runtime"
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	dbm "github.com/tendermint/tm-db"
 	"github.com/dterei/gotsc"
 
 	"github.com/coinexchain/onvakv/datatree"
 	"github.com/coinexchain/onvakv/indextree"
+	"github.com/coinexchain/onvakv/logging"
 	"github.com/coinexchain/onvakv/metadb"
+	"github.com/coinexchain/onvakv/metrics"
 	"github.com/coinexchain/onvakv/types"
 )
 
@@ -26,6 +31,10 @@ const (
 
 	heMapSize = 128
 	nkMapSize = 64
+
+	rebuildLogInterval = 1024*1024 // log the progress of index rebuilding after so many entries
+
+	indexSnapshotName = "index.snapshot" // the snapshot of indextree's B-Tree taken by Close
 )
 
 type OnvaKV struct {
@@ -40,10 +49,28 @@ type OnvaKV struct {
 	cachedEntries []*HotEntry
 	startKey      []byte
 	endKey        []byte
+	dirName       string // empty for the mock
+	encrypted     bool   // the data tree is encrypted, so the index snapshot of plaintext keys is not taken
+
+	updateTime      metrics.Histogram
+	reapTime        metrics.Histogram
+	endBlockTime    metrics.Histogram
+	compactionBytes metrics.Counter
+	logger          logging.Logger
+
+	limits types.KVLimits
+
+	keySpaceMtx sync.RWMutex
+	keySpaces   map[string]*KeySpace
+
+	rangeMtx       sync.Mutex
+	preparedRanges map[[2]string]*keyRange
+	deletedRanges  []*keyRange // the ranges deleted in the current block
 }
 
 func NewOnvaKV4Mock(startEndKeys [][]byte) *OnvaKV {
-	okv := &OnvaKV{k2heMap: NewBucketMap(heMapSize), k2nkMap: NewBucketMap(nkMapSize)}
+	okv := &OnvaKV{k2heMap: NewBucketMap(heMapSize), k2nkMap: NewBucketMap(nkMapSize), limits: types.DefaultKVLimits}
+	okv.logger = logging.Default().With("module", "onvakv")
 
 	okv.datTree = datatree.NewMockDataTree()
 	okv.idxTree = indextree.NewMockIndexTree()
@@ -57,10 +84,27 @@ func NewOnvaKV4Mock(startEndKeys [][]byte) *OnvaKV {
 	okv.meta = metadb.NewMetaDB(okv.rocksdb)
 	okv.rocksdb.OpenNewBatch()
 	okv.InitGuards(startEndKeys[0], startEndKeys[1])
+	okv.SetMetrics(nil)
+	okv.SetLogger(logging.Default())
 	return okv
 }
 
 func NewOnvaKV(dirName string, canQueryHistory bool, startEndKeys [][]byte) (*OnvaKV, error) {
+	return NewOnvaKVCtx(context.Background(), dirName, canQueryHistory, startEndKeys, nil)
+}
+
+// Like NewOnvaKV, but the recovery of data tree and the rebuilding of index tree can be aborted
+// by cancelling ctx. In that case, all the opened files are closed and ctx.Err() is returned.
+// When repFn is not nil, it is called with each key added to the index tree during rebuilding,
+// to report the progress.
+func NewOnvaKVCtx(ctx context.Context, dirName string, canQueryHistory bool, startEndKeys [][]byte,
+	repFn func([]byte)) (*OnvaKV, error) {
+	return NewOnvaKVWithOptions(ctx, dirName, canQueryHistory, startEndKeys, repFn, datatree.HPFileOptions{})
+}
+
+// Like NewOnvaKVCtx, but the files of the data tree are opened with opts
+func NewOnvaKVWithOptions(ctx context.Context, dirName string, canQueryHistory bool, startEndKeys [][]byte,
+	repFn func([]byte), opts datatree.HPFileOptions) (*OnvaKV, error) {
 	tscOverhead = gotsc.TSCOverhead()
 	_, err := os.Stat(dirName)
 	dirNotExists := os.IsNotExist(err)
@@ -68,6 +112,12 @@ func NewOnvaKV(dirName string, canQueryHistory bool, startEndKeys [][]byte) (*On
 		k2heMap:      NewBucketMap(heMapSize),
 		k2nkMap:      NewBucketMap(nkMapSize),
 		cachedEntries: make([]*HotEntry, 0, 2000),
+		logger:       logging.Default().With("module", "onvakv"),
+		limits:       types.DefaultKVLimits,
+		startKey:     append([]byte{}, startEndKeys[0]...),
+		endKey:       append([]byte{}, startEndKeys[1]...),
+		dirName:      dirName,
+		encrypted:    opts.Encryption != nil,
 	}
 	for i := range okv.tempEntries64 {
 		okv.tempEntries64[i] = make([]*HotEntry, 0, len(okv.cachedEntries)/8)
@@ -87,7 +137,8 @@ func NewOnvaKV(dirName string, canQueryHistory bool, startEndKeys [][]byte) (*On
 	}
 
 	if dirNotExists { // Create a new database in this dir
-		okv.datTree = datatree.NewEmptyTree(datatree.BufferSize, defaultFileSize, dirName)
+		okv.logger.Info("create new database")
+		okv.datTree = datatree.NewEmptyTreeWithOptions(datatree.BufferSize, defaultFileSize, dirName, opts)
 		if canQueryHistory {
 			okv.idxTree = indextree.NewNVTreeMem(okv.rocksdb)
 		} else {
@@ -109,41 +160,205 @@ func NewOnvaKV(dirName string, canQueryHistory bool, startEndKeys [][]byte) (*On
 		youngestTwigID := okv.meta.GetMaxSerialNum() >> datatree.TwigShift
 		bz := okv.meta.GetEdgeNodes()
 		edgeNodes := datatree.BytesToEdgeNodes(bz)
-		okv.datTree = datatree.RecoverTree(datatree.BufferSize, defaultFileSize, dirName, edgeNodes,
-			okv.meta.GetLastPrunedTwig(), oldestActiveTwigID, youngestTwigID)
+		okv.logger.Warn("not closed properly, recover the data tree",
+			"oldestActiveTwigID", oldestActiveTwigID, "youngestTwigID", youngestTwigID)
+		datTree, err := datatree.RecoverTreeWithOptions(ctx, datatree.BufferSize, defaultFileSize, dirName, edgeNodes,
+			okv.meta.GetLastPrunedTwig(), oldestActiveTwigID, youngestTwigID, opts)
+		if err != nil {
+			okv.abortOpening(err)
+			return nil, err
+		}
+		okv.datTree = datTree
 	} else { // OnvaKV is closed properly
-		okv.datTree = datatree.LoadTree(datatree.BufferSize, defaultFileSize, dirName)
+		okv.logger.Info("closed properly, load the data tree")
+		okv.datTree = datatree.LoadTreeWithOptions(datatree.BufferSize, defaultFileSize, dirName, opts)
 	}
 
+	var historyDB *indextree.RocksDB
+	if canQueryHistory {
+		historyDB = okv.rocksdb
+	}
 	if dirNotExists {
 		//do nothing
+	} else if okv.loadIndexSnapshot(historyDB, repFn) {
+		//the B-Tree is loaded from the snapshot
 	} else if canQueryHistory { // use rocksdb to keep the historical index
+		okv.logger.Info("rebuild the index from rocksdb")
 		okv.idxTree = indextree.NewNVTreeMem(okv.rocksdb)
-		err = okv.idxTree.Init(nil)
+		err = okv.idxTree.InitCtx(ctx, repFn)
 		if err != nil {
+			okv.abortOpening(err)
 			return nil, err
 		}
 	} else { // only latest index, no historical index at all
-		okv.idxTree = indextree.NewNVTreeMem(nil)
+		idxTree := indextree.NewNVTreeMem(nil)
+		okv.idxTree = idxTree
 		oldestActiveTwigID := okv.meta.GetOldestActiveTwigID()
-		okv.idxTree.BeginWrite(0) // we set height=0 here, which will not be used 
-		keyAndPosChan := make(chan types.KeyAndPos, 100)
-		go okv.datTree.ScanEntriesLite(oldestActiveTwigID, keyAndPosChan)
-		for e := range keyAndPosChan {
-			okv.idxTree.Set(e.Key, uint64(e.Pos))
+		workers := runtime.NumCPU()
+		okv.logger.Info("rebuild the index by scanning entries", "oldestActiveTwigID", oldestActiveTwigID,
+			"workers", workers)
+		runs, err := okv.datTree.ScanSortedRunsCtx(ctx, oldestActiveTwigID, workers)
+		if err != nil {
+			okv.abortOpening(err)
+			return nil, err
+		}
+		// the runs are merged and loaded into the B-tree in the order of keys
+		count := 0
+		idxTree.LoadSorted(func() ([]byte, uint64, bool) {
+			e, ok := runs.Next()
+			if !ok {
+				return nil, 0, false
+			}
+			if repFn != nil {
+				repFn(e.Key)
+			}
+			count++
+			if count%rebuildLogInterval == 0 {
+				okv.logger.Info("rebuilding the index", "keys", count)
+			}
+			return e.Key, uint64(e.Pos), true
+		})
+		runs.Close()
+	}
+
+	if !dirNotExists { // the plain keys starting with KeySpaceMark are allowed by older versions
+		if key := okv.findReservedPlainKey(); key != nil {
+			err = fmt.Errorf("The database was written before KeySpaceMark was reserved, and it must be migrated: %w",
+				types.NewKVError(types.ErrKeySpaceKey, key, 0, 0))
+			okv.abortOpening(err)
+			return nil, err
 		}
-		okv.idxTree.EndWrite()
 	}
 
 	okv.meta.SetIsRunning(true)
+	okv.SetMetrics(nil)
+	okv.SetLogger(logging.Default())
+	okv.logger.Info("database opened", "height", okv.meta.GetCurrHeight(), "activeCount", okv.idxTree.ActiveCount())
 	return okv, nil
 }
 
+// Close the sub-systems opened by NewOnvaKVCtx, leaving IsRunning unchanged on disk
+func (okv *OnvaKV) abortOpening(err error) {
+	okv.logger.Warn("opening aborted", "err", err)
+	if okv.idxTree != nil {
+		okv.idxTree.Close()
+	}
+	okv.rocksdb.Close()
+	if okv.datTree != nil {
+		okv.datTree.Close()
+	}
+	okv.meta.Close()
+}
+
+// Let OnvaKV and its sub-systems report to reg. A nil reg disables the reporting.
+func (okv *OnvaKV) SetMetrics(reg metrics.Registry) {
+	reg = metrics.OrNop(reg)
+	okv.updateTime = reg.NewHistogram(metrics.BlockUpdateSeconds)
+	okv.reapTime = reg.NewHistogram(metrics.BlockReapSeconds)
+	okv.endBlockTime = reg.NewHistogram(metrics.BlockEndSeconds)
+	okv.compactionBytes = reg.NewCounter(metrics.CompactionBytes)
+	okv.idxTree.SetMetrics(reg)
+	okv.datTree.SetMetrics(reg)
+}
+
+// Let OnvaKV and its sub-systems write their events to logger. A nil logger disables the logging.
+func (okv *OnvaKV) SetLogger(logger logging.Logger) {
+	logger = logging.OrNop(logger)
+	okv.logger = logger.With("module", "onvakv")
+	okv.meta.SetLogger(logger)
+	okv.idxTree.SetLogger(logger)
+	okv.datTree.SetLogger(logger)
+	okv.rocksdb.SetLogger(logger)
+}
+
+// Change the maximum sizes of keys and values. The limits are rejected if an entry within
+// them may exceed datatree.MaxEntryBytes after serialization.
+func (okv *OnvaKV) SetLimits(limits types.KVLimits) error {
+	if limits.MaxKeyLength <= 0 || limits.MaxKeyLength > indextree.MaxKeyLength {
+		return fmt.Errorf("Invalid MaxKeyLength %d", limits.MaxKeyLength)
+	}
+	if limits.MaxValueLength < 0 {
+		return fmt.Errorf("Invalid MaxValueLength %d", limits.MaxValueLength)
+	}
+	// an entry contains the key, the value and the next key
+	if datatree.WorstCaseEntryLength(2*limits.MaxKeyLength+limits.MaxValueLength) >= datatree.MaxEntryBytes {
+		return fmt.Errorf("Entries may be too large with MaxKeyLength %d MaxValueLength %d",
+			limits.MaxKeyLength, limits.MaxValueLength)
+	}
+	okv.limits = limits
+	return nil
+}
+
+// Change the format of the entries written afterwards. All the nodes of a chain must use the
+// same format, because the entries' hashes cover their serialized bytes.
+func (okv *OnvaKV) SetEntryFormat(format types.EntryFormat) {
+	okv.datTree.SetEntryFormat(format)
+}
+
+func (okv *OnvaKV) GetLimits() types.KVLimits {
+	return okv.limits
+}
+
+// Check whether key and value can be written. The key must be between the two guard keys,
+// within the size limit and not start with KeySpaceMark. When value is nil, only key is checked.
+func (okv *OnvaKV) CheckKV(key, value []byte) error {
+	if err := okv.limits.CheckKV(key, value); err != nil {
+		return err
+	}
+	if bytes.Equal(key, okv.startKey) || bytes.Equal(key, okv.endKey) {
+		return types.NewKVError(types.ErrGuardKey, key, 0, 0)
+	}
+	if bytes.Compare(key, okv.startKey) < 0 || bytes.Compare(key, okv.endKey) > 0 {
+		return types.NewKVError(types.ErrKeyOutOfRange, key, 0, 0)
+	}
+	if isKeySpaceKey(key) {
+		return types.NewKVError(types.ErrKeySpaceKey, key, 0, 0)
+	}
+	return nil
+}
+
 func (okv *OnvaKV) PrintMetaInfo() {
 	okv.meta.PrintInfo()
 }
 
+// Load indextree's B-Tree from the snapshot taken by Close, and return whether it succeeds.
+// The snapshot is removed anyway, because it is stale once a new block is committed.
+func (okv *OnvaKV) loadIndexSnapshot(rocksdb *indextree.RocksDB, repFn func([]byte)) bool {
+	fname := filepath.Join(okv.dirName, indexSnapshotName)
+	defer os.Remove(fname)
+	if okv.meta.GetIsRunning() { // not closed properly, so the snapshot is not taken
+		return false
+	}
+	idxTree := indextree.NewNVTreeMem(rocksdb)
+	err := idxTree.LoadSnapshot(fname, okv.meta.GetCurrHeight(), repFn)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			okv.logger.Warn("can not load the index snapshot", "err", err)
+		}
+		idxTree.Close()
+		return false
+	}
+	okv.logger.Info("load the index from the snapshot", "height", okv.meta.GetCurrHeight())
+	okv.idxTree = idxTree
+	return true
+}
+
+// Take a snapshot of indextree's B-Tree, so the next NewOnvaKV need not rebuild it. The snapshot
+// holds the keys in plaintext, so it is not taken when the data tree is encrypted.
+func (okv *OnvaKV) saveIndexSnapshot() {
+	idxTree, ok := okv.idxTree.(*indextree.NVTreeMem)
+	if okv.dirName == "" || okv.encrypted || !ok {
+		return
+	}
+	fname := filepath.Join(okv.dirName, indexSnapshotName)
+	err := idxTree.SaveSnapshot(fname, okv.meta.GetCurrHeight())
+	if err != nil {
+		okv.logger.Warn("can not save the index snapshot", "err", err)
+	}
+}
+
 func (okv *OnvaKV) Close() {
+	okv.saveIndexSnapshot()
 	okv.meta.SetIsRunning(false)
 	okv.idxTree.Close()
 	okv.rocksdb.Close()
@@ -185,13 +400,61 @@ func isModified(hotEntry *HotEntry) bool {
 	return hotEntry.Operation == types.OpInsertOrChange && hotEntry.EntryPtr.SerialNum >= 0
 }
 
+// PrepareForUpdate, PrepareForDeletion, Set and Delete panic with *types.KVError on invalid input,
+// before anything is changed. Their Try* counterparts return the error instead.
 func (okv *OnvaKV) PrepareForUpdate(k []byte) {
-	//fmt.Printf("In PrepareForUpdate we see: %s\n", string(k))
+	if err := okv.TryPrepareForUpdate(k); err != nil {
+		panic(err)
+	}
+}
+
+func (okv *OnvaKV) TryPrepareForUpdate(k []byte) error {
+	if err := okv.CheckKV(k, nil); err != nil {
+		return err
+	}
+	okv.prepareForUpdate(k)
+	return nil
+}
+
+// PrepareForUpdates works like calling PrepareForUpdate for each key, but the entries of the
+// existing keys are read at once with ReadEntries.
+func (okv *OnvaKV) PrepareForUpdates(keys [][]byte) {
+	if err := okv.TryPrepareForUpdates(keys); err != nil {
+		panic(err)
+	}
+}
+
+// Nothing is prepared if any of the keys is invalid
+func (okv *OnvaKV) TryPrepareForUpdates(keys [][]byte) error {
+	for _, k := range keys {
+		if err := okv.CheckKV(k, nil); err != nil {
+			return err
+		}
+	}
+	var positions []int64
+	var foundKeys [][]byte
+	for _, k := range keys {
+		pos, findIt := okv.idxTree.Get(k)
+		if findIt {
+			positions = append(positions, int64(pos))
+			foundKeys = append(foundKeys, k)
+		} else {
+			okv.prepareForUpdate(k)
+		}
+	}
+	for i, entry := range okv.datTree.ReadEntries(positions) {
+		okv.k2heMap.Store(string(foundKeys[i]), &HotEntry{
+			EntryPtr:  entry,
+			Operation: types.OpNone,
+		})
+	}
+	return nil
+}
+
+func (okv *OnvaKV) prepareForUpdate(k []byte) {
 	pos, findIt := okv.idxTree.Get(k)
 	if findIt { // The case of Change
-		//fmt.Printf("In PrepareForUpdate we update\n")
 		entry := okv.datTree.ReadEntry(int64(pos))
-		//fmt.Printf("Now we add entry to k2e(findIt): %s(%#v)\n", string(k), k)
 		okv.k2heMap.Store(string(k), &HotEntry{
 			EntryPtr:  entry,
 			Operation: types.OpNone,
@@ -201,7 +464,6 @@ func (okv *OnvaKV) PrepareForUpdate(k []byte) {
 	prevEntry := okv.getPrevEntry(k)
 
 	// The case of Insert
-	//fmt.Printf("Now we add entry to k2e(not-findIt): %s(%#v)\n", string(k), k)
 	okv.k2heMap.Store(string(k), &HotEntry{
 		EntryPtr: &Entry{
 			Key:        append([]byte{}, k...),
@@ -214,9 +476,6 @@ func (okv *OnvaKV) PrepareForUpdate(k []byte) {
 		Operation: types.OpNone,
 	})
 
-	//fmt.Printf("In PrepareForUpdate we insert\n")
-	//fmt.Printf("prevEntry(%#v): %#v\n", k, prevEntry)
-	//fmt.Printf("Now we add entry to k2e(prevEntry.Key): %s(%#v)\n", kStr, prevEntry.Key)
 	okv.k2heMap.Store(string(prevEntry.Key), &HotEntry{
 		EntryPtr:  prevEntry,
 		Operation: types.OpNone,
@@ -226,7 +485,21 @@ func (okv *OnvaKV) PrepareForUpdate(k []byte) {
 }
 
 func (okv *OnvaKV) PrepareForDeletion(k []byte) (findIt bool) {
-	//fmt.Printf("In PrepareForDeletion we see: %#v\n", k)
+	findIt, err := okv.TryPrepareForDeletion(k)
+	if err != nil {
+		panic(err)
+	}
+	return findIt
+}
+
+func (okv *OnvaKV) TryPrepareForDeletion(k []byte) (findIt bool, err error) {
+	if err = okv.CheckKV(k, nil); err != nil {
+		return
+	}
+	return okv.prepareForDeletion(k), nil
+}
+
+func (okv *OnvaKV) prepareForDeletion(k []byte) (findIt bool) {
 	pos, findIt := okv.idxTree.Get(k)
 	if !findIt {
 		return
@@ -235,7 +508,6 @@ func (okv *OnvaKV) PrepareForDeletion(k []byte) (findIt bool) {
 	entry := okv.datTree.ReadEntry(int64(pos))
 	prevEntry := okv.getPrevEntry(k)
 
-	//fmt.Printf("In PrepareForDeletion we read: %#v\n", entry)
 	okv.k2heMap.Store(string(entry.Key), &HotEntry{
 		EntryPtr:  entry,
 		Operation: types.OpNone,
@@ -275,7 +547,6 @@ func (okv *OnvaKV) getPrevEntry(k []byte) *Entry {
 		panic(fmt.Sprintf("The iterator is invalid! Missing a guard node? k=%#v", k))
 	}
 	pos := iter.Value()
-	//fmt.Printf("In getPrevEntry: %#v %d\n", iter.Key(), iter.Value())
 	return okv.datTree.ReadEntry(int64(pos))
 }
 
@@ -300,6 +571,20 @@ func (okv *OnvaKV) BeginWrite(height int64) {
 }
 
 func (okv *OnvaKV) Set(key, value []byte) {
+	if err := okv.TrySet(key, value); err != nil {
+		panic(err)
+	}
+}
+
+func (okv *OnvaKV) TrySet(key, value []byte) error {
+	if err := okv.CheckKV(key, value); err != nil {
+		return err
+	}
+	okv.set(key, value)
+	return nil
+}
+
+func (okv *OnvaKV) set(key, value []byte) {
 	hotEntry, ok := okv.k2heMap.Load(string(key))
 	if !ok {
 		panic("Can not find entry in cache")
@@ -307,13 +592,25 @@ func (okv *OnvaKV) Set(key, value []byte) {
 	if hotEntry == nil {
 		panic("Can not change or insert at a fake entry")
 	}
-	//fmt.Printf("In Set we see: %#v %#v\n", key, value)
 	hotEntry.EntryPtr.Value = value
 	hotEntry.Operation = types.OpInsertOrChange
 }
 
 func (okv *OnvaKV) Delete(key []byte) {
-	//fmt.Printf("In Delete we see: %s(%#v)\n", string(key), key)
+	if err := okv.TryDelete(key); err != nil {
+		panic(err)
+	}
+}
+
+func (okv *OnvaKV) TryDelete(key []byte) error {
+	if err := okv.CheckKV(key, nil); err != nil {
+		return err
+	}
+	okv.delete(key)
+	return nil
+}
+
+func (okv *OnvaKV) delete(key []byte) {
 	hotEntry, ok := okv.k2heMap.Load(string(key))
 	if !ok {
 		return // delete a non-exist kv pair
@@ -332,9 +629,6 @@ func getPrev(cachedEntries []*HotEntry, i int) int {
 		}
 	}
 	if j < 0 {
-		//for j = i; j >= 0; j-- {
-		//	fmt.Printf("Debug j %d hotEntry %#v Entry %#v\n", j, cachedEntries[j], cachedEntries[j].EntryPtr)
-		//}
 		panic("Can not find previous entry")
 	}
 	return j
@@ -348,15 +642,13 @@ func getNext(cachedEntries []*HotEntry, i int) int {
 		}
 	}
 	if j >= len(cachedEntries) {
-		//for j = i; j < len(cachedEntries); j++ {
-		//	fmt.Printf("Debug j %d hotEntry %#v Entry %#v\n", j, cachedEntries[j], cachedEntries[j].EntryPtr)
-		//}
 		panic("Can not find next entry")
 	}
 	return j
 }
 
 func (okv *OnvaKV) update() {
+	ranges := okv.applyDeletedRanges()
 	sharedIdx := int64(-1)
 	datatree.ParrallelRun(runtime.NumCPU(), func(workerID int) {
 		for {
@@ -398,19 +690,16 @@ func (okv *OnvaKV) update() {
 			okv.cachedEntries[prev].IsTouchedByNext = true
 		} else if isInserted(hotEntry) {
 			hotEntry.IsModified = true
-			//fmt.Printf("THERE key: %#v HotEntry: %#v Entry: %#v\n", hotEntry.EntryPtr.Key, hotEntry, *(hotEntry.EntryPtr))
 			next := getNext(okv.cachedEntries, i)
 			hotEntry.EntryPtr.NextKey = okv.cachedEntries[next].EntryPtr.Key
 			prev := getPrev(okv.cachedEntries, i)
 			okv.cachedEntries[prev].EntryPtr.NextKey = hotEntry.EntryPtr.Key
 			okv.cachedEntries[prev].IsTouchedByNext = true
-			//fmt.Printf("this: %s(%#v) prev %d: %s(%#v) next %d: %s(%#v)\n", hotEntry.EntryPtr.Key, hotEntry.EntryPtr.Key,
-			//	prev, okv.cachedEntries[prev].EntryPtr.Key, okv.cachedEntries[prev].EntryPtr.Key,
-			//	next,  okv.cachedEntries[next].EntryPtr.Key, okv.cachedEntries[next].EntryPtr.Key)
 		} else if isModified(hotEntry) {
 			hotEntry.IsModified = true
 		}
 	}
+	okv.fixNextKeys(ranges)
 	start := gotsc.BenchStart()
 	// update stored data
 	for _, hotEntry := range okv.cachedEntries {
@@ -420,18 +709,15 @@ func (okv *OnvaKV) update() {
 		ptr := hotEntry.EntryPtr
 		if hotEntry.Operation == types.OpDelete && ptr.SerialNum >= 0 {
 			// if ptr.SerialNum==-1, then we are deleting a just-inserted value, so ignore it.
-			//fmt.Printf("Now we deactive %d for deletion %#v\n", ptr.SerialNum, ptr)
 			okv.idxTree.Delete(ptr.Key)
 			okv.DeactiviateEntry(ptr.SerialNum)
 		} else if hotEntry.Operation != types.OpNone || hotEntry.IsTouchedByNext {
 			if ptr.SerialNum >= 0 { // if this entry already exists
-				//fmt.Printf("Now we deactive %d for refresh %#v\n", ptr.SerialNum, ptr)
 				okv.DeactiviateEntry(ptr.SerialNum)
 			}
 			ptr.LastHeight = ptr.Height
 			ptr.Height = okv.meta.GetCurrHeight()
 			ptr.SerialNum = okv.meta.GetMaxSerialNum()
-			//fmt.Printf("Now SerialNum = %d for %s(%#v) %#v Entry %#v\n", ptr.SerialNum, string(ptr.Key), ptr.Key, hotEntry, *ptr)
 			okv.meta.IncrMaxSerialNum()
 			//@ start := gotsc.BenchStart()
 			pos := okv.datTree.AppendEntry(ptr)
@@ -476,12 +762,14 @@ func (okv *OnvaKV) ActiveCount() int {
 var Phase1n2Time, Phase1Time, Phase2Time, Phase3Time, Phase4Time, Phase0Time, tscOverhead uint64
 
 func (okv *OnvaKV) EndWrite() {
+	startTime := time.Now()
 	okv.update()
+	okv.updateTime.Observe(time.Since(startTime).Seconds())
+	startTime = time.Now()
 	start := gotsc.BenchStart()
 	//if okv.meta.GetActiveEntryCount() != int64(okv.idxTree.ActiveCount()) - 2 {
 	//	panic(fmt.Sprintf("Fuck meta.GetActiveEntryCount %d okv.idxTree.ActiveCount %d\n", okv.meta.GetActiveEntryCount(), okv.idxTree.ActiveCount()))
 	//}
-	//fmt.Printf("begin numOfKeptEntries %d ActiveCount %d x2 %d\n", okv.numOfKeptEntries(), okv.idxTree.ActiveCount(), okv.idxTree.ActiveCount()*2)
 	for okv.numOfKeptEntries() > int64(okv.idxTree.ActiveCount())*KeptEntriesToActiveEntriesRatio &&
 		int64(okv.idxTree.ActiveCount()) > StartReapThres {
 		twigID := okv.meta.GetOldestActiveTwigID()
@@ -493,20 +781,26 @@ func (okv *OnvaKV) EndWrite() {
 			datatree.UpdateSerialNum(entryBz, sn)
 			okv.meta.IncrMaxSerialNum()
 			pos := okv.datTree.AppendEntryRawBytes(entryBz, sn)
+			okv.compactionBytes.Add(float64(len(entryBz)))
 			key := datatree.ExtractKeyFromRawBytes(entryBz)
 			okv.idxTree.Set(key, uint64(pos))
 		}
 		okv.datTree.EvictTwig(twigID)
 		okv.meta.IncrOldestActiveTwigID()
+		okv.logger.Debug("reap twig", "twigID", twigID, "height", okv.meta.GetCurrHeight())
 	}
 	Phase3Time += gotsc.BenchEnd() - start - tscOverhead
+	okv.reapTime.Observe(time.Since(startTime).Seconds())
+	startTime = time.Now()
 	start = gotsc.BenchStart()
-	//fmt.Printf("end numOfKeptEntries %d ActiveCount %d x2 %d\n", okv.numOfKeptEntries(), okv.idxTree.ActiveCount(), okv.idxTree.ActiveCount()*2)
 	root := okv.datTree.EndBlock()
 	Phase4Time += gotsc.BenchEnd() - start - tscOverhead
+	okv.endBlockTime.Observe(time.Since(startTime).Seconds())
 	okv.rootHash = root
 	okv.k2heMap = NewBucketMap(heMapSize) // clear content
 	okv.k2nkMap = NewBucketMap(nkMapSize) // clear content
+	okv.preparedRanges = nil
+	okv.deletedRanges = nil
 	for i := range okv.tempEntries64 {
 		okv.tempEntries64[i] = okv.tempEntries64[i][:0] // clear content
 	}
@@ -578,6 +872,7 @@ func (okv *OnvaKV) PruneBeforeHeight(height int64) {
 			okv.meta.DeleteTwigHeight(i)
 		}
 		okv.meta.SetLastPrunedTwig(end-1)
+		okv.logger.Info("prune twigs", "height", height, "startID", start, "endID", end)
 	}
 	okv.rocksdb.SetPruneHeight(uint64(height))
 }
@@ -635,7 +930,6 @@ func (iter *OnvaIterator) Value() []byte {
 		return nil
 	}
 	pos := iter.iter.Value()
-	//fmt.Printf("pos = %d %#v\n", pos, iter.okv.datTree.ReadEntry(int64(pos)))
 	return iter.okv.datTree.ReadEntry(int64(pos)).Value
 }
 func (iter *OnvaIterator) Close() {
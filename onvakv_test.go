@@ -1,12 +1,19 @@
 package onvakv
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"testing"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/coinexchain/onvakv/datatree"
+	"github.com/coinexchain/onvakv/types"
 )
 
 type TestOp struct {
@@ -214,3 +221,372 @@ func Test1(t *testing.T) {
 	os.RemoveAll("./rocksdb.db")
 }
 
+
+func TestCheckKV(t *testing.T) {
+	first := []byte{1}
+	last := []byte{255,255,255,255,255,255}
+	okv := NewOnvaKV4Mock([][]byte{first, last})
+	assert.Equal(t, nil, okv.CheckKV([]byte("key"), []byte("value")))
+	assert.Equal(t, nil, okv.CheckKV([]byte("key"), nil))
+
+	checkKind := func(kind error, key, value []byte) {
+		err := okv.CheckKV(key, value)
+		assert.True(t, errors.Is(err, kind), "%v", err)
+		var kvErr *types.KVError
+		assert.True(t, errors.As(err, &kvErr))
+	}
+	checkKind(types.ErrEmptyKey, []byte{}, nil)
+	checkKind(types.ErrGuardKey, first, nil)
+	checkKind(types.ErrGuardKey, last, []byte("v"))
+	checkKind(types.ErrKeyOutOfRange, []byte{0}, nil)
+	checkKind(types.ErrKeyOutOfRange, []byte{255,255,255,255,255,255,0}, nil)
+	checkKind(types.ErrKeyTooLong, make([]byte, types.DefaultMaxKeyLength+1), nil)
+	checkKind(types.ErrValueTooLong, []byte("key"), make([]byte, types.DefaultMaxValueLength+1))
+
+	assert.NotNil(t, okv.SetLimits(types.KVLimits{MaxKeyLength: 64, MaxValueLength: 16*1024*1024}))
+	assert.NotNil(t, okv.SetLimits(types.KVLimits{MaxKeyLength: 0, MaxValueLength: 16}))
+	assert.Equal(t, nil, okv.SetLimits(types.KVLimits{MaxKeyLength: 8, MaxValueLength: 4}))
+	checkKind(types.ErrKeyTooLong, []byte("123456789"), nil)
+	checkKind(types.ErrValueTooLong, []byte("key"), []byte("12345"))
+
+	// invalid input is rejected before anything is changed
+	assert.Panics(t, func() { okv.PrepareForUpdate(first) })
+	assert.True(t, errors.Is(okv.TryPrepareForUpdate(first), types.ErrGuardKey))
+	assert.True(t, errors.Is(okv.TryPrepareForUpdates([][]byte{[]byte("k"), last}), types.ErrGuardKey))
+	_, err := okv.TryPrepareForDeletion([]byte("123456789"))
+	assert.True(t, errors.Is(err, types.ErrKeyTooLong))
+	assert.Equal(t, nil, okv.TryPrepareForUpdate([]byte("key")))
+	okv.BeginWrite(0)
+	assert.Panics(t, func() { okv.Set([]byte("key"), []byte("12345")) })
+	assert.True(t, errors.Is(okv.TrySet([]byte("key"), []byte("12345")), types.ErrValueTooLong))
+	assert.True(t, errors.Is(okv.TryDelete(first), types.ErrGuardKey))
+	assert.Equal(t, nil, okv.TrySet([]byte("key"), []byte("1234")))
+	okv.EndWrite()
+	assert.Equal(t, []byte("1234"), okv.GetEntry([]byte("key")).Value)
+	okv.CheckConsistency()
+
+	okv.Close()
+	os.RemoveAll("./rocksdb.db")
+}
+
+func TestKeySpace(t *testing.T) {
+	first := []byte{0}
+	last := []byte{255,255,255,255,255,255}
+	okv := NewOnvaKV4Mock([][]byte{first, last})
+	_, err := okv.KeySpace("")
+	assert.NotNil(t, err)
+	_, err = okv.KeySpace("bad\n")
+	assert.NotNil(t, err)
+	ksA, err := okv.KeySpace("a")
+	assert.Nil(t, err)
+	ksB, err := okv.KeySpace("b")
+	assert.Nil(t, err)
+	assert.False(t, ksA.Exists())
+	err = ksA.CheckKV([]byte("k"), nil)
+	assert.True(t, errors.Is(err, types.ErrNoKeySpace), "%v", err)
+
+	ksA.PrepareForCreation()
+	ksB.PrepareForCreation()
+	okv.BeginWrite(0)
+	ksA.Create()
+	ksB.Create()
+	okv.EndWrite()
+	assert.True(t, ksA.Exists())
+	assert.Panics(t, func() { ksA.PrepareForCreation() })
+
+	// the keys of KeySpaces can not be written as plain keys, even if they are not registered
+	for _, k := range []string{"\xfea\x00", "\xfeb\x01", "\xfea\x00x", "\xfec\x00"} {
+		err = okv.CheckKV([]byte(k), nil)
+		assert.True(t, errors.Is(err, types.ErrKeySpaceKey), "%v", err)
+	}
+	assert.Nil(t, okv.CheckKV([]byte("a\x00x"), nil))
+
+	keys := []string{"1", "2", "3"}
+	for _, k := range keys {
+		ksA.PrepareForUpdate([]byte(k))
+		ksB.PrepareForUpdate([]byte(k))
+	}
+	okv.BeginWrite(1)
+	for _, k := range keys {
+		ksA.Set([]byte(k), []byte("a"+k))
+		ksB.Set([]byte(k), []byte("b"+k))
+	}
+	okv.EndWrite()
+	assert.Equal(t, []byte("a2"), ksA.GetEntry([]byte("2")).Value)
+	assert.Equal(t, []byte("b2"), ksB.GetEntry([]byte("2")).Value)
+	assert.Equal(t, []byte("\xfea\x003"), ksA.GetEntry([]byte("3")).Key)
+	assert.Equal(t, []byte("\xfea\x01"), ksA.GetEntry([]byte("3")).NextKey)
+
+	// the ranges containing the entries of KeySpaces can not be deleted
+	err = okv.CheckRange([]byte("\xfea\x002"), []byte("\xfea\x003"))
+	assert.True(t, errors.Is(err, types.ErrKeySpaceKey), "%v", err)
+	err = okv.CheckRange([]byte("4"), nil)
+	assert.True(t, errors.Is(err, types.ErrKeySpaceKey), "%v", err)
+	assert.Nil(t, okv.CheckRange([]byte("\xfea\x004"), []byte("\xfea\x01")))
+
+	var res []string
+	iter := ksA.Iterator(nil, nil)
+	for ; iter.Valid(); iter.Next() {
+		res = append(res, string(iter.Key())+":"+string(iter.Value()))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"1:a1", "2:a2", "3:a3"}, res)
+	res = res[:0]
+	iter = ksB.ReverseIterator([]byte("2"), nil)
+	for ; iter.Valid(); iter.Next() {
+		res = append(res, string(iter.Key())+":"+string(iter.Value()))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"3:b3", "2:b2"}, res)
+
+	assert.True(t, ksB.PrepareForDeletion([]byte("2")))
+	okv.BeginWrite(2)
+	ksB.Delete([]byte("2"))
+	okv.EndWrite()
+	assert.Nil(t, ksB.GetEntry([]byte("2")))
+	assert.NotNil(t, ksA.GetEntry([]byte("2")))
+	okv.CheckConsistency()
+
+	okv.Close()
+	os.RemoveAll("./rocksdb.db")
+}
+
+func TestKeySpaceProof(t *testing.T) {
+	dirName := "./testokv"
+	os.RemoveAll(dirName)
+	okv, err := NewOnvaKV(dirName, false, [][]byte{{0}, {255,255,255,255,255,255}})
+	assert.Nil(t, err)
+	ks, err := okv.KeySpace("ks")
+	assert.Nil(t, err)
+	ks.PrepareForCreation()
+	okv.BeginWrite(0)
+	ks.Create()
+	okv.EndWrite()
+	for _, k := range []string{"1", "3"} {
+		ks.PrepareForUpdate([]byte(k))
+	}
+	okv.PrepareForUpdate([]byte("ks2"))
+	okv.BeginWrite(1)
+	ks.Set([]byte("1"), []byte("v1"))
+	ks.Set([]byte("3"), []byte("v3"))
+	okv.Set([]byte("ks2"), []byte("x"))
+	okv.EndWrite()
+	root := okv.GetRootHash()
+
+	proof, err := ks.GetProof([]byte("1"))
+	assert.Nil(t, err)
+	exists, value, err := VerifyKeySpaceProof("ks", []byte("1"), proof, root)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, []byte("v1"), value)
+	_, _, err = VerifyKeySpaceProof("ks", []byte("1"), proof, append([]byte{1}, root[1:]...))
+	assert.NotNil(t, err)
+
+	proof, err = ks.GetProof([]byte("2"))
+	assert.Nil(t, err)
+	exists, _, err = VerifyKeySpaceProof("ks", []byte("2"), proof, root)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	_, _, err = VerifyKeySpaceProof("ks", []byte("4"), proof, root)
+	assert.NotNil(t, err)
+
+	// the absence proof of a plain key can not prove anything about a KeySpace
+	proof, err = okv.GetProof([]byte("ks1"))
+	assert.Nil(t, err)
+	exists, _, err = VerifyProof([]byte("ks1"), proof, root)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	_, _, err = VerifyKeySpaceProof("k", []byte("s1"), proof, root)
+	assert.NotNil(t, err)
+	okv.Close()
+
+	// the guards are protected after restarting, before the KeySpace is got again
+	okv, err = NewOnvaKV(dirName, false, [][]byte{{0}, {255,255,255,255,255,255}})
+	assert.Nil(t, err)
+	assert.Panics(t, func() { okv.PrepareForDeletion([]byte("\xfeks\x01")) })
+	assert.Panics(t, func() { okv.PrepareForUpdate([]byte("\xfeks\x00")) })
+	assert.Panics(t, func() { okv.PrepareForDeleteRange([]byte("\xfe"), nil) })
+	ks, err = okv.KeySpace("ks")
+	assert.Nil(t, err)
+	assert.True(t, ks.Exists())
+	assert.Equal(t, []byte("v3"), ks.GetEntry([]byte("3")).Value)
+
+	// a plain key written by the versions before KeySpaceMark was reserved
+	okv.prepareForUpdate([]byte("\xfeold"))
+	okv.BeginWrite(2)
+	okv.set([]byte("\xfeold"), []byte("x"))
+	okv.EndWrite()
+	okv.Close()
+	okv, err = NewOnvaKV(dirName, false, [][]byte{{0}, {255,255,255,255,255,255}})
+	assert.Nil(t, okv)
+	assert.True(t, errors.Is(err, types.ErrKeySpaceKey))
+	os.RemoveAll(dirName)
+}
+
+func TestDeleteRange(t *testing.T) {
+	first := []byte{0}
+	last := []byte{255,255,255,255,255,255}
+	okv := NewOnvaKV4Mock([][]byte{first, last})
+	runList(okv, getListAdd(), 0)
+
+	checkKind := func(kind error, start, end []byte) {
+		err := okv.CheckRange(start, end)
+		assert.True(t, errors.Is(err, kind), "%v", err)
+	}
+	checkKind(types.ErrGuardKey, first, []byte("4"))
+	checkKind(types.ErrKeyOutOfRange, []byte("4"), []byte{255,255,255,255,255,255,0})
+	assert.Nil(t, okv.CheckRange([]byte("4"), last))
+	assert.Nil(t, okv.CheckRange([]byte("4"), nil))
+
+	okv.PrepareForUpdate([]byte("43215"))
+	okv.PrepareForUpdate([]byte("432177"))
+	okv.PrepareForUpdate([]byte("43213")) // prepared but not changed
+	okv.PrepareForDeletion([]byte("4321b"))
+	okv.PrepareForDeleteRange([]byte("43212"), []byte("43218"))
+	okv.PrepareForDeleteRange([]byte("43217"), []byte("4321a"))
+	assert.Panics(t, func() { okv.PrepareForDeleteRange(first, []byte("4")) })
+	okv.BeginWrite(1)
+	okv.Set([]byte("43215"), []byte("55"))
+	okv.Set([]byte("432177"), []byte("777"))
+	okv.Delete([]byte("4321b"))
+	okv.DeleteRange([]byte("43212"), []byte("43218"))
+	okv.DeleteRange([]byte("43217"), []byte("4321a")) // overlaps the previous one
+	okv.DeleteRange([]byte("4321e"), []byte("4321e")) // empty
+	assert.Panics(t, func() { okv.DeleteRange([]byte("4321c"), []byte("4321d")) }) // not prepared
+	okv.EndWrite()
+	okv.CheckConsistency()
+
+	getKeys := func() (keys []string) {
+		iter := okv.Iterator(first, last)
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return
+	}
+	assert.Equal(t, []string{"\x00", "43210", "43211", "43215", "432177", "4321a", "4321c", "4321d", "4321e", "4321f"}, getKeys())
+	assert.Equal(t, []byte("55"), okv.GetEntry([]byte("43215")).Value)
+	assert.Equal(t, []byte("4321a"), okv.GetEntry([]byte("432177")).NextKey)
+	assert.Equal(t, []byte("43215"), okv.GetEntry([]byte("43211")).NextKey)
+
+	okv.PrepareForDeleteRange([]byte("4321"), nil)
+	okv.BeginWrite(2)
+	okv.DeleteRange([]byte("4321"), nil)
+	okv.EndWrite()
+	okv.CheckConsistency()
+	assert.Equal(t, []string{"\x00"}, getKeys())
+	assert.Equal(t, 2, okv.ActiveCount())
+	assert.Equal(t, last, okv.GetEntry(first).NextKey)
+
+	okv.Close()
+	os.RemoveAll("./rocksdb.db")
+}
+
+func TestPrepareForUpdates(t *testing.T) {
+	first := []byte{0}
+	last := []byte{255,255,255,255,255,255}
+	okv := NewOnvaKV4Mock([][]byte{first, last})
+	runList(okv, getListAdd(), 0)
+
+	keys := [][]byte{[]byte("43215"), []byte("4321a"), []byte("432155"), []byte("43210")}
+	okv.PrepareForUpdates(keys)
+	assert.Panics(t, func() { okv.PrepareForUpdates([][]byte{[]byte("4321b"), first}) })
+	okv.BeginWrite(1)
+	okv.Set([]byte("43215"), []byte("55"))
+	okv.Set([]byte("432155"), []byte("555"))
+	okv.Set([]byte("43210"), []byte("0"))
+	okv.EndWrite()
+	okv.CheckConsistency()
+	assert.Equal(t, []byte("55"), okv.GetEntry([]byte("43215")).Value)
+	assert.Equal(t, []byte("555"), okv.GetEntry([]byte("432155")).Value)
+	assert.Equal(t, []byte("432155"), okv.GetEntry([]byte("43215")).NextKey)
+	assert.Equal(t, []byte("a0"), okv.GetEntry([]byte("4321a")).Value)
+
+	okv.Close()
+	os.RemoveAll("./rocksdb.db")
+}
+
+func TestRebuildIndex(t *testing.T) {
+	dirName := "./testokv"
+	os.RemoveAll(dirName)
+	startEndKeys := [][]byte{{0}, {255,255,255,255,255,255}}
+	okv, err := NewOnvaKV(dirName, false, startEndKeys)
+	assert.Nil(t, err)
+	for height := int64(0); height < 4; height++ {
+		for i := 0; i < 1500; i++ {
+			okv.PrepareForUpdate([]byte(fmt.Sprintf("k%04d", i*(int(height)+1)%3000)))
+		}
+		okv.BeginWrite(height)
+		for i := 0; i < 1500; i++ {
+			key := fmt.Sprintf("k%04d", i*(int(height)+1)%3000)
+			okv.Set([]byte(key), []byte(fmt.Sprintf("%s-%d", key, height)))
+		}
+		okv.EndWrite()
+	}
+	count := okv.ActiveCount()
+	values := make(map[string][]byte)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("k%04d", i)
+		if e := okv.GetEntry([]byte(key)); e != nil {
+			values[key] = e.Value
+		}
+	}
+	okv.Close()
+	check := func() {
+		assert.Equal(t, count, okv.ActiveCount())
+		for key, value := range values {
+			assert.Equal(t, value, okv.GetEntry([]byte(key)).Value)
+		}
+		okv.CheckConsistency()
+	}
+
+	// the index is rebuilt from the entry file in parallel without the snapshot
+	snapshot := filepath.Join(dirName, indexSnapshotName)
+	bz, err := ioutil.ReadFile(snapshot)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(snapshot))
+	okv, err = NewOnvaKV(dirName, false, startEndKeys)
+	assert.Nil(t, err)
+	check()
+	okv.Close()
+
+	// the index is loaded from the snapshot, which is removed then
+	okv, err = NewOnvaKV(dirName, false, startEndKeys)
+	assert.Nil(t, err)
+	_, err = os.Stat(snapshot)
+	assert.True(t, os.IsNotExist(err))
+	check()
+	okv.PrepareForUpdate([]byte("k0001"))
+	okv.BeginWrite(4)
+	okv.Set([]byte("k0001"), []byte("new"))
+	okv.EndWrite()
+	if _, ok := values["k0001"]; !ok {
+		count++
+	}
+	values["k0001"] = []byte("new")
+	okv.Close()
+
+	// a stale snapshot is ignored
+	assert.Nil(t, ioutil.WriteFile(snapshot, bz, 0700))
+	okv, err = NewOnvaKV(dirName, false, startEndKeys)
+	assert.Nil(t, err)
+	check()
+	okv.Close()
+
+	// no snapshot of plaintext keys is taken when the data tree is encrypted
+	opts := datatree.HPFileOptions{Encryption: &datatree.Encryption{
+		KeyID:  1,
+		GetKey: func(keyID uint32) ([]byte, error) { return bytes.Repeat([]byte{byte(keyID)}, 32), nil },
+	}}
+	okv, err = NewOnvaKVWithOptions(context.Background(), dirName, false, startEndKeys, nil, opts)
+	assert.Nil(t, err)
+	check()
+	okv.Close()
+	_, err = os.Stat(snapshot)
+	assert.True(t, os.IsNotExist(err))
+	okv, err = NewOnvaKVWithOptions(context.Background(), dirName, false, startEndKeys, nil, opts)
+	assert.Nil(t, err)
+	check()
+	okv.Close()
+	os.RemoveAll(dirName)
+}
@@ -0,0 +1,73 @@
+package onvakv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/coinexchain/onvakv/datatree"
+)
+
+var ErrProofUnavailable = errors.New("proof is unavailable")
+
+// Proof proves the existence of a key, with the entry which has this key, or proves the
+// absence of a key, with the entry whose Key and NextKey are around this key.
+type Proof struct {
+	EntryBz []byte // the raw bytes of the entry, whose hash is a leaf of the Merkle tree
+	PathBz  []byte // the serialized datatree.ProofPath
+}
+
+// The entry contained in proof. It is not verified, so only use it with trusted proofs.
+func (proof *Proof) Entry() *Entry {
+	e, _ := datatree.EntryAndSNListFromRawBytes(proof.EntryBz)
+	return e
+}
+
+// Get the proof of key's existence or absence. It must not be called between BeginWrite
+// and EndWrite, and the proof is checked against the root hash returned by GetRootHash.
+// ErrProofUnavailable is returned if the proof can not be generated, and an error wrapping
+// datatree.ErrTwigChecksum is returned if the twig Merkle tree file is corrupted.
+func (okv *OnvaKV) GetProof(key []byte) (*Proof, error) {
+	pos, ok := okv.idxTree.Get(key)
+	if !ok {
+		iter := okv.idxTree.ReverseIterator([]byte{}, key)
+		if !iter.Valid() {
+			iter.Close()
+			return nil, fmt.Errorf("%w: no entry before key %X", ErrProofUnavailable, key)
+		}
+		pos = iter.Value()
+		iter.Close()
+	}
+	entryBz, pathBz, err := okv.datTree.GetProofBytes(int64(pos))
+	if err != nil { // the corrupted data must not look like the proofs are not supported
+		return nil, fmt.Errorf("Can not get the proof of key %X: %w", key, err)
+	}
+	if pathBz == nil {
+		return nil, ErrProofUnavailable
+	}
+	return &Proof{EntryBz: entryBz, PathBz: pathBz}, nil
+}
+
+// Verify the proof against root. It returns the value if key exists, or nil if key is
+// proven to be absent.
+func VerifyProof(key []byte, proof *Proof, root []byte) (exists bool, value []byte, err error) {
+	entry, exists, err := verifyProof(key, proof, root)
+	if err != nil || !exists {
+		return false, nil, err
+	}
+	return true, entry.Value, nil
+}
+
+func verifyProof(key []byte, proof *Proof, root []byte) (entry *Entry, exists bool, err error) {
+	entry, err = datatree.VerifyEntryProof(proof.EntryBz, proof.PathBz, root)
+	if err != nil {
+		return nil, false, err
+	}
+	if bytes.Equal(entry.Key, key) {
+		return entry, true, nil
+	}
+	if bytes.Compare(entry.Key, key) < 0 && bytes.Compare(key, entry.NextKey) < 0 {
+		return entry, false, nil
+	}
+	return nil, false, fmt.Errorf("The proven entry is irrelevant to key %X", key)
+}
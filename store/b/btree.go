@@ -14,6 +14,7 @@ var deletedMarker int64
 
 type Value struct {
 	obj interface{}
+	bz  []byte // the serialized obj, if it is known
 }
 
 func NilValue() Value {
@@ -28,6 +29,11 @@ func NewValue(obj interface{}) Value {
 	return Value{obj: obj}
 }
 
+// Like NewValue, but also records bz, which is obj serialized
+func NewSerializedValue(obj interface{}, bz []byte) Value {
+	return Value{obj: obj, bz: bz}
+}
+
 func (v Value) HasNilValue() bool {
 	return v.obj == nil
 }
@@ -43,6 +49,11 @@ func (v Value) GetObj() interface{} {
 	return v.obj
 }
 
+// Return the bytes passed to NewSerializedValue, or nil
+func (v Value) GetBytes() []byte {
+	return v.bz
+}
+
 const (
 	kx = 32 //TODO benchmark tune this number if using custom key/value type(s).
 	kd = 32 //TODO benchmark tune this number if using custom key/value type(s).
@@ -29,6 +29,13 @@ func (cs *CacheStore) Close() {
 }
 
 func (cs *CacheStore) ScanAllEntries(fn func(key []byte, obj interface{}, isDeleted bool)) {
+	cs.scanAllEntriesWithBytes(func(key []byte, obj interface{}, bz []byte, isDeleted bool) {
+		fn(key, obj, isDeleted)
+	})
+}
+
+// Like ScanAllEntries, but also passes the bytes set by setSerializedObj, or nil
+func (cs *CacheStore) scanAllEntriesWithBytes(fn func(key []byte, obj interface{}, bz []byte, isDeleted bool)) {
 	e, err := cs.bt.SeekFirst()
 	if err != nil {
 		return
@@ -39,7 +46,7 @@ func (cs *CacheStore) ScanAllEntries(fn func(key []byte, obj interface{}, isDele
 		if value.HasNilValue() {
 			panic(fmt.Sprintf("Dangling Cache Entry for %s(%v) %#v", string(key), key, value))
 		}
-		fn(key, value.GetObj(), value.IsDeleted())
+		fn(key, value.GetObj(), value.GetBytes(), value.IsDeleted())
 		key, value, err = e.Next()
 	}
 }
@@ -140,6 +147,12 @@ func (cs *CacheStore) SetObj(key []byte, obj types.Serializable) {
 	cs.bt.Set(append([]byte{}, key...), v)
 }
 
+// Like SetObj, but also keeps bz, which is obj serialized, so it need not be serialized again
+func (cs *CacheStore) setSerializedObj(key []byte, obj types.Serializable, bz []byte) {
+	v := b.NewSerializedValue(obj, bz)
+	cs.bt.Set(append([]byte{}, key...), v)
+}
+
 func (cs *CacheStore) RealDelete(key []byte) {
 	cs.bt.Delete(key)
 }
@@ -300,3 +313,17 @@ func (cs *CacheStore) ReverseIterator(start, end []byte) types.ObjIterator {
 	iter.Next() //fill key, value, err
 	return iter
 }
+
+// Get the raw value of key, which may be a deleted or nil value
+func (cs *CacheStore) getValue(key []byte) (v b.Value, ok bool) {
+	return cs.bt.Get(key)
+}
+
+// Restore the raw value of key, or remove key if it did not exist
+func (cs *CacheStore) restoreValue(key []byte, v b.Value, exists bool) {
+	if exists {
+		cs.bt.Set(key, v)
+	} else {
+		cs.bt.Delete(key)
+	}
+}
@@ -0,0 +1,293 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// Binary is a compact and deterministic codec based on reflection. It supports booleans, integers
+// (as varints), floats, strings, byte slices, arrays, slices, maps (sorted by the encoded keys),
+// pointers and structs (only the exported fields, in the order of declaration; a field tagged
+// with `codec:"-"` is skipped). Interfaces, channels and functions are not supported.
+var Binary Codec = binaryCodec{}
+
+var errShortBuffer = errors.New("unexpected end of input")
+
+type binaryCodec struct{}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeValue(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (binaryCodec) Unmarshal(bz []byte, ptr interface{}) error {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("Unmarshal needs a non-nil pointer, not %T", ptr)
+	}
+	rest, err := decodeValue(bz, v.Elem())
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("%d bytes left after decoding %T", len(rest), ptr)
+	}
+	return nil
+}
+
+func putUvarint(buf *bytes.Buffer, x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], x)])
+}
+
+func putVarint(buf *bytes.Buffer, x int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutVarint(tmp[:], x)])
+}
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		putVarint(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		putUvarint(buf, v.Uint())
+	case reflect.Float32:
+		var tmp [4]byte
+		binary.LittleEndian.PutUint32(tmp[:], math.Float32bits(float32(v.Float())))
+		buf.Write(tmp[:])
+	case reflect.Float64:
+		var tmp [8]byte
+		binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v.Float()))
+		buf.Write(tmp[:])
+	case reflect.String:
+		putUvarint(buf, uint64(v.Len()))
+		buf.WriteString(v.String())
+	case reflect.Slice:
+		putUvarint(buf, uint64(v.Len()))
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf.Write(v.Bytes())
+			return nil
+		}
+		return encodeElems(buf, v)
+	case reflect.Array:
+		return encodeElems(buf, v)
+	case reflect.Map:
+		return encodeMap(buf, v)
+	case reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteByte(0)
+			return nil
+		}
+		buf.WriteByte(1)
+		return encodeValue(buf, v.Elem())
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if skipField(t.Field(i)) {
+				continue
+			}
+			if err := encodeValue(buf, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Type %s is not supported", v.Type())
+	}
+	return nil
+}
+
+func encodeElems(buf *bytes.Buffer, v reflect.Value) error {
+	for i := 0; i < v.Len(); i++ {
+		if err := encodeValue(buf, v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeMap(buf *bytes.Buffer, v reflect.Value) error {
+	type pair struct {
+		k, v []byte
+	}
+	pairs := make([]pair, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		var kBuf, vBuf bytes.Buffer
+		if err := encodeValue(&kBuf, iter.Key()); err != nil {
+			return err
+		}
+		if err := encodeValue(&vBuf, iter.Value()); err != nil {
+			return err
+		}
+		pairs = append(pairs, pair{kBuf.Bytes(), vBuf.Bytes()})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].k, pairs[j].k) < 0
+	})
+	putUvarint(buf, uint64(len(pairs)))
+	for _, p := range pairs {
+		buf.Write(p.k)
+		buf.Write(p.v)
+	}
+	return nil
+}
+
+func skipField(f reflect.StructField) bool {
+	return f.PkgPath != "" || f.Tag.Get("codec") == "-"
+}
+
+func getUvarint(bz []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(bz)
+	if n <= 0 {
+		return 0, nil, errShortBuffer
+	}
+	return x, bz[n:], nil
+}
+
+func getLength(bz []byte) (int, []byte, error) {
+	n, bz, err := getUvarint(bz)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > uint64(len(bz)) { // every element takes at least one byte
+		return 0, nil, errShortBuffer
+	}
+	return int(n), bz, nil
+}
+
+func decodeValue(bz []byte, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if len(bz) == 0 {
+			return nil, errShortBuffer
+		}
+		if bz[0] > 1 {
+			return nil, fmt.Errorf("Invalid boolean byte %d", bz[0])
+		}
+		v.SetBool(bz[0] == 1)
+		return bz[1:], nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, n := binary.Varint(bz)
+		if n <= 0 {
+			return nil, errShortBuffer
+		}
+		if v.OverflowInt(x) {
+			return nil, fmt.Errorf("Value %d overflows %s", x, v.Type())
+		}
+		v.SetInt(x)
+		return bz[n:], nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x, rest, err := getUvarint(bz)
+		if err != nil {
+			return nil, err
+		}
+		if v.OverflowUint(x) {
+			return nil, fmt.Errorf("Value %d overflows %s", x, v.Type())
+		}
+		v.SetUint(x)
+		return rest, nil
+	case reflect.Float32:
+		if len(bz) < 4 {
+			return nil, errShortBuffer
+		}
+		v.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(bz))))
+		return bz[4:], nil
+	case reflect.Float64:
+		if len(bz) < 8 {
+			return nil, errShortBuffer
+		}
+		v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(bz)))
+		return bz[8:], nil
+	case reflect.String:
+		n, bz, err := getLength(bz)
+		if err != nil {
+			return nil, err
+		}
+		v.SetString(string(bz[:n]))
+		return bz[n:], nil
+	case reflect.Slice:
+		n, bz, err := getLength(bz)
+		if err != nil {
+			return nil, err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte{}, bz[:n]...))
+			return bz[n:], nil
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		return decodeElems(bz, v)
+	case reflect.Array:
+		return decodeElems(bz, v)
+	case reflect.Map:
+		n, bz, err := getLength(bz)
+		if err != nil {
+			return nil, err
+		}
+		t := v.Type()
+		v.Set(reflect.MakeMapWithSize(t, n))
+		for i := 0; i < n; i++ {
+			key := reflect.New(t.Key()).Elem()
+			if bz, err = decodeValue(bz, key); err != nil {
+				return nil, err
+			}
+			elem := reflect.New(t.Elem()).Elem()
+			if bz, err = decodeValue(bz, elem); err != nil {
+				return nil, err
+			}
+			v.SetMapIndex(key, elem)
+		}
+		return bz, nil
+	case reflect.Ptr:
+		if len(bz) == 0 {
+			return nil, errShortBuffer
+		}
+		switch bz[0] {
+		case 0:
+			v.Set(reflect.Zero(v.Type()))
+			return bz[1:], nil
+		case 1:
+			elem := reflect.New(v.Type().Elem())
+			v.Set(elem)
+			return decodeValue(bz[1:], elem.Elem())
+		default:
+			return nil, fmt.Errorf("Invalid pointer flag %d", bz[0])
+		}
+	case reflect.Struct:
+		t := v.Type()
+		var err error
+		for i := 0; i < t.NumField(); i++ {
+			if skipField(t.Field(i)) {
+				continue
+			}
+			if bz, err = decodeValue(bz, v.Field(i)); err != nil {
+				return nil, err
+			}
+		}
+		return bz, nil
+	default:
+		return nil, fmt.Errorf("Type %s is not supported", v.Type())
+	}
+}
+
+func decodeElems(bz []byte, v reflect.Value) (_ []byte, err error) {
+	for i := 0; i < v.Len(); i++ {
+		if bz, err = decodeValue(bz, v.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return bz, nil
+}
@@ -0,0 +1,88 @@
+package codec
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type Inner struct {
+	Name  string
+	Flags []bool
+}
+
+type Account struct {
+	ID      uint64
+	Balance int64
+	Rate    float64
+	Code    []byte
+	Tags    map[string]uint32
+	Inner   *Inner
+	Pair    [2]int8
+	skipped int
+	Skipped int `codec:"-"`
+}
+
+func TestBinary(t *testing.T) {
+	acc := Account{
+		ID:      300,
+		Balance: -5,
+		Rate:    0.5,
+		Code:    []byte{1, 2, 3},
+		Tags:    map[string]uint32{"b": 2, "a": 1, "c": 3},
+		Inner:   &Inner{Name: "in", Flags: []bool{true, false}},
+		Pair:    [2]int8{-1, 1},
+		skipped: 7,
+		Skipped: 8,
+	}
+	bz, err := Binary.Marshal(acc)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ { // the order of map is deterministic
+		bz2, _ := Binary.Marshal(acc)
+		assert.Equal(t, bz, bz2)
+	}
+	var acc2 Account
+	assert.Nil(t, Binary.Unmarshal(bz, &acc2))
+	acc.skipped, acc.Skipped = 0, 0
+	assert.Equal(t, acc, acc2)
+
+	assert.NotNil(t, Binary.Unmarshal(bz[:len(bz)-1], &acc2))
+	assert.NotNil(t, Binary.Unmarshal(append(bz, 0), &acc2))
+	assert.NotNil(t, Binary.Unmarshal(bz, acc2))
+	_, err = Binary.Marshal(struct{ F func() }{})
+	assert.NotNil(t, err)
+
+	var small int8
+	bz, _ = Binary.Marshal(1000)
+	assert.NotNil(t, Binary.Unmarshal(bz, &small))
+}
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	assert.Nil(t, reg.Register([]byte("acc"), &Account{}, nil))
+	assert.Nil(t, reg.Register([]byte("acc/in"), Inner{}, Binary))
+	assert.NotNil(t, reg.Register([]byte("acc"), Inner{}, nil))
+
+	typ, _, ok := reg.Lookup([]byte("acc/inner1"))
+	assert.True(t, ok)
+	assert.Equal(t, "Inner", typ.Name())
+	typ, _, ok = reg.Lookup([]byte("acc1"))
+	assert.True(t, ok)
+	assert.Equal(t, "Account", typ.Name())
+	_, _, ok = reg.Lookup([]byte("ac"))
+	assert.False(t, ok)
+
+	bz, err := reg.Marshal([]byte("acc1"), &Account{ID: 1})
+	assert.Nil(t, err)
+	var acc Account
+	assert.Nil(t, reg.Unmarshal([]byte("acc1"), bz, &acc))
+	assert.Equal(t, uint64(1), acc.ID)
+
+	_, err = reg.Marshal([]byte("acc1"), Inner{})
+	assert.True(t, errors.Is(err, ErrTypeMismatch))
+	err = reg.Unmarshal([]byte("acc/in1"), bz, &acc)
+	assert.True(t, errors.Is(err, ErrTypeMismatch))
+	_, err = reg.Marshal([]byte("xyz"), Inner{})
+	assert.True(t, errors.Is(err, ErrNoCodec))
+}
@@ -0,0 +1,124 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/coinexchain/onvakv/store/types"
+)
+
+var (
+	ErrNoCodec      = errors.New("no codec is registered for the key")
+	ErrTypeMismatch = errors.New("type mismatch")
+)
+
+// Codec converts the values of some types from and to bytes
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(bz []byte, ptr interface{}) error
+}
+
+type entry struct {
+	prefix []byte
+	typ    reflect.Type
+	codec  Codec
+}
+
+// Registry maps key prefixes to concrete value types and their codecs. A key uses the entry
+// with the longest prefix of it.
+type Registry struct {
+	mtx     sync.RWMutex
+	entries []entry // sorted by the lengths of prefixes, in descending order
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+var defaultRegistry = NewRegistry()
+
+// The registry used when no registry is specified
+func DefaultRegistry() *Registry {
+	return defaultRegistry
+}
+
+// Register the type of sample, or the type sample points to, for the keys with prefix.
+// When c is nil, Binary is used.
+func (r *Registry) Register(prefix []byte, sample interface{}, c Codec) error {
+	if sample == nil {
+		return errors.New("The sample value is nil")
+	}
+	typ := reflect.TypeOf(sample)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if c == nil {
+		c = Binary
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, e := range r.entries {
+		if bytes.Equal(e.prefix, prefix) {
+			return fmt.Errorf("Prefix %X has been registered for %s", prefix, e.typ)
+		}
+	}
+	r.entries = append(r.entries, entry{prefix: append([]byte{}, prefix...), typ: typ, codec: c})
+	sort.SliceStable(r.entries, func(i, j int) bool {
+		return len(r.entries[i].prefix) > len(r.entries[j].prefix)
+	})
+	return nil
+}
+
+// Register the type of sample for all the keys in the sub-store of storeKey
+func (r *Registry) RegisterStoreKey(storeKey types.StoreKey, sample interface{}, c Codec) error {
+	return r.Register([]byte(storeKey.Prefix()), sample, c)
+}
+
+// Find the type and codec registered for key
+func (r *Registry) Lookup(key []byte) (typ reflect.Type, c Codec, ok bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for _, e := range r.entries {
+		if bytes.HasPrefix(key, e.prefix) {
+			return e.typ, e.codec, true
+		}
+	}
+	return nil, nil, false
+}
+
+// Encode v, whose type (or the type it points to) must be the one registered for key
+func (r *Registry) Marshal(key []byte, v interface{}) ([]byte, error) {
+	typ, c, ok := r.Lookup(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: %X", ErrNoCodec, key)
+	}
+	if v == nil {
+		return nil, fmt.Errorf("%w: nil is not %s", ErrTypeMismatch, typ)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && rv.Type().Elem() == typ {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("Marshal nil %T", v)
+		}
+		v = rv.Elem().Interface()
+	} else if rv.Type() != typ {
+		return nil, fmt.Errorf("%w: %T is not %s", ErrTypeMismatch, v, typ)
+	}
+	return c.Marshal(v)
+}
+
+// Decode bz to ptr, which must point to the type registered for key
+func (r *Registry) Unmarshal(key, bz []byte, ptr interface{}) error {
+	typ, c, ok := r.Lookup(key)
+	if !ok {
+		return fmt.Errorf("%w: %X", ErrNoCodec, key)
+	}
+	if t := reflect.TypeOf(ptr); t == nil || t.Kind() != reflect.Ptr || t.Elem() != typ {
+		return fmt.Errorf("%w: %T is not *%s", ErrTypeMismatch, ptr, typ)
+	}
+	return c.Unmarshal(bz, ptr)
+}
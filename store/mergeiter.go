@@ -21,6 +21,11 @@ type cacheMergeIterator struct {
 
 var _ types.ObjIterator = (*cacheMergeIterator)(nil)
 
+// NewCacheMergeIterator merges parent and cache, where the deleted items of cache have nil values
+func NewCacheMergeIterator(parent, cache types.ObjIterator, ascending bool) types.ObjIterator {
+	return newCacheMergeIterator(parent, cache, ascending)
+}
+
 func newCacheMergeIterator(parent, cache types.ObjIterator, ascending bool) *cacheMergeIterator {
 	iter := &cacheMergeIterator{
 		parent:    parent,
@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	"github.com/coinexchain/onvakv/store/types"
+	onvakvtypes "github.com/coinexchain/onvakv/types"
 )
 
 type MockRootStore struct {
@@ -29,6 +30,9 @@ func (rs *MockRootStore) GetTrunkStore() interface{} {
 		cache:     NewCacheStore(),
 		root:      rs,
 		isWriting: 0,
+
+		preparedForUpdate:   &sync.Map{},
+		preparedForDeletion: &sync.Map{},
 	}
 }
 
@@ -66,6 +70,10 @@ func (rs *MockRootStore) Has(key []byte) bool {
 	return status == types.Hit
 }
 
+func (rs *MockRootStore) CheckKV(key, value []byte) error {
+	return onvakvtypes.DefaultKVLimits.CheckKV(key, value)
+}
+
 func (rs *MockRootStore) PrepareForUpdate(key []byte) {
 	if rs.isWritting {panic("isWritting")}
 	rs.preparedForUpdate.Store(string(key), struct{}{})
@@ -76,6 +84,30 @@ func (rs *MockRootStore) PrepareForDeletion(key []byte) {
 	rs.preparedForDeletion.Store(string(key), struct{}{})
 }
 
+func (rs *MockRootStore) TryPrepareForUpdate(key []byte) error {
+	if err := rs.CheckKV(key, nil); err != nil {
+		return err
+	}
+	rs.PrepareForUpdate(key)
+	return nil
+}
+
+func (rs *MockRootStore) TryPrepareForDeletion(key []byte) error {
+	if err := rs.CheckKV(key, nil); err != nil {
+		return err
+	}
+	rs.PrepareForDeletion(key)
+	return nil
+}
+
+func (rs *MockRootStore) CheckRange(start, end []byte) error {
+	return onvakvtypes.DefaultKVLimits.CheckKV(start, nil)
+}
+
+func (rs *MockRootStore) PrepareForDeleteRange(start, end []byte) {
+	if rs.isWritting {panic("isWritting")}
+}
+
 func (rs *MockRootStore) Iterator(start, end []byte) types.ObjIterator {
 	return rs.cacheStore.Iterator(start, end)
 }
@@ -104,6 +136,10 @@ func (rs *MockRootStore) SetObj(key []byte, obj types.Serializable) {
 	rs.cacheStore.SetObj(key, obj)
 }
 
+func (rs *MockRootStore) SetSerializedObj(key []byte, obj types.Serializable, bz []byte) {
+	rs.SetObj(key, obj)
+}
+
 func (rs *MockRootStore) Delete(key []byte) {
 	if !rs.isWritting {panic("notWritting")}
 	if _, ok := rs.preparedForDeletion.Load(string(key)); !ok {
@@ -112,6 +148,11 @@ func (rs *MockRootStore) Delete(key []byte) {
 	rs.cacheStore.RealDelete(key)
 }
 
+func (rs *MockRootStore) DeleteRange(start, end []byte) {
+	if !rs.isWritting {panic("notWritting")}
+	rs.cacheStore.removeRange(start, end)
+}
+
 func (rs *MockRootStore) EndWrite() {
 	rs.isWritting = false
 	rs.preparedForUpdate = &sync.Map{}
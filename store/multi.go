@@ -1,6 +1,8 @@
 package store
 
 import (
+	"bytes"
+
 	"github.com/coinexchain/onvakv/store/types"
 )
 
@@ -9,6 +11,13 @@ type MultiStore struct {
 	cache     *CacheStore
 	trunk     *TrunkStore
 	storeKeys map[types.StoreKey]struct{}
+	readSet   readSet // what is read from trunk
+	version   int     // the count of trunk's logged write-backs when this MultiStore was created
+
+	deletedRanges deletedRanges
+
+	journal    []journalEntry
+	savepoints []int // the lengths of journal when the savepoints were taken
 }
 
 func (ms *MultiStore) SubStore(storeKey types.StoreKey) types.KObjStore {
@@ -30,6 +39,10 @@ func (ms *MultiStore) Has(key []byte) bool {
 	case types.Hit:
 		return true
 	case types.Missed:
+		if ms.deletedRanges.contains(key) {
+			return false
+		}
+		ms.readSet.addKey(key)
 		return ms.trunk.Has(key)
 	default:
 		panic("Invalid Status")
@@ -44,6 +57,10 @@ func (ms *MultiStore) Get(key []byte) []byte {
 	case types.Hit:
 		return res
 	case types.Missed:
+		if ms.deletedRanges.contains(key) {
+			return nil
+		}
+		ms.readSet.addKey(key)
 		return ms.trunk.Get(key)
 	default:
 		panic("Invalid Status")
@@ -51,11 +68,17 @@ func (ms *MultiStore) Get(key []byte) []byte {
 }
 
 func (ms *MultiStore) GetObj(key []byte, ptr *types.Serializable) {
+	ms.journalKey(key)
 	status := ms.cache.GetObj(key, ptr)
 	switch status {
 	case types.JustDeleted:
 		*ptr = nil
 	case types.Missed:
+		if ms.deletedRanges.contains(key) {
+			*ptr = nil
+			return
+		}
+		ms.readSet.addKey(key)
 		ms.trunk.GetObjCopy(key, ptr)
 	}
 }
@@ -66,42 +89,135 @@ func (ms *MultiStore) GetReadOnlyObj(key []byte, ptr *types.Serializable) {
 	case types.JustDeleted:
 		*ptr = nil
 	case types.Missed:
+		if ms.deletedRanges.contains(key) {
+			*ptr = nil
+			return
+		}
+		ms.readSet.addKey(key)
 		ms.trunk.GetReadOnlyObj(key, ptr)
 	}
 }
 
+// Set, SetObj and Delete panic with *onvakv/types.KVError on invalid input, before anything is changed
 func (ms *MultiStore) Set(key, value []byte) {
+	if err := ms.TrySet(key, value); err != nil {
+		panic(err)
+	}
+}
+
+func (ms *MultiStore) SetObj(key []byte, obj types.Serializable) {
+	if err := ms.TrySetObj(key, obj); err != nil {
+		panic(err)
+	}
+}
+
+func (ms *MultiStore) Delete(key []byte) {
+	if err := ms.TryDelete(key); err != nil {
+		panic(err)
+	}
+}
+
+func (ms *MultiStore) TrySet(key, value []byte) error {
+	if err := ms.trunk.CheckKV(key, value); err != nil {
+		return err
+	}
+	ms.journalKey(key)
 	ms.cache.Set(key, value)
 	ms.trunk.PrepareForUpdate(key)
+	return nil
 }
 
-func (ms *MultiStore) SetObj(key []byte, obj types.Serializable) {
-	ms.cache.SetObj(key, obj)
+// obj is serialized to check its size, because an oversized object would make the whole
+// block fail when it is written back. The bytes are kept with obj and written back instead of
+// serializing obj again.
+func (ms *MultiStore) TrySetObj(key []byte, obj types.Serializable) error {
+	bz := obj.ToBytes()
+	if err := ms.trunk.CheckKV(key, bz); err != nil {
+		return err
+	}
+	ms.journalKey(key)
+	ms.cache.setSerializedObj(key, obj, bz)
 	ms.trunk.PrepareForUpdate(key)
+	return nil
 }
 
-func (ms *MultiStore) Delete(key []byte) {
+func (ms *MultiStore) TryDelete(key []byte) error {
+	if err := ms.trunk.CheckKV(key, nil); err != nil {
+		return err
+	}
+	ms.journalKey(key)
 	ms.cache.Delete(key)
 	ms.trunk.PrepareForDeletion(key)
+	return nil
 }
 
+// Delete all the keys in [start, end). The keys need not be prepared. It panics with
+// *onvakv/types.KVError on an invalid range.
+func (ms *MultiStore) DeleteRange(start, end []byte) {
+	if err := ms.TryDeleteRange(start, end); err != nil {
+		panic(err)
+	}
+}
+
+// end must not be nil. Nothing is deleted if start >= end.
+func (ms *MultiStore) TryDeleteRange(start, end []byte) error {
+	if err := ms.trunk.CheckRange(start, end); err != nil {
+		return err
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return nil
+	}
+	iter := ms.cache.Iterator(start, end)
+	for ; iter.Valid(); iter.Next() {
+		ms.journalKey(iter.Key())
+	}
+	iter.Close()
+	ms.cache.removeRange(start, end)
+	ms.deletedRanges = append(ms.deletedRanges, keyRange{
+		start: append([]byte{}, start...),
+		end:   append([]byte{}, end...),
+	})
+	ms.journalRange()
+	return nil
+}
+
+// Close panics with *ConflictError if the write-back conflicts with an earlier one, which only
+// happens to the MultiStores created by CachedWithOCC
 func (ms *MultiStore) Close(writeBack bool) {
+	if err := ms.TryClose(writeBack); err != nil {
+		panic(err)
+	}
+}
+
+// For a MultiStore created by CachedWithOCC, when writeBack is true and some key read by it has
+// been written by the write-back of another MultiStore after its creation, TryClose does not write
+// back and returns a *ConflictError. Then the transaction should be re-executed with a new
+// MultiStore. The MultiStores created by Cached never conflict.
+func (ms *MultiStore) TryClose(writeBack bool) (err error) {
 	if writeBack {
-		ms.writeBack()
+		err = ms.trunk.writeBackMulti(ms)
 	}
 	ms.cache = nil
 	ms.trunk = nil
 	ms.storeKeys = nil
+	ms.readSet = readSet{}
+	ms.deletedRanges = nil
+	ms.journal = nil
+	ms.savepoints = nil
+	return
 }
 
 func (ms *MultiStore) writeBack() {
+	for _, r := range ms.deletedRanges {
+		ms.trunk.DeleteRange(r.start, r.end)
+	}
 	ms.trunk.Update(func(cache *CacheStore) {
-		ms.cache.ScanAllEntries(func(key []byte, obj interface{}, isDeleted bool) {
+		ms.cache.scanAllEntriesWithBytes(func(key []byte, obj interface{}, bz []byte, isDeleted bool) {
 			if isDeleted {
 				cache.Delete(key)
 			} else {
 				if sobj, ok := obj.(types.Serializable); ok {
-					cache.SetObj(key, sobj)
+					cache.setSerializedObj(key, sobj, bz)
 				} else {
 					cache.Set(key, obj.([]byte))
 				}
@@ -111,9 +227,19 @@ func (ms *MultiStore) writeBack() {
 }
 
 func (ms *MultiStore) Iterator(start, end []byte) types.ObjIterator {
-	return newCacheMergeIterator(ms.trunk.Iterator(start, end), ms.cache.Iterator(start, end), true)
+	parent := newRangeSkipIterator(ms.trunk.Iterator(start, end), ms.deletedRanges)
+	iter := newCacheMergeIterator(parent, ms.cache.Iterator(start, end), true)
+	if !ms.readSet.enabled {
+		return iter
+	}
+	return newTrackedIterator(iter, &ms.readSet, start, end, true)
 }
 
 func (ms *MultiStore) ReverseIterator(start, end []byte) types.ObjIterator {
-	return newCacheMergeIterator(ms.trunk.ReverseIterator(start, end), ms.cache.ReverseIterator(start, end), false)
+	parent := newRangeSkipIterator(ms.trunk.ReverseIterator(start, end), ms.deletedRanges)
+	iter := newCacheMergeIterator(parent, ms.cache.ReverseIterator(start, end), false)
+	if !ms.readSet.enabled {
+		return iter
+	}
+	return newTrackedIterator(iter, &ms.readSet, start, end, false)
 }
@@ -0,0 +1,213 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coinexchain/onvakv/metrics"
+	"github.com/coinexchain/onvakv/store/types"
+)
+
+const (
+	DefaultCacheSizeInBytes = 256 * 1024 * 1024
+
+	objCacheShardCount = 16
+	objCacheOverhead   = 96 // the estimated bytes taken by the bookkeeping of one object
+)
+
+// Sizer can be implemented by the cached objects to tell their sizes in DRAM. Otherwise, the
+// size of an object is estimated with the length of its serialized bytes.
+type Sizer interface {
+	Size() int
+}
+
+type ObjCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Count     int
+	Bytes     int64
+}
+
+// ObjCache is an LRU cache of deserialized objects, which is bounded by the estimated bytes of
+// them. It is divided into shards with their own locks, so the concurrent readers seldom block
+// each other.
+type ObjCache struct {
+	shards [objCacheShardCount]objCacheShard
+
+	hits      int64
+	misses    int64
+	evictions int64
+
+	hitCounter   metrics.Counter
+	missCounter  metrics.Counter
+	evictCounter metrics.Counter
+}
+
+type objCacheShard struct {
+	mtx      sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       *list.List // the most recently used item is at the front
+	items    map[string]*list.Element
+}
+
+type objCacheItem struct {
+	key  string
+	obj  types.Serializable
+	size int64
+}
+
+func NewObjCache(maxBytes int64) *ObjCache {
+	c := &ObjCache{}
+	for i := range c.shards {
+		c.shards[i].ll = list.New()
+		c.shards[i].items = make(map[string]*list.Element)
+	}
+	c.SetMetrics(nil)
+	c.SetMaxBytes(maxBytes)
+	return c
+}
+
+func (c *ObjCache) SetMetrics(reg metrics.Registry) {
+	reg = metrics.OrNop(reg)
+	c.hitCounter = reg.NewCounter(metrics.RootStoreCacheHits)
+	c.missCounter = reg.NewCounter(metrics.RootStoreCacheMisses)
+	c.evictCounter = reg.NewCounter(metrics.RootStoreCacheEvictions)
+}
+
+// Change the bound of cache, evicting the least recently used objects if needed
+func (c *ObjCache) SetMaxBytes(maxBytes int64) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mtx.Lock()
+		s.maxBytes = maxBytes / objCacheShardCount
+		c.evict(s)
+		s.mtx.Unlock()
+	}
+}
+
+func (c *ObjCache) shard(key string) *objCacheShard {
+	h := uint32(2166136261) // FNV-1a
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &c.shards[h%objCacheShardCount]
+}
+
+// Get the object of key and mark it as the most recently used one. The hit or miss is counted.
+func (c *ObjCache) Get(key []byte) (types.Serializable, bool) {
+	s := c.shard(string(key))
+	s.mtx.Lock()
+	elem, ok := s.items[string(key)]
+	var obj types.Serializable
+	if ok {
+		s.ll.MoveToFront(elem)
+		obj = elem.Value.(*objCacheItem).obj
+	}
+	s.mtx.Unlock()
+	if ok {
+		atomic.AddInt64(&c.hits, 1)
+		c.hitCounter.Add(1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+		c.missCounter.Add(1)
+	}
+	return obj, ok
+}
+
+// Like Get, but neither the recency nor the statistics are changed
+func (c *ObjCache) Peek(key []byte) (types.Serializable, bool) {
+	s := c.shard(string(key))
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if elem, ok := s.items[string(key)]; ok {
+		return elem.Value.(*objCacheItem).obj, true
+	}
+	return nil, false
+}
+
+// Add or replace the object of key. Its size is estimated again, so Add must be called
+// again after an object is changed in place.
+func (c *ObjCache) Add(key []byte, obj types.Serializable) {
+	var size int64
+	if sizer, ok := obj.(Sizer); ok {
+		size = int64(sizer.Size())
+	} else {
+		size = int64(len(obj.ToBytes()))
+	}
+	size += int64(len(key)) + objCacheOverhead
+	s := c.shard(string(key))
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if size > s.maxBytes { // too large to be cached
+		c.remove(s, string(key))
+		return
+	}
+	if elem, ok := s.items[string(key)]; ok {
+		item := elem.Value.(*objCacheItem)
+		s.bytes += size - item.size
+		item.obj, item.size = obj, size
+		s.ll.MoveToFront(elem)
+	} else {
+		s.items[string(key)] = s.ll.PushFront(&objCacheItem{key: string(key), obj: obj, size: size})
+		s.bytes += size
+	}
+	c.evict(s)
+}
+
+func (c *ObjCache) Delete(key []byte) {
+	s := c.shard(string(key))
+	s.mtx.Lock()
+	c.remove(s, string(key))
+	s.mtx.Unlock()
+}
+
+// Delete the objects whose keys are in [start, end). nil end means no upper bound.
+func (c *ObjCache) DeleteRange(start, end []byte) {
+	r := keyRange{start: start, end: end}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mtx.Lock()
+		for key := range s.items {
+			if r.contains([]byte(key)) {
+				c.remove(s, key)
+			}
+		}
+		s.mtx.Unlock()
+	}
+}
+
+func (c *ObjCache) remove(s *objCacheShard, key string) {
+	if elem, ok := s.items[key]; ok {
+		s.bytes -= elem.Value.(*objCacheItem).size
+		s.ll.Remove(elem)
+		delete(s.items, key)
+	}
+}
+
+// Evict the least recently used objects until the shard is within its bound
+func (c *ObjCache) evict(s *objCacheShard) {
+	for s.bytes > s.maxBytes {
+		elem := s.ll.Back()
+		c.remove(s, elem.Value.(*objCacheItem).key)
+		atomic.AddInt64(&c.evictions, 1)
+		c.evictCounter.Add(1)
+	}
+}
+
+func (c *ObjCache) Stats() (stats ObjCacheStats) {
+	stats.Hits = atomic.LoadInt64(&c.hits)
+	stats.Misses = atomic.LoadInt64(&c.misses)
+	stats.Evictions = atomic.LoadInt64(&c.evictions)
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mtx.Lock()
+		stats.Count += len(s.items)
+		stats.Bytes += s.bytes
+		s.mtx.Unlock()
+	}
+	return
+}
@@ -0,0 +1,39 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjCache(t *testing.T) {
+	// each Coord takes 8+2+96=106 bytes, and each shard can hold 2 of them
+	cache := NewObjCache(16 * 250)
+	keys := make([][]byte, 0, 100)
+	for i := 0; i < 100; i++ {
+		key := []byte{byte(i / 10 + '0'), byte(i % 10 + '0')}
+		keys = append(keys, key)
+		cache.Add(key, &Coord{x: uint32(i)})
+		_, ok := cache.Get(keys[0]) // keep keys[0] hot
+		assert.True(t, ok)
+	}
+	stats := cache.Stats()
+	assert.True(t, stats.Count <= 32)
+	assert.Equal(t, int64(stats.Count*106), stats.Bytes)
+	assert.Equal(t, int64(100-stats.Count), stats.Evictions)
+	assert.Equal(t, int64(100), stats.Hits)
+	obj, ok := cache.Peek(keys[0])
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0), obj.(*Coord).x)
+	_, ok = cache.Get(keys[1])
+	assert.False(t, ok)
+	assert.Equal(t, int64(1), cache.Stats().Misses)
+
+	cache.Delete(keys[0])
+	_, ok = cache.Peek(keys[0])
+	assert.False(t, ok)
+	cache.SetMaxBytes(0)
+	assert.Equal(t, 0, cache.Stats().Count)
+	cache.Add(keys[0], &Coord{})
+	assert.Equal(t, 0, cache.Stats().Count) // too large
+}
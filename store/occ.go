@@ -0,0 +1,170 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/coinexchain/onvakv/store/types"
+)
+
+// Optimistic concurrency control among the MultiStores built upon the same TrunkStore:
+// A MultiStore created by CachedWithOCC records the keys and the ranges it reads from the
+// TrunkStore. When it is written back, we check whether the write-backs of other MultiStores, which happened after its creation,
+// have written some keys it read. If so, the transaction executed with it may have seen a stale
+// state, and it must be re-executed.
+
+// ErrConflict is wrapped by the error returned by MultiStore.TryClose
+var ErrConflict = errors.New("conflict with an earlier write-back")
+
+// ConflictError tells a key which was read by a MultiStore and written by an earlier write-back
+type ConflictError struct {
+	Key []byte
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: key=%X", ErrConflict, e.Key)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// [start, end) read by an iterator or deleted by DeleteRange. nil end means no upper bound.
+type keyRange struct {
+	start []byte
+	end   []byte
+}
+
+func (r keyRange) contains(key []byte) bool {
+	return bytes.Compare(key, r.start) >= 0 && (r.end == nil || bytes.Compare(key, r.end) < 0)
+}
+
+func (r keyRange) overlaps(other keyRange) bool {
+	return (other.end == nil || bytes.Compare(r.start, other.end) < 0) &&
+		(r.end == nil || bytes.Compare(other.start, r.end) < 0)
+}
+
+// What a write-back of MultiStore has written
+type writeRecord struct {
+	keys   [][]byte
+	ranges []keyRange
+}
+
+type readSet struct {
+	enabled bool // nothing is recorded if false
+	keys    map[string]struct{}
+	ranges  []keyRange
+	iters   []*trackedIterator
+}
+
+func (rs *readSet) addKey(key []byte) {
+	if !rs.enabled {
+		return
+	}
+	if rs.keys == nil {
+		rs.keys = make(map[string]struct{})
+	}
+	rs.keys[string(key)] = struct{}{}
+}
+
+// Find a key which has been read and then written by rec. For a deleted range which overlaps
+// a range read by an iterator, the start of the deleted range is returned.
+func (rs *readSet) findConflict(rec writeRecord) []byte {
+	for _, iter := range rs.iters {
+		if !iter.closed { // the iterators not closed yet have read till now
+			rs.ranges = append(rs.ranges, iter.readRange())
+		}
+	}
+	rs.iters = nil
+	for _, key := range rec.keys {
+		if _, ok := rs.keys[string(key)]; ok {
+			return key
+		}
+		for _, r := range rs.ranges {
+			if r.contains(key) {
+				return key
+			}
+		}
+	}
+	for _, deleted := range rec.ranges {
+		for key := range rs.keys {
+			if deleted.contains([]byte(key)) {
+				return []byte(key)
+			}
+		}
+		for _, r := range rs.ranges {
+			if r.overlaps(deleted) {
+				return deleted.start
+			}
+		}
+	}
+	return nil
+}
+
+// trackedIterator records the range which has been read by its client
+type trackedIterator struct {
+	types.ObjIterator
+	rs         *readSet
+	start, end []byte
+	ascending  bool
+	observed   bool // whether the client has seen the current key or value
+	closed     bool
+}
+
+func newTrackedIterator(iter types.ObjIterator, rs *readSet, start, end []byte, ascending bool) *trackedIterator {
+	res := &trackedIterator{
+		ObjIterator: iter,
+		rs:          rs,
+		start:       start,
+		end:         end,
+		ascending:   ascending,
+	}
+	rs.iters = append(rs.iters, res)
+	return res
+}
+
+func (iter *trackedIterator) Next() {
+	iter.observed = false
+	iter.ObjIterator.Next()
+}
+
+func (iter *trackedIterator) Key() []byte {
+	iter.observed = true
+	return iter.ObjIterator.Key()
+}
+
+func (iter *trackedIterator) Value() []byte {
+	iter.observed = true
+	return iter.ObjIterator.Value()
+}
+
+func (iter *trackedIterator) ObjValue(ptr *types.Serializable) {
+	iter.observed = true
+	iter.ObjIterator.ObjValue(ptr)
+}
+
+func (iter *trackedIterator) Close() {
+	iter.rs.ranges = append(iter.rs.ranges, iter.readRange())
+	iter.closed = true
+	iter.ObjIterator.Close()
+}
+
+// An exhausted iterator has read the whole domain. Otherwise, it has read the keys it has passed,
+// and also the current key if observed.
+func (iter *trackedIterator) readRange() keyRange {
+	if !iter.ObjIterator.Valid() {
+		return keyRange{start: iter.start, end: iter.end}
+	}
+	curr := append([]byte{}, iter.ObjIterator.Key()...)
+	if iter.ascending {
+		if iter.observed {
+			curr = append(curr, 0)
+		}
+		return keyRange{start: iter.start, end: curr}
+	}
+	if !iter.observed {
+		curr = append(curr, 0)
+	}
+	return keyRange{start: curr, end: iter.end}
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConflictDetection(t *testing.T) {
+	root := NewMockRootStore()
+	trunk := root.GetTrunkStore().(*TrunkStore)
+	ms0 := trunk.Cached()
+	ms0.Set([]byte("k1"), []byte("v1"))
+	ms0.Set([]byte("k5"), []byte("v5"))
+	ms0.Close(true)
+
+	ms1 := trunk.Cached() // the write-backs without OCC are also logged
+	ms2 := trunk.CachedWithOCC()
+	ms3 := trunk.CachedWithOCC()
+	ms4 := trunk.CachedWithOCC()
+	ms5 := trunk.Cached()
+	assert.Equal(t, []byte("v1"), ms5.Get([]byte("k1")))
+	assert.Equal(t, []byte("v1"), ms2.Get([]byte("k1")))
+	ms2.Set([]byte("k2"), []byte("v2"))
+	iter := ms3.Iterator([]byte("k3"), []byte("k9"))
+	assert.Equal(t, []byte("k5"), iter.Key())
+	iter.Close()
+	iter = ms4.ReverseIterator([]byte("k0"), []byte("k4"))
+	assert.True(t, iter.Valid()) // k1 is not observed, so only [k1+0x00, k4) is read
+	iter.Close()
+
+	ms1.Set([]byte("k1"), []byte("v1'"))
+	ms1.Set([]byte("k4"), []byte("v4"))
+	assert.Nil(t, ms1.TryClose(true))
+
+	err := ms2.TryClose(true)
+	var conflict *ConflictError
+	assert.True(t, errors.Is(err, ErrConflict))
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, []byte("k1"), conflict.Key)
+	assert.Panics(t, func() { ms3.Close(true) }) // k4 is inserted into the range it read
+	assert.Nil(t, ms4.TryClose(true))
+	ms5.Set([]byte("k6"), []byte("v6"))
+	assert.Nil(t, ms5.TryClose(true)) // no conflict is checked without OCC
+
+	trunk.Close(true)
+	assert.Equal(t, []byte("v1'"), root.Get([]byte("k1")))
+	assert.Nil(t, root.Get([]byte("k2")))
+	assert.Equal(t, []byte("v6"), root.Get([]byte("k6")))
+}
@@ -3,12 +3,15 @@ package store
 import (
 	"bytes"
 
+	"github.com/coinexchain/onvakv/store/codec"
 	"github.com/coinexchain/onvakv/store/types"
+	onvakvtypes "github.com/coinexchain/onvakv/types"
 )
 
 type PrefixedStore struct {
 	parent *MultiStore
 	prefix []byte
+	codecs *codec.Registry // nil means codec.DefaultRegistry()
 }
 
 var _ types.KObjStore = PrefixedStore{}
@@ -35,6 +38,54 @@ func (s PrefixedStore) key(key []byte) (res []byte) {
 	return
 }
 
+// Use reg to find the codecs for GetTyped and SetTyped. The codecs are looked up with
+// the full keys, i.e., the keys with the prefix of this store.
+func (s PrefixedStore) WithCodecs(reg *codec.Registry) PrefixedStore {
+	s.codecs = reg
+	return s
+}
+
+func (s PrefixedStore) registry() *codec.Registry {
+	if s.codecs == nil {
+		return codec.DefaultRegistry()
+	}
+	return s.codecs
+}
+
+// Decode the value of key into ptr, which must point to the type registered for key.
+// It returns false if key does not exist, and panics if the value can not be decoded.
+func (s PrefixedStore) GetTyped(key []byte, ptr interface{}) bool {
+	fullKey := s.key(key)
+	bz := s.parent.Get(fullKey)
+	if bz == nil {
+		return false
+	}
+	if err := s.registry().Unmarshal(fullKey, bz, ptr); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+// Encode v with the codec registered for key and set the result as key's value
+func (s PrefixedStore) SetTyped(key []byte, v interface{}) {
+	if err := s.TrySetTyped(key, v); err != nil {
+		panic(err)
+	}
+}
+
+// Like SetTyped, but returns an error instead of panicking
+func (s PrefixedStore) TrySetTyped(key []byte, v interface{}) error {
+	if key == nil {
+		return onvakvtypes.NewKVError(onvakvtypes.ErrEmptyKey, key, 0, 0)
+	}
+	fullKey := s.key(key)
+	bz, err := s.registry().Marshal(fullKey, v)
+	if err != nil {
+		return err
+	}
+	return s.parent.TrySet(fullKey, bz)
+}
+
 // Implements KObjStore
 func (s PrefixedStore) Get(key []byte) []byte {
 	res := s.parent.Get(s.key(key))
@@ -77,6 +128,78 @@ func (s PrefixedStore) Delete(key []byte) {
 	s.parent.Delete(s.key(key))
 }
 
+// Implements KObjStore
+func (s PrefixedStore) TrySet(key, value []byte) error {
+	if value == nil {
+		return onvakvtypes.NewKVError(onvakvtypes.ErrNilValue, key, 0, 0)
+	}
+	if key == nil {
+		return onvakvtypes.NewKVError(onvakvtypes.ErrEmptyKey, key, 0, 0)
+	}
+	return s.parent.TrySet(s.key(key), value)
+}
+
+// Implements KObjStore
+func (s PrefixedStore) TrySetObj(key []byte, obj types.Serializable) error {
+	if obj == nil {
+		return onvakvtypes.NewKVError(onvakvtypes.ErrNilValue, key, 0, 0)
+	}
+	if key == nil {
+		return onvakvtypes.NewKVError(onvakvtypes.ErrEmptyKey, key, 0, 0)
+	}
+	return s.parent.TrySetObj(s.key(key), obj)
+}
+
+// Implements KObjStore
+func (s PrefixedStore) TryDelete(key []byte) error {
+	if key == nil {
+		return onvakvtypes.NewKVError(onvakvtypes.ErrEmptyKey, key, 0, 0)
+	}
+	return s.parent.TryDelete(s.key(key))
+}
+
+// Delete the keys in [start, end) of this store. It panics with *onvakv/types.KVError on an
+// invalid range.
+func (s PrefixedStore) DeleteRange(start, end []byte) {
+	if err := s.TryDeleteRange(start, end); err != nil {
+		panic(err)
+	}
+}
+
+func (s PrefixedStore) TryDeleteRange(start, end []byte) error {
+	if start == nil || end == nil {
+		return onvakvtypes.NewKVError(onvakvtypes.ErrEmptyKey, start, 0, 0)
+	}
+	return s.parent.TryDeleteRange(s.key(start), s.key(end))
+}
+
+// Delete all the keys of this store
+func (s PrefixedStore) DeleteAll() {
+	if err := s.TryDeleteAll(); err != nil {
+		panic(err)
+	}
+}
+
+func (s PrefixedStore) TryDeleteAll() error {
+	end := prefixEnd(s.prefix)
+	if end == nil {
+		return onvakvtypes.NewKVError(onvakvtypes.ErrKeyOutOfRange, s.prefix, 0, 0)
+	}
+	return s.parent.TryDeleteRange(s.prefix, end)
+}
+
+// The smallest key larger than all the keys with prefix. It is nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
 // Implements KObjStore
 func (s PrefixedStore) Iterator(start, end []byte) types.ObjIterator {
 	if start == nil || end == nil {
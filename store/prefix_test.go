@@ -1,19 +1,20 @@
 package store
 
 import (
+	"errors"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/coinexchain/onvakv"
+	"github.com/coinexchain/onvakv/store/codec"
 	"github.com/coinexchain/onvakv/store/types"
 )
 
 func TestPrefix(t *testing.T) {
-	okv := onvakv.NewOnvaKV4Mock()
 	first := []byte{0}
 	last := []byte{255,255,255,255,255,255}
-	okv.InitGuards(first, last)
+	okv := onvakv.NewOnvaKV4Mock([][]byte{first, last})
 
 	storeKeys := make(map[types.StoreKey]struct{})
 	keyAll := types.NewStrStoreKey("storekey-all","")
@@ -28,7 +29,7 @@ func TestPrefix(t *testing.T) {
 		return false // no cache at all
 	})
 	root.SetHeight(1)
-	ts := root.GetTrunkStore()
+	ts := root.GetTrunkStore().(*TrunkStore)
 
 	tx1Store := ts.Cached()
 	tx2Store := ts.Cached()
@@ -182,3 +183,26 @@ func TestPrefix(t *testing.T) {
 //func (iter *prefixIterator) ObjValue(ptr *types.Serializable) {
 //func (iter *prefixIterator) Close() {
 
+func TestTypedAccessors(t *testing.T) {
+	type Balance struct {
+		Owner  string
+		Amount uint64
+	}
+	reg := codec.NewRegistry()
+	assert.Nil(t, reg.Register([]byte("bank/"), Balance{}, nil))
+	root := NewMockRootStore()
+	trunk := root.GetTrunkStore().(*TrunkStore)
+	ms := trunk.Cached()
+	bank := NewPrefixedStore(ms, []byte("bank/")).WithCodecs(reg)
+
+	var b Balance
+	assert.False(t, bank.GetTyped([]byte("alice"), &b))
+	bank.SetTyped([]byte("alice"), Balance{Owner: "alice", Amount: 100})
+	assert.True(t, bank.GetTyped([]byte("alice"), &b))
+	assert.Equal(t, Balance{Owner: "alice", Amount: 100}, b)
+	err := bank.TrySetTyped([]byte("bob"), &Coord{})
+	assert.True(t, errors.Is(err, codec.ErrTypeMismatch))
+	assert.Panics(t, func() { bank.GetTyped([]byte("alice"), &Coord{}) })
+	ms.Close(true)
+	trunk.Close(true)
+}
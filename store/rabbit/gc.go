@@ -0,0 +1,107 @@
+package rabbit
+
+import (
+	"bytes"
+)
+
+// GCStats tells what a round of Compact has done
+type GCStats struct {
+	Scanned   int // the number of slots scanned
+	Deleted   int // the number of empty slots deleted
+	Relocated int // the number of keys moved to earlier slots in their hopping paths
+}
+
+// The domain of short keys in the TrunkStore. Their first bytes are always odd, and the
+// ordered index's keys, which start with OrderedIndexPrefix, are excluded.
+var (
+	shortKeyStart = []byte{OrderedIndexPrefix + 1}
+	shortKeyEnd   = append(bytes.Repeat([]byte{0xFF}, KeySize), 0)
+)
+
+// Compact is an incremental maintenance routine. It scans at most maxSlots slots in the
+// TrunkStore, starting from the short key start (nil means the beginning), and deletes the
+// empty slots which have no pass-by stones. If relocate is true, a key is also moved to the
+// first empty slot in its hopping path, which shortens the path. The changes are written back
+// when the RabbitStore is closed. It returns the start of the next round, which is nil when
+// all the slots have been scanned.
+func (rabbit RabbitStore) Compact(start []byte, maxSlots int, relocate bool) (next []byte, stats GCStats) {
+	if start == nil {
+		start = shortKeyStart
+	}
+	var slots [][KeySize]byte
+	iter := rabbit.sms.trunk.Iterator(start, shortKeyEnd)
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if len(key) != KeySize || key[0]&0x1 == 0 {
+			continue
+		}
+		if len(slots) == maxSlots {
+			next = append([]byte{}, key...)
+			break
+		}
+		var k [KeySize]byte
+		copy(k[:], key)
+		slots = append(slots, k)
+	}
+	iter.Close()
+
+	for _, k := range slots {
+		stats.Scanned++
+		cv := rabbit.sms.GetCachedValue(k)
+		if cv == nil { // deleted
+			continue
+		}
+		if cv.isEmpty {
+			if cv.passbyNum == 0 {
+				cv.isDeleted = true
+				rabbit.sms.SetCachedValue(k, cv)
+				stats.Deleted++
+			}
+		} else if relocate && cv.obj != nil && rabbit.relocate(cv.key) {
+			stats.Relocated++
+		}
+	}
+	return
+}
+
+// Move key to the first empty slot in its hopping path, and remove the pass-by stones it left
+// in the later slots. Returns false if there is no such empty slot.
+func (rabbit RabbitStore) relocate(key []byte) bool {
+	_, path, status, _ := rabbit.find(key, true)
+	if status != Exists {
+		return false
+	}
+	last := len(path) - 1
+	j := 0
+	for ; j < last; j++ {
+		if rabbit.sms.MustGetCachedValue(path[j]).isEmpty {
+			break
+		}
+	}
+	if j == last {
+		return false
+	}
+	old := rabbit.sms.MustGetCachedValue(path[last])
+	cv := rabbit.sms.MustGetCachedValue(path[j])
+	cv.key = old.key
+	cv.obj = old.obj
+	cv.isEmpty = false
+	cv.passbyNum--
+	rabbit.sms.SetCachedValue(path[j], cv)
+	for _, k := range path[j+1 : last] {
+		cv := rabbit.sms.MustGetCachedValue(k)
+		cv.passbyNum--
+		if cv.passbyNum == 0 && cv.isEmpty {
+			cv.isDeleted = true
+		}
+		rabbit.sms.SetCachedValue(k, cv)
+	}
+	if old.passbyNum == 0 {
+		old.isDeleted = true
+	} else {
+		old.isEmpty = true
+		old.obj = nil
+	}
+	rabbit.sms.SetCachedValue(path[last], old)
+	return true
+}
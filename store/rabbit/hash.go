@@ -0,0 +1,36 @@
+package rabbit
+
+import (
+	"encoding/binary"
+
+	sha256 "github.com/minio/sha256-simd"
+)
+
+// HashFunc generates the short keys: the first short key of a key is taken from the hash of the
+// key, and the next one is taken from the hash of the previous hash. All the RabbitStores built
+// upon the same RootStore must use the same HashFunc.
+type HashFunc func(data []byte) [32]byte
+
+// SHA256Hash is the default HashFunc. It must be used when the short keys are consensus-critical,
+// because it is hard for adversaries to find keys with long hopping paths.
+func SHA256Hash(data []byte) [32]byte {
+	return sha256.Sum256(data)
+}
+
+// FastHash is a non-cryptographic HashFunc based on FNV-1a and splitmix64. It is much faster
+// than SHA256Hash but offers no protection against crafted keys.
+func FastHash(data []byte) (res [32]byte) {
+	h := uint64(14695981039346656037)
+	for _, b := range data {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	for i := 0; i < len(res); i += 8 {
+		h += 0x9E3779B97F4A7C15
+		z := h
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		binary.LittleEndian.PutUint64(res[i:i+8], z^(z>>31))
+	}
+	return
+}
@@ -0,0 +1,82 @@
+package rabbit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/coinexchain/onvakv"
+)
+
+// Proof proves a key's value, or its absence, in RabbitStore. It contains an OnvaKV proof for
+// each slot the rabbit hops to: the slots passed by are proven to exist, and the last slot is
+// proven to contain the key, or to be absent or have no pass-by stones.
+type Proof struct {
+	Hops []*onvakv.Proof
+}
+
+// Get the proof of key with the committed state, i.e., the changes which have not been written
+// back to the RootStore are not included. It is checked against the root hash of the RootStore.
+func (rabbit RabbitStore) GetProof(key []byte) (*Proof, error) {
+	hash := rabbit.hash(key)
+	res := &Proof{}
+	for i := 0; i < MaxFindDepth; i++ {
+		k := shortKeyOf(hash)
+		hop, err := rabbit.sms.trunk.GetProof(k[:])
+		if err != nil {
+			return nil, err
+		}
+		res.Hops = append(res.Hops, hop)
+		entry := hop.Entry()
+		if !bytes.Equal(entry.Key, k[:]) { // the slot is absent
+			return res, nil
+		}
+		cv := BytesToCachedValue(entry.Value)
+		if cv == nil || bytes.Equal(cv.key, key) || cv.passbyNum == 0 {
+			return res, nil
+		}
+		hash = rabbit.hash(hash[:])
+	}
+	return nil, fmt.Errorf("%w: MaxFindDepth(%d) for key %X", ErrMaxFindDepth, MaxFindDepth, key)
+}
+
+// Replay the rabbit's hopping with proof, and verify each hop against root
+func VerifyProof(key []byte, proof *Proof, root []byte) (exists bool, value []byte, err error) {
+	return VerifyProofWithHash(key, proof, root, SHA256Hash)
+}
+
+// Like VerifyProof, for the RabbitStores using h to generate the short keys
+func VerifyProofWithHash(key []byte, proof *Proof, root []byte, h HashFunc) (exists bool, value []byte, err error) {
+	hash := h(key)
+	for i, hop := range proof.Hops {
+		last := i == len(proof.Hops)-1
+		k := shortKeyOf(hash)
+		var found bool
+		var bz []byte
+		found, bz, err = onvakv.VerifyProof(k[:], hop, root)
+		if err != nil {
+			return false, nil, err
+		}
+		if !found {
+			if !last {
+				return false, nil, fmt.Errorf("Hop %d is absent but not the last one", i)
+			}
+			return false, nil, nil
+		}
+		cv := BytesToCachedValue(bz)
+		if cv == nil {
+			return false, nil, fmt.Errorf("Invalid slot content at hop %d", i)
+		}
+		if bytes.Equal(cv.key, key) || cv.passbyNum == 0 {
+			if !last {
+				return false, nil, fmt.Errorf("Hop %d terminates the hopping but not the last one", i)
+			}
+			if !bytes.Equal(cv.key, key) || cv.isEmpty {
+				return false, nil, nil
+			}
+			return true, cv.obj.([]byte), nil
+		}
+		hash = h(hash[:])
+	}
+	return false, nil, errors.New("The hopping does not terminate")
+}
@@ -2,10 +2,9 @@ package rabbit
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 
-	sha256 "github.com/minio/sha256-simd"
-
 	"github.com/coinexchain/onvakv/store"
 	"github.com/coinexchain/onvakv/store/types"
 )
@@ -18,20 +17,58 @@ const (
 	Exists = 2
 
 	MaxFindDepth = 100
+
+	// The keys of the ordered index start with this byte. The short keys never start with it,
+	// because their first bytes are always odd.
+	OrderedIndexPrefix = byte(0)
 )
 
+// ErrMaxFindDepth is returned when a new key cannot find a slot within MaxFindDepth hops
+var ErrMaxFindDepth = errors.New("max find depth reached")
+
 type RabbitStore struct {
-	sms SimpleMultiStore
+	sms     SimpleMultiStore
+	indexed [][]byte // the prefixes of the keys which have ordered index
+	hash    HashFunc
 }
 
 func NewRabbitStore(trunk *store.TrunkStore) (rabbit RabbitStore) {
 	rabbit.sms = SimpleMultiStore{
-		cache: NewSimpleCacheStore(),
-		trunk: trunk,
+		cache:    NewSimpleCacheStore(),
+		trunk:    trunk,
+		idxCache: store.NewCacheStore(),
 	}
+	rabbit.hash = SHA256Hash
 	return
 }
 
+// Use h, instead of SHA256Hash, to generate the short keys
+func (rabbit RabbitStore) WithHash(h HashFunc) RabbitStore {
+	rabbit.hash = h
+	return rabbit
+}
+
+// Maintain an ordered index for the keys with the given prefixes, so they can be iterated.
+// The same prefixes must be used by all the RabbitStores built upon the same RootStore;
+// otherwise the index would miss some keys.
+func (rabbit RabbitStore) WithOrderedIndex(prefixes ...[]byte) RabbitStore {
+	rabbit.indexed = prefixes
+	return rabbit
+}
+
+func (rabbit RabbitStore) isIndexed(key []byte) bool {
+	for _, prefix := range rabbit.indexed {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func indexKey(key []byte) []byte {
+	return append([]byte{OrderedIndexPrefix}, key...)
+}
+
 func (rabbit RabbitStore) ScanAllShortKeys(fn func(key [KeySize]byte) bool) {
 	rabbit.sms.cache.ScanAllShortKeys(fn)
 }
@@ -39,18 +76,18 @@ func (rabbit RabbitStore) ScanAllShortKeys(fn func(key [KeySize]byte) bool) {
 var _ types.MultiStoreI = &RabbitStore{}
 
 func (rabbit RabbitStore) Has(key []byte) bool {
-	_, _, status := rabbit.find(key, true)
+	_, _, status, _ := rabbit.find(key, true)
 	return status == Exists
 }
 
 func (rabbit RabbitStore) GetShortKeyPath(key []byte) (path [][KeySize]byte, ok bool) {
-	_, path, status := rabbit.find(key, true)
+	_, path, status, _ := rabbit.find(key, true)
 	ok = status == Exists
 	return
 }
 
 func (rabbit RabbitStore) Get(key []byte) []byte {
-	cv, _, status := rabbit.find(key, true)
+	cv, _, status, _ := rabbit.find(key, true)
 	if status != Exists {
 		return nil
 	}
@@ -70,7 +107,7 @@ func (rabbit RabbitStore) GetReadOnlyObj(key []byte, ptr *types.Serializable) {
 }
 
 func (rabbit RabbitStore) getObjHelper(readonly bool, key []byte, ptr *types.Serializable) {
-	cv, _, status := rabbit.find(key, true)
+	cv, _, status, _ := rabbit.find(key, true)
 	if status != Exists {
 		*ptr = nil
 		return
@@ -88,13 +125,16 @@ func (rabbit RabbitStore) getObjHelper(readonly bool, key []byte, ptr *types.Ser
 	}
 }
 
-func (rabbit RabbitStore) find(key []byte, earlyExit bool) (cv *CachedValue, path [][KeySize]byte, status int) {
+// Follow the hopping path of key. Without earlyExit, the path ends at the key or a free slot, and
+// ErrMaxFindDepth is returned if no such slot is found within MaxFindDepth hops. With earlyExit,
+// the path also ends at a slot with no pass-by stones; and since a key is never stored beyond
+// MaxFindDepth hops, reaching MaxFindDepth just means the key is not found.
+func (rabbit RabbitStore) find(key []byte, earlyExit bool) (cv *CachedValue, path [][KeySize]byte, status int, err error) {
 	var k [KeySize]byte
-	hash := sha256.Sum256(key)
+	hash := rabbit.hash(key)
 	status = NotFount
 	for i := 0; i < MaxFindDepth; i++ {
-		copy(k[:], hash[:])
-		k[0] = k[0] | 0x1 // force the MSB to 1
+		k = shortKeyOf(hash)
 		path = append(path, k)
 		cv = rabbit.sms.GetCachedValue(k)
 		if cv == nil {
@@ -109,27 +149,55 @@ func (rabbit RabbitStore) find(key []byte, earlyExit bool) (cv *CachedValue, pat
 		} else if earlyExit && cv.passbyNum == 0 {
 			return
 		} else {
-			hash = sha256.Sum256(hash[:])
+			hash = rabbit.hash(hash[:])
 		}
 	}
-	panic(fmt.Sprintf("MaxFindDepth(%d) reached!", MaxFindDepth))
+	if earlyExit {
+		return nil, path, NotFount, nil
+	}
+	return nil, path, NotFount, fmt.Errorf("%w: MaxFindDepth(%d) for key %X", ErrMaxFindDepth, MaxFindDepth, key)
+}
+
+func shortKeyOf(hash [32]byte) (k [KeySize]byte) {
+	copy(k[:], hash[:])
+	k[0] = k[0] | 0x1 // force the MSB to 1
+	return
 }
 
 func (rabbit RabbitStore) Set(key []byte, bz []byte) {
-	rabbit.setHelper(key, bz)
+	if err := rabbit.setHelper(key, bz); err != nil {
+		panic(err)
+	}
 }
 
 func (rabbit RabbitStore) SetObj(key []byte, obj types.Serializable) {
-	rabbit.setHelper(key, obj)
+	if err := rabbit.setHelper(key, obj); err != nil {
+		panic(err)
+	}
+}
+
+// Like Set, but returns ErrMaxFindDepth instead of panicking, if the key cannot be stored
+func (rabbit RabbitStore) TrySet(key []byte, bz []byte) error {
+	return rabbit.setHelper(key, bz)
 }
 
-func (rabbit RabbitStore) setHelper(key []byte, obj interface{}) {
-	_, path, status := rabbit.find(key, false)
+func (rabbit RabbitStore) TrySetObj(key []byte, obj types.Serializable) error {
+	return rabbit.setHelper(key, obj)
+}
+
+func (rabbit RabbitStore) setHelper(key []byte, obj interface{}) error {
+	_, path, status, err := rabbit.find(key, false)
+	if err != nil {
+		return err
+	}
 	if status == Exists { //change
 		cv := rabbit.sms.MustGetCachedValue(path[len(path)-1])
 		cv.obj = obj
 		rabbit.sms.SetCachedValue(path[len(path)-1], cv)
-		return
+		return nil
+	}
+	if rabbit.isIndexed(key) {
+		rabbit.sms.SetIndex(indexKey(key), true)
 	}
 	if status == EmptySlot { //overwrite
 		cv := rabbit.sms.MustGetCachedValue(path[len(path)-1])
@@ -151,13 +219,17 @@ func (rabbit RabbitStore) setHelper(key []byte, obj interface{}) {
 		cv.passbyNum++
 		rabbit.sms.SetCachedValue(k, cv)
 	}
+	return nil
 }
 
 func (rabbit RabbitStore) Delete(key []byte) {
-	_, path, status := rabbit.find(key, true)
+	_, path, status, _ := rabbit.find(key, true)
 	if status != Exists {
 		return
 	}
+	if rabbit.isIndexed(key) {
+		rabbit.sms.SetIndex(indexKey(key), false)
+	}
 	cv := rabbit.sms.MustGetCachedValue(path[len(path)-1])
 	if cv.passbyNum == 0 { // can delete it
 		cv.isDeleted = true
@@ -183,11 +255,78 @@ func (rabbit RabbitStore) ActiveCount() int {
 	return rabbit.sms.trunk.ActiveCount()
 }
 
+// Iterate over [start, end), which must be covered by one of the prefixes with ordered index
 func (rabbit RabbitStore) Iterator(start, end []byte) types.ObjIterator {
-	panic("Not Implemented")
+	return rabbit.newIterator(start, end, true)
 }
 
 func (rabbit RabbitStore) ReverseIterator(start, end []byte) types.ObjIterator {
-	panic("Not Implemented")
+	return rabbit.newIterator(start, end, false)
+}
+
+func (rabbit RabbitStore) newIterator(start, end []byte, ascending bool) types.ObjIterator {
+	covered := false
+	for _, prefix := range rabbit.indexed {
+		if bytes.HasPrefix(start, prefix) && bytes.Compare(end, prefixEnd(prefix)) <= 0 {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		panic("Not Implemented: the range is not covered by an ordered index")
+	}
+	return &rabbitIterator{
+		rabbit: rabbit,
+		iter:   rabbit.sms.IndexIterator(indexKey(start), indexKey(end), ascending),
+		start:  start,
+		end:    end,
+	}
+}
+
+// The smallest key larger than all the keys with prefix. It is nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// rabbitIterator iterates the ordered index, and reads the values with the rabbits' hopping
+type rabbitIterator struct {
+	rabbit     RabbitStore
+	iter       types.ObjIterator
+	start, end []byte
+}
+
+func (iter *rabbitIterator) Domain() (start []byte, end []byte) {
+	return iter.start, iter.end
+}
+
+func (iter *rabbitIterator) Valid() bool {
+	return iter.iter.Valid()
+}
+
+func (iter *rabbitIterator) Next() {
+	iter.iter.Next()
+}
+
+func (iter *rabbitIterator) Key() []byte {
+	return iter.iter.Key()[1:]
+}
+
+func (iter *rabbitIterator) Value() []byte {
+	return iter.rabbit.Get(iter.Key())
+}
+
+func (iter *rabbitIterator) ObjValue(ptr *types.Serializable) {
+	iter.rabbit.GetReadOnlyObj(iter.Key(), ptr)
+}
+
+func (iter *rabbitIterator) Close() {
+	iter.iter.Close()
 }
 
@@ -2,14 +2,18 @@ package rabbit
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"testing"
 
 	"github.com/coinexchain/randsrc"
+	"github.com/stretchr/testify/assert"
 
+	"github.com/coinexchain/onvakv"
 	"github.com/coinexchain/onvakv/store"
+	storetypes "github.com/coinexchain/onvakv/store/types"
 )
 
 // go test -c -coverpkg github.com/coinexchain/onvakv/store/rabbit .
@@ -28,7 +32,7 @@ type FuzzConfig struct {
 	WritebackInterval int
 }
 
-func FuzzSet(cfg *FuzzConfig, rs randsrc.RandSrc, refMap map[[KeyLen]byte][]byte, rbt RabbitStore) {
+func fuzzSet(cfg *FuzzConfig, rs randsrc.RandSrc, refMap map[[KeyLen]byte][]byte, rbt RabbitStore) {
 	var key [KeyLen]byte
 	for i:=0; i<cfg.RunSteps; i++ {
 		copy(key[:], rs.GetBytes(KeyLen))
@@ -38,7 +42,7 @@ func FuzzSet(cfg *FuzzConfig, rs randsrc.RandSrc, refMap map[[KeyLen]byte][]byte
 	}
 }
 
-func FuzzModify(cfg *FuzzConfig, rs randsrc.RandSrc, refMap map[[KeyLen]byte][]byte, rbt RabbitStore) {
+func fuzzModify(cfg *FuzzConfig, rs randsrc.RandSrc, refMap map[[KeyLen]byte][]byte, rbt RabbitStore) {
 	finishedSteps := 0
 	skippedEntries := 0
 	toBeSkipped := int(rs.GetUint64()) % len(refMap) - cfg.RunSteps
@@ -113,11 +117,11 @@ func RunFuzz(cfg *FuzzConfig, roundCount int, randFilename string) {
 		}
 		if len(refMap) < cfg.MaxSize {
 			//fmt.Printf("FuzzSet\n")
-			FuzzSet(cfg, rs, refMap, rbt)
+			fuzzSet(cfg, rs, refMap, rbt)
 		}
 		if len(refMap) > cfg.MinSize {
 			//fmt.Printf("FuzzModify\n")
-			FuzzModify(cfg, rs, refMap, rbt)
+			fuzzModify(cfg, rs, refMap, rbt)
 		}
 		if i % cfg.CompareInterval == 0 {
 			//fmt.Printf("RunCompare\n")
@@ -167,3 +171,170 @@ func Test1(t *testing.T) {
 	runTest(cfg)
 }
 
+func TestRabbitOrderedIndex(t *testing.T) {
+	root := store.NewMockRootStore()
+	trunk := root.GetTrunkStore().(*store.TrunkStore)
+	rbt := NewRabbitStore(trunk).WithOrderedIndex([]byte("sys/"))
+	for _, k := range []string{"sys/c", "sys/a", "sys/d", "evm/x"} {
+		rbt.Set([]byte(k), []byte("v"+k))
+	}
+	rbt.Close(true)
+	trunk.Close(true)
+
+	trunk = root.GetTrunkStore().(*store.TrunkStore)
+	rbt = NewRabbitStore(trunk).WithOrderedIndex([]byte("sys/"))
+	rbt.Delete([]byte("sys/d"))
+	rbt.Set([]byte("sys/b"), []byte("vsys/b"))
+	rbt.Set([]byte("sys/a"), []byte("vsys/a'"))
+	scan := func(iter storetypes.ObjIterator) (res []string) {
+		for ; iter.Valid(); iter.Next() {
+			res = append(res, string(iter.Key())+"="+string(iter.Value()))
+		}
+		iter.Close()
+		return
+	}
+	assert.Equal(t, []string{"sys/a=vsys/a'", "sys/b=vsys/b", "sys/c=vsys/c"},
+		scan(rbt.Iterator([]byte("sys/"), []byte("sys0"))))
+	assert.Equal(t, []string{"sys/c=vsys/c", "sys/b=vsys/b"},
+		scan(rbt.ReverseIterator([]byte("sys/b"), []byte("sys/z"))))
+	assert.Panics(t, func() { rbt.Iterator([]byte("evm/"), []byte("evm0")) })
+	rbt.Close(true)
+	trunk.Close(true)
+
+	trunk = root.GetTrunkStore().(*store.TrunkStore)
+	rbt = NewRabbitStore(trunk).WithOrderedIndex([]byte("sys/"))
+	assert.Equal(t, []string{"sys/a=vsys/a'", "sys/b=vsys/b", "sys/c=vsys/c"},
+		scan(rbt.Iterator([]byte("sys/"), []byte("sys0"))))
+	assert.Equal(t, []byte("vevm/x"), rbt.Get([]byte("evm/x")))
+	rbt.Close(false)
+	trunk.Close(false)
+}
+
+func TestRabbitProof(t *testing.T) {
+	dirName := "./rabbitproof"
+	os.RemoveAll(dirName)
+	okv, err := onvakv.NewOnvaKV(dirName, false, [][]byte{{0}, {255, 255, 255, 255, 255, 255, 255, 255}})
+	assert.Nil(t, err)
+	root := store.NewRootStore(okv, nil, func(k []byte) bool { return false })
+	root.SetHeight(0)
+	trunk := root.GetTrunkStore().(*store.TrunkStore)
+	rbt := NewRabbitStore(trunk)
+	for i := 0; i < 100; i++ {
+		rbt.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	rbt.Close(true)
+	trunk.Close(true)
+
+	trunk = root.GetTrunkStore().(*store.TrunkStore)
+	rbt = NewRabbitStore(trunk)
+	rootHash := root.GetRootHash()
+	proof, err := rbt.GetProof([]byte("key7"))
+	assert.Nil(t, err)
+	exists, value, err := VerifyProof([]byte("key7"), proof, rootHash)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, []byte("value7"), value)
+	_, _, err = VerifyProof([]byte("key8"), proof, rootHash)
+	assert.NotNil(t, err)
+	_, _, err = VerifyProof([]byte("key7"), proof, make([]byte, 32))
+	assert.NotNil(t, err)
+
+	proof, err = rbt.GetProof([]byte("nokey"))
+	assert.Nil(t, err)
+	exists, _, err = VerifyProof([]byte("nokey"), proof, rootHash)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	_, _, err = VerifyProof([]byte("nokey"), &Proof{}, rootHash)
+	assert.NotNil(t, err)
+
+	_, err = NewRabbitStore(store.NewMockRootStore().GetTrunkStore().(*store.TrunkStore)).GetProof([]byte("key7"))
+	assert.True(t, errors.Is(err, onvakv.ErrProofUnavailable))
+	trunk.Close(false)
+	root.Close()
+	os.RemoveAll(dirName)
+}
+
+func TestRabbitHashAndStats(t *testing.T) {
+	root := store.NewMockRootStore()
+	trunk := root.GetTrunkStore().(*store.TrunkStore)
+	rbt := NewRabbitStore(trunk).WithHash(FastHash)
+	for i := 0; i < 100; i++ {
+		rbt.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	assert.Equal(t, []byte("value42"), rbt.Get([]byte("key42")))
+	stats := rbt.Stats()
+	assert.Equal(t, 100, stats.Keys)
+	assert.Equal(t, 0, stats.EmptySlots)
+	sum := 0
+	for hops, count := range stats.Hops {
+		assert.True(t, hops >= 1 && hops <= stats.MaxHops)
+		sum += count
+	}
+	assert.Equal(t, 100, sum)
+	rbt.Close(false)
+
+	// with a degenerate hash, all the keys hop to the same slot
+	rbt = NewRabbitStore(trunk).WithHash(func([]byte) (h [32]byte) { return })
+	assert.Nil(t, rbt.TrySet([]byte("a"), []byte("1")))
+	err := rbt.TrySet([]byte("b"), []byte("2"))
+	assert.True(t, errors.Is(err, ErrMaxFindDepth))
+	assert.False(t, rbt.Has([]byte("b")))
+	assert.Nil(t, rbt.Get([]byte("b")))
+	assert.Panics(t, func() { rbt.Set([]byte("b"), []byte("2")) })
+	stats = rbt.Stats()
+	assert.Equal(t, 1, stats.Keys)
+	assert.Equal(t, map[int]int{1: 1}, stats.Hops)
+	assert.Equal(t, map[uint64]int{0: 1}, stats.Passby)
+	rbt.Close(false)
+	trunk.Close(false)
+}
+
+func TestRabbitCompact(t *testing.T) {
+	// all the keys share the same hopping path
+	chainHash := func(data []byte) [32]byte {
+		if len(data) != 32 {
+			data = []byte("start")
+		}
+		return SHA256Hash(data)
+	}
+	root := store.NewMockRootStore()
+	trunk := root.GetTrunkStore().(*store.TrunkStore)
+	rbt := NewRabbitStore(trunk).WithHash(chainHash)
+	for i := 0; i < 4; i++ {
+		rbt.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	assert.Equal(t, 4, rbt.Stats().MaxHops)
+	rbt.Delete([]byte("key0"))
+	rbt.Delete([]byte("key3"))
+	rbt.Close(true)
+
+	rbt = NewRabbitStore(trunk).WithHash(chainHash)
+	next, stats := rbt.Compact(nil, 1, false)
+	assert.NotNil(t, next)
+	assert.Equal(t, 1, stats.Scanned)
+	total := stats
+	for next != nil {
+		next, stats = rbt.Compact(next, 1, true)
+		total.Scanned += stats.Scanned
+		total.Relocated += stats.Relocated
+	}
+	assert.Equal(t, 3, total.Scanned) // key3's slot was deleted with it
+	assert.True(t, total.Relocated >= 1) // depends on the order of the slots
+	for i := 1; i < 3; i++ {
+		assert.Equal(t, []byte(fmt.Sprintf("value%d", i)), rbt.Get([]byte(fmt.Sprintf("key%d", i))))
+	}
+	assert.False(t, rbt.Has([]byte("key0")))
+	rbt.Close(true)
+
+	rbt = NewRabbitStore(trunk).WithHash(chainHash)
+	_, stats = rbt.Compact(nil, 100, true)
+	assert.Equal(t, 2, stats.Scanned)
+	assert.Equal(t, 0, stats.Relocated)
+	hopStats := rbt.Stats()
+	assert.Equal(t, 2, hopStats.MaxHops)
+	assert.Equal(t, 0, hopStats.EmptySlots)
+	rbt.Set([]byte("key4"), []byte("value4"))
+	assert.Equal(t, []byte("value4"), rbt.Get([]byte("key4")))
+	rbt.Close(false)
+	trunk.Close(false)
+}
@@ -11,6 +11,7 @@ import (
 type SimpleMultiStore struct {
 	cache     *SimpleCacheStore
 	trunk     *store.TrunkStore
+	idxCache  *store.CacheStore // the changed entries of the ordered index
 }
 
 //var WatchedKey = []uint8{0x47, 0x60, 0x3, 0x0, 0x0, 0x0, 0x0, 0x0}
@@ -54,6 +55,24 @@ func (sms *SimpleMultiStore) SetCachedValue(key [KeySize]byte, cv *CachedValue)
 	}
 }
 
+// Add or remove an entry of the ordered index
+func (sms *SimpleMultiStore) SetIndex(key []byte, exists bool) {
+	if exists {
+		sms.idxCache.Set(key, []byte{1}) // a non-empty value, so it is never taken as deleted
+		sms.trunk.PrepareForUpdate(key)
+	} else {
+		sms.idxCache.Delete(key)
+		sms.trunk.PrepareForDeletion(key)
+	}
+}
+
+func (sms *SimpleMultiStore) IndexIterator(start, end []byte, ascending bool) types.ObjIterator {
+	if ascending {
+		return store.NewCacheMergeIterator(sms.trunk.Iterator(start, end), sms.idxCache.Iterator(start, end), true)
+	}
+	return store.NewCacheMergeIterator(sms.trunk.ReverseIterator(start, end), sms.idxCache.ReverseIterator(start, end), false)
+}
+
 func (sms *SimpleMultiStore) Close(writeBack bool) {
 	if writeBack {
 		sms.writeBack()
@@ -69,6 +88,13 @@ func (sms *SimpleMultiStore) writeBack() {
 				cache.Set(key, value)
 			}
 		})
+		sms.idxCache.ScanAllEntries(func(key []byte, obj interface{}, isDeleted bool) {
+			if isDeleted {
+				cache.Delete(key)
+			} else {
+				cache.Set(key, obj.([]byte))
+			}
+		})
 	})
 }
 
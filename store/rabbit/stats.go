@@ -0,0 +1,42 @@
+package rabbit
+
+// HopStats describes the hopping paths of the slots loaded in a RabbitStore's cache
+type HopStats struct {
+	Keys       int            // the number of keys
+	EmptySlots int            // the number of slots which are kept only for their pass-by stones
+	MaxHops    int            // the length of the longest hopping path
+	Hops       map[int]int    // hopping path length -> the number of keys
+	Passby     map[uint64]int // pass-by stone count -> the number of slots
+	PassbySum  uint64         // the total number of pass-by stones
+}
+
+// Collect the statistics of the slots found by ScanAllShortKeys, i.e., the ones in the cache
+func (rabbit RabbitStore) Stats() (stats HopStats) {
+	stats.Hops = make(map[int]int)
+	stats.Passby = make(map[uint64]int)
+	var keys [][]byte
+	rabbit.ScanAllShortKeys(func(k [KeySize]byte) bool {
+		cv := rabbit.sms.GetCachedValue(k)
+		if cv == nil { // deleted
+			return false
+		}
+		stats.Passby[cv.passbyNum]++
+		stats.PassbySum += cv.passbyNum
+		if cv.isEmpty {
+			stats.EmptySlots++
+		} else {
+			keys = append(keys, cv.key)
+		}
+		return false
+	})
+	// find may load more slots into the cache, so it is not called during the scan
+	for _, key := range keys {
+		_, path, _, _ := rabbit.find(key, true)
+		stats.Keys++
+		stats.Hops[len(path)]++
+		if len(path) > stats.MaxHops {
+			stats.MaxHops = len(path)
+		}
+	}
+	return
+}
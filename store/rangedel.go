@@ -0,0 +1,61 @@
+package store
+
+import (
+	"github.com/coinexchain/onvakv/store/types"
+)
+
+// The ranges deleted by DeleteRange in a cache layer (MultiStore or TrunkStore). The cached
+// entries in a range are removed when it is deleted, and the keys of the parent in the ranges
+// are hidden, so the entries cached after the deletion shadow the ranges.
+type deletedRanges []keyRange
+
+func (d deletedRanges) contains(key []byte) bool {
+	for _, r := range d {
+		if r.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the entries in [start, end) from cache, and return their keys
+func (cs *CacheStore) removeRange(start, end []byte) (keys [][]byte) {
+	iter := cs.Iterator(start, end)
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, append([]byte{}, iter.Key()...))
+	}
+	iter.Close()
+	for _, key := range keys {
+		cs.bt.Delete(key)
+	}
+	return
+}
+
+// rangeSkipIterator hides the keys of its parent in the deleted ranges
+type rangeSkipIterator struct {
+	types.ObjIterator
+	ranges deletedRanges
+}
+
+func newRangeSkipIterator(iter types.ObjIterator, ranges deletedRanges) types.ObjIterator {
+	if len(ranges) == 0 {
+		return iter
+	}
+	res := &rangeSkipIterator{
+		ObjIterator: iter,
+		ranges:      append(deletedRanges{}, ranges...), // later deletions do not affect it
+	}
+	res.skip()
+	return res
+}
+
+func (iter *rangeSkipIterator) Next() {
+	iter.ObjIterator.Next()
+	iter.skip()
+}
+
+func (iter *rangeSkipIterator) skip() {
+	for iter.ObjIterator.Valid() && iter.ranges.contains(iter.ObjIterator.Key()) {
+		iter.ObjIterator.Next()
+	}
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/coinexchain/onvakv"
+	"github.com/coinexchain/onvakv/store/types"
+	onvakvtypes "github.com/coinexchain/onvakv/types"
+)
+
+func TestDeleteRange(t *testing.T) {
+	dirName := "./deleterange"
+	os.RemoveAll(dirName)
+	okv, err := onvakv.NewOnvaKV(dirName, false, [][]byte{{0}, {255, 255, 255, 255, 255, 255, 255, 255}})
+	assert.Nil(t, err)
+	realRoot := NewRootStore(okv, nil, func(k []byte) bool { return false })
+	for _, root := range []types.RootStoreI{NewMockRootStore(), realRoot} {
+		testDeleteRange(t, root)
+	}
+	realRoot.Close()
+	os.RemoveAll(dirName)
+}
+
+func testDeleteRange(t *testing.T, root types.RootStoreI) {
+	getKeys := func(iter types.ObjIterator) (keys []string) {
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return
+	}
+	root.SetHeight(1)
+	trunk := root.GetTrunkStore().(*TrunkStore)
+	ms := trunk.Cached()
+	for _, key := range []string{"a1", "a2", "a3", "a4", "a5", "b1"} {
+		ms.Set([]byte(key), []byte("v"+key))
+	}
+	ms.Close(true)
+	trunk.Close(true)
+
+	root.SetHeight(2)
+	trunk = root.GetTrunkStore().(*TrunkStore)
+	reader := trunk.CachedWithOCC()
+	assert.Equal(t, []byte("va4"), reader.Get([]byte("a4")))
+	ms = trunk.Cached()
+	ms.Set([]byte("a2"), []byte("x"))
+	ms.Set([]byte("a6"), []byte("va6"))
+	sp := ms.Savepoint()
+	ms.DeleteRange([]byte("a2"), []byte("a5"))
+	assert.Nil(t, ms.Get([]byte("a2")))
+	assert.False(t, ms.Has([]byte("a3")))
+	assert.Equal(t, []string{"a1", "a5", "a6"}, getKeys(ms.Iterator([]byte("a"), []byte("b"))))
+	ms.RollbackTo(sp)
+	assert.Equal(t, []byte("x"), ms.Get([]byte("a2")))
+	assert.Equal(t, []byte("va3"), ms.Get([]byte("a3")))
+	ms.DeleteRange([]byte("a2"), []byte("a5"))
+	ms.Set([]byte("a3"), []byte("new"))
+	assert.Equal(t, []string{"a5", "a3", "a1"}, getKeys(ms.ReverseIterator([]byte("a"), []byte("a6"))))
+	assert.True(t, errors.Is(ms.TryDeleteRange([]byte{}, []byte("a")), onvakvtypes.ErrEmptyKey))
+	ms.Close(true)
+	assert.True(t, errors.Is(reader.TryClose(true), ErrConflict)) // it read a4
+
+	assert.Nil(t, trunk.Get([]byte("a4")))
+	assert.Equal(t, []string{"a1", "a3", "a5", "a6", "b1"}, getKeys(trunk.Iterator([]byte("a"), []byte("c"))))
+	trunk.DeleteRange([]byte("b"), []byte("c"))
+	assert.Nil(t, trunk.Get([]byte("b1")))
+	trunk.Close(true)
+
+	root.SetHeight(3)
+	trunk = root.GetTrunkStore().(*TrunkStore)
+	assert.Equal(t, []string{"a1", "a3", "a5", "a6"}, getKeys(trunk.Iterator([]byte("a"), []byte("c"))))
+	assert.Equal(t, []byte("new"), trunk.Get([]byte("a3")))
+	ms = trunk.Cached()
+	sub := NewPrefixedStore(ms, []byte("a"))
+	sub.DeleteRange([]byte("1"), []byte("4"))
+	assert.Equal(t, []string{"5", "6"}, getKeys(sub.Iterator([]byte("0"), []byte("9"))))
+	sub.DeleteAll()
+	assert.Nil(t, sub.Get([]byte("5")))
+	ms.Close(true)
+	trunk.Close(true)
+
+	trunk = root.GetTrunkStore().(*TrunkStore)
+	assert.Empty(t, getKeys(trunk.Iterator([]byte("a"), []byte("c"))))
+	trunk.Close(false)
+	root.CheckConsistency()
+}
@@ -8,31 +8,62 @@ import (
 	dbm "github.com/tendermint/tm-db"
 
 	"github.com/coinexchain/onvakv"
+	"github.com/coinexchain/onvakv/logging"
+	"github.com/coinexchain/onvakv/metrics"
 	"github.com/coinexchain/onvakv/store/types"
 )
 
-const CacheSizeLimit = 1024 * 1024
-
 type RootStore struct {
-	cache          map[string]types.Serializable
+	cache          *ObjCache
 	cacheBuf       *sync.Map
 	isCacheableKey func(k []byte) bool
 	okv            *onvakv.OnvaKV
 	height         int64
 	storeKeys      map[types.StoreKey]struct{}
+
+	cacheBytes     metrics.Gauge
+	writeBackTime  metrics.Histogram
+	logger         logging.Logger
 }
 
 var _ types.RootStoreI = &RootStore{}
 
 func NewRootStore(okv *onvakv.OnvaKV, storeKeys map[types.StoreKey]struct{}, isCacheableKey func(k []byte) bool) *RootStore {
-	return &RootStore{
-		cache:          make(map[string]types.Serializable),
+	root := &RootStore{
+		cache:          NewObjCache(DefaultCacheSizeInBytes),
 		cacheBuf:       &sync.Map{},
 		isCacheableKey: isCacheableKey,
 		okv:            okv,
 		height:         -1,
 		storeKeys:      storeKeys,
 	}
+	root.SetMetrics(nil)
+	root.SetLogger(logging.Default())
+	return root
+}
+
+// It does not change the logger used by the underlying OnvaKV.
+func (root *RootStore) SetLogger(logger logging.Logger) {
+	root.logger = logging.OrNop(logger).With("module", "rootstore")
+}
+
+// Let RootStore report its cache statistics and writeback time to reg. It does not
+// change the registry used by the underlying OnvaKV. The TrunkStores created before
+// also report their writeback time to reg.
+func (root *RootStore) SetMetrics(reg metrics.Registry) {
+	reg = metrics.OrNop(reg)
+	root.cache.SetMetrics(reg)
+	root.cacheBytes = reg.NewGauge(metrics.RootStoreCacheBytes)
+	root.writeBackTime = reg.NewHistogram(metrics.TrunkWriteBackSecs)
+}
+
+// Limit the estimated bytes taken by the cached objects. The default is DefaultCacheSizeInBytes.
+func (root *RootStore) SetCacheSize(maxBytes int64) {
+	root.cache.SetMaxBytes(maxBytes)
+}
+
+func (root *RootStore) CacheStats() ObjCacheStats {
+	return root.cache.Stats()
 }
 
 func (root *RootStore) SetHeight(h int64) {
@@ -43,7 +74,7 @@ func (root *RootStore) Get(key []byte) []byte {
 	ok := false
 	var obj types.Serializable
 	if root.isCacheableKey != nil && root.isCacheableKey(key) {
-		obj, ok = root.cache[string(key)]
+		obj, ok = root.cache.Get(key)
 	}
 	if ok {
 		return obj.ToBytes()
@@ -64,10 +95,9 @@ func (root *RootStore) GetReadOnlyObj(key []byte, ptr *types.Serializable) {
 	ok := false
 	var obj types.Serializable
 	if root.isCacheableKey != nil && root.isCacheableKey(key) {
-		obj, ok = root.cache[string(key)]
+		obj, ok = root.cache.Get(key)
 	}
 	if ok {
-		//fmt.Printf("HIT on %#v : %#v\n", key, obj.ToBytes())
 		reflect.ValueOf(ptr).Elem().Set(reflect.ValueOf(obj))
 	} else if bz := root.get(key); bz != nil {
 		(*ptr).FromBytes(bz)
@@ -83,10 +113,9 @@ func (root *RootStore) GetObjCopy(key []byte, ptr *types.Serializable) {
 	ok := false
 	var obj types.Serializable
 	if root.isCacheableKey != nil && root.isCacheableKey(key) {
-		obj, ok = root.cache[string(key)]
+		obj, ok = root.cache.Get(key)
 	}
 	if ok {
-		//fmt.Printf("HIT on %#v : %#v\n", key, obj.ToBytes())
 		newObj := obj.DeepCopy().(types.Serializable)
 		reflect.ValueOf(ptr).Elem().Set(reflect.ValueOf(newObj))
 	} else if bz := root.get(key); bz != nil {
@@ -100,14 +129,37 @@ func (root *RootStore) Has(key []byte) bool {
 	return root.okv.GetEntry(key) != nil
 }
 
+func (root *RootStore) CheckKV(key, value []byte) error {
+	return root.okv.CheckKV(key, value)
+}
+
+func (root *RootStore) CheckRange(start, end []byte) error {
+	return root.okv.CheckRange(start, end)
+}
+
+func (root *RootStore) PrepareForDeleteRange(start, end []byte) {
+	root.okv.PrepareForDeleteRange(start, end)
+}
+
+// PrepareForUpdate, PrepareForDeletion, Set, SetObj and Delete panic with *onvakv/types.KVError
+// on invalid input, before anything is changed. Their Try* counterparts return the error instead.
 func (root *RootStore) PrepareForUpdate(key []byte) {
 	root.okv.PrepareForUpdate(key)
 }
 
+func (root *RootStore) TryPrepareForUpdate(key []byte) error {
+	return root.okv.TryPrepareForUpdate(key)
+}
+
 func (root *RootStore) PrepareForDeletion(key []byte) {
 	root.okv.PrepareForDeletion(key)
 }
 
+func (root *RootStore) TryPrepareForDeletion(key []byte) error {
+	_, err := root.okv.TryPrepareForDeletion(key)
+	return err
+}
+
 func (root *RootStore) Iterator(start, end []byte) types.ObjIterator {
 	return &RootStoreIterator{root: root, iter: root.okv.Iterator(start, end)}
 }
@@ -117,8 +169,9 @@ func (root *RootStore) ReverseIterator(start, end []byte) types.ObjIterator {
 
 func (root *RootStore) BeginWrite() {
 	if root.height < 0 {
-		panic(fmt.Sprintf("Height is not initialized: %", root.height))
+		panic(fmt.Sprintf("Height is not initialized: %d", root.height))
 	}
+	root.logger.Debug("begin write", "height", root.height)
 	root.okv.BeginWrite(root.height)
 	root.cacheBuf.Range(func(key, value interface{}) bool {
 		root.addToCache([]byte(key.(string)), value.(types.Serializable))
@@ -128,31 +181,74 @@ func (root *RootStore) BeginWrite() {
 }
 
 func (root *RootStore) Set(key, value []byte) {
-	root.okv.Set(key, value)
+	if err := root.TrySet(key, value); err != nil {
+		panic(err)
+	}
+}
+
+func (root *RootStore) TrySet(key, value []byte) error {
+	if err := root.okv.TrySet(key, value); err != nil {
+		return err
+	}
 	if root.isCacheableKey != nil && root.isCacheableKey(key) {
-		_, ok := root.cache[string(key)]
+		obj, ok := root.cache.Peek(key)
 		if ok {
-			//fmt.Printf("CACHE-UPDATE on %#v : %#v\n", key, value)
-			root.cache[string(key)].FromBytes(value)
+			obj.FromBytes(value)
+			root.cache.Add(key, obj) // its size may change
 		}
 	}
+	return nil
 }
 
 func (root *RootStore) SetObj(key []byte, obj types.Serializable) {
-	root.okv.Set(key, obj.ToBytes())
+	root.SetSerializedObj(key, obj, obj.ToBytes())
+}
+
+func (root *RootStore) TrySetObj(key []byte, obj types.Serializable) error {
+	return root.trySetSerializedObj(key, obj, obj.ToBytes())
+}
+
+func (root *RootStore) SetSerializedObj(key []byte, obj types.Serializable, bz []byte) {
+	if err := root.trySetSerializedObj(key, obj, bz); err != nil {
+		panic(err)
+	}
+}
+
+func (root *RootStore) trySetSerializedObj(key []byte, obj types.Serializable, bz []byte) error {
+	if err := root.okv.TrySet(key, bz); err != nil {
+		return err
+	}
 	if root.isCacheableKey != nil && root.isCacheableKey(key) {
 		root.addToCache(key, obj)
 	}
+	return nil
 }
 
 func (root *RootStore) Delete(key []byte) {
-	root.okv.Delete(key)
-	delete(root.cache, string(key))
+	if err := root.TryDelete(key); err != nil {
+		panic(err)
+	}
+}
+
+func (root *RootStore) TryDelete(key []byte) error {
+	if err := root.okv.TryDelete(key); err != nil {
+		return err
+	}
+	root.cache.Delete(key)
+	return nil
+}
+
+func (root *RootStore) DeleteRange(start, end []byte) {
+	root.okv.DeleteRange(start, end)
+	root.cache.DeleteRange(start, end)
 }
 
 func (root *RootStore) EndWrite() {
 	root.okv.EndWrite()
 	root.cacheBuf = &sync.Map{}
+	stats := root.cache.Stats()
+	root.cacheBytes.Set(float64(stats.Bytes))
+	root.logger.Debug("end write", "height", root.height, "cacheSize", stats.Count, "cacheBytes", stats.Bytes)
 }
 
 func (root *RootStore) CheckConsistency() {
@@ -160,22 +256,19 @@ func (root *RootStore) CheckConsistency() {
 }
 
 func (root *RootStore) addToCache(key []byte, obj types.Serializable) {
-	if len(root.cache) > CacheSizeLimit {
-		for k := range root.cache {
-			delete(root.cache, k) //remove a random entry
-			break
-		}
-	}
-	//fmt.Printf("CACHE-INSERT on %#v : %#v\n", key, obj.ToBytes())
-	root.cache[string(key)] = obj //.DeepCopy().(types.Serializable) // maybe we do not need deepcopy
+	root.cache.Add(key, obj) //.DeepCopy().(types.Serializable) // maybe we do not need deepcopy
 }
 
 func (root *RootStore) GetTrunkStore() interface{} {
 	return &TrunkStore{
-		cache:     NewCacheStore(),
-		root:      root,
-		storeKeys: root.storeKeys,
-		isWriting: 0,
+		cache:         NewCacheStore(),
+		root:          root,
+		storeKeys:     root.storeKeys,
+		isWriting:     0,
+		writeBackTime: &root.writeBackTime,
+
+		preparedForUpdate:   &sync.Map{},
+		preparedForDeletion: &sync.Map{},
 	}
 }
 
@@ -183,6 +276,11 @@ func (root *RootStore) GetRootHash() []byte {
 	return root.okv.GetRootHash()
 }
 
+// Get the proof of key's existence or absence, which is checked against GetRootHash()
+func (root *RootStore) GetProof(key []byte) (*onvakv.Proof, error) {
+	return root.okv.GetProof(key)
+}
+
 func (root *RootStore) Close() {
 	root.okv.Close()
 	root.cache = nil
@@ -217,7 +315,7 @@ func (iter *RootStoreIterator) ObjValue(ptr *types.Serializable) {
 	ok := false
 	var obj types.Serializable
 	if iter.root.isCacheableKey != nil && iter.root.isCacheableKey(key) {
-		obj, ok = iter.root.cache[string(key)]
+		obj, ok = iter.root.cache.Peek(key)
 	}
 	if ok {
 		reflect.ValueOf(ptr).Elem().Set(reflect.ValueOf(obj)) // Client must use this obj as readonly
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"github.com/coinexchain/onvakv/store/b"
+	"github.com/coinexchain/onvakv/store/types"
+)
+
+// Savepoint marks a state of MultiStore, which can be rolled back to. Savepoints are nested:
+// rolling back to or releasing a savepoint also discards the savepoints taken after it.
+type Savepoint int
+
+// When there are savepoints, the old value of a key in MultiStore's cache is recorded in the
+// journal before it is overwritten, so rolling back costs O(changes). A range deletion is also
+// recorded, after the entries it removed from the cache.
+type journalEntry struct {
+	key     []byte
+	value   b.Value
+	exists  bool
+	isRange bool
+}
+
+// Take a savepoint of the current state
+func (ms *MultiStore) Savepoint() Savepoint {
+	ms.savepoints = append(ms.savepoints, len(ms.journal))
+	return Savepoint(len(ms.savepoints))
+}
+
+// Undo the changes made after sp was taken, and discard sp and the savepoints after it
+func (ms *MultiStore) RollbackTo(sp Savepoint) {
+	ms.checkSavepoint(sp)
+	start := ms.savepoints[sp-1]
+	for i := len(ms.journal) - 1; i >= start; i-- {
+		e := ms.journal[i]
+		if e.isRange {
+			ms.deletedRanges = ms.deletedRanges[:len(ms.deletedRanges)-1]
+			continue
+		}
+		ms.cache.restoreValue(e.key, e.value, e.exists)
+	}
+	ms.journal = ms.journal[:start]
+	ms.releaseFrom(sp)
+}
+
+// Keep the changes made after sp was taken, and discard sp and the savepoints after it
+func (ms *MultiStore) Release(sp Savepoint) {
+	ms.checkSavepoint(sp)
+	ms.releaseFrom(sp)
+}
+
+func (ms *MultiStore) checkSavepoint(sp Savepoint) {
+	if sp <= 0 || int(sp) > len(ms.savepoints) {
+		panic("Invalid Savepoint")
+	}
+}
+
+func (ms *MultiStore) releaseFrom(sp Savepoint) {
+	ms.savepoints = ms.savepoints[:sp-1]
+	if len(ms.savepoints) == 0 {
+		ms.journal = ms.journal[:0]
+	}
+}
+
+// Record key's current value in cache, if there are savepoints
+func (ms *MultiStore) journalKey(key []byte) {
+	if len(ms.savepoints) == 0 {
+		return
+	}
+	v, exists := ms.cache.getValue(key)
+	if sobj, ok := v.GetObj().(types.Serializable); ok {
+		// the object may be changed in place after it is moved out by GetObj
+		v = b.NewSerializedValue(sobj.DeepCopy(), v.GetBytes())
+	}
+	ms.journal = append(ms.journal, journalEntry{
+		key:    append([]byte{}, key...),
+		value:  v,
+		exists: exists,
+	})
+}
+
+// Record the last range deletion, if there are savepoints
+func (ms *MultiStore) journalRange() {
+	if len(ms.savepoints) == 0 {
+		return
+	}
+	ms.journal = append(ms.journal, journalEntry{isRange: true})
+}
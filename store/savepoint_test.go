@@ -0,0 +1,45 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/coinexchain/onvakv/store/types"
+)
+
+func TestSavepoint(t *testing.T) {
+	root := NewMockRootStore()
+	trunk := root.GetTrunkStore().(*TrunkStore)
+	ms := trunk.Cached()
+	ms.Set([]byte("k1"), []byte("v1"))
+	ms.SetObj([]byte("k2"), &Coord{x: 1, y: 1})
+
+	sp1 := ms.Savepoint()
+	ms.Set([]byte("k1"), []byte("v1'"))
+	ms.Set([]byte("k3"), []byte("v3"))
+	var obj types.Serializable = &Coord{}
+	ms.GetObj([]byte("k2"), &obj)
+	obj.(*Coord).x = 2 // changed in place
+	ms.SetObj([]byte("k2"), obj)
+
+	sp2 := ms.Savepoint()
+	ms.Delete([]byte("k1"))
+	assert.Nil(t, ms.Get([]byte("k1")))
+	ms.RollbackTo(sp2)
+	assert.Equal(t, []byte("v1'"), ms.Get([]byte("k1")))
+	assert.Panics(t, func() { ms.Release(sp2) }) // sp2 is discarded
+
+	sp2 = ms.Savepoint()
+	ms.Set([]byte("k4"), []byte("v4"))
+	ms.Release(sp2) // the changes are kept in sp1
+	ms.RollbackTo(sp1)
+	assert.Equal(t, []byte("v1"), ms.Get([]byte("k1")))
+	assert.Equal(t, []byte{1, 0, 0, 0, 1, 0, 0, 0}, ms.Get([]byte("k2")))
+	assert.Nil(t, ms.Get([]byte("k3")))
+	assert.Nil(t, ms.Get([]byte("k4")))
+
+	ms.Close(true)
+	trunk.Close(true)
+	assert.Equal(t, []byte("v1"), root.Get([]byte("k1")))
+	assert.Nil(t, root.Get([]byte("k3")))
+}
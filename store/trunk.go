@@ -1,10 +1,17 @@
 package store
 
 import (
+	"bytes"
+	"runtime"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/dterei/gotsc"
 
+	"github.com/coinexchain/onvakv"
+	"github.com/coinexchain/onvakv/datatree"
+	"github.com/coinexchain/onvakv/metrics"
 	"github.com/coinexchain/onvakv/store/types"
 )
 
@@ -15,21 +22,71 @@ func init() {
 }
 
 // We use a new TrunkStore for every block
+// The keys written to it need not be prepared: writeBack prepares the keys which were not passed
+// to PrepareForUpdate or PrepareForDeletion, before beginning to write the root store.
 type TrunkStore struct {
 	cache     *CacheStore
 	root      types.RootStoreI
 	storeKeys map[types.StoreKey]struct{}
 	isWriting int64
+
+	preparedForUpdate   *sync.Map
+	preparedForDeletion *sync.Map
+
+	deletedRanges deletedRanges
+
+	occMtx   sync.Mutex
+	writeLog []writeRecord // what is written by each write-back of MultiStore
+
+	writeBackTime *metrics.Histogram // points to RootStore's, which may be replaced by SetMetrics
 }
 
 func (ts *TrunkStore) Cached() *MultiStore {
+	return ts.cached(false)
+}
+
+// CachedWithOCC is like Cached, but the returned MultiStore records what it reads from ts, and
+// its TryClose(true) returns a *ConflictError instead of writing back if the write-backs of other
+// MultiStores after its creation have written what it read.
+func (ts *TrunkStore) CachedWithOCC() *MultiStore {
+	return ts.cached(true)
+}
+
+func (ts *TrunkStore) cached(occ bool) *MultiStore {
+	ts.occMtx.Lock()
+	defer ts.occMtx.Unlock()
 	return &MultiStore{
 		cache:     NewCacheStore(),
 		trunk:     ts,
 		storeKeys: ts.storeKeys,
+		readSet:   readSet{enabled: occ},
+		version:   len(ts.writeLog),
 	}
 }
 
+// Write back ms if it does not conflict with the write-backs after its creation, and log its keys.
+// The keys written by every MultiStore are logged, but only the ones created by CachedWithOCC are
+// checked for conflicts.
+func (ts *TrunkStore) writeBackMulti(ms *MultiStore) error {
+	ts.occMtx.Lock()
+	defer ts.occMtx.Unlock()
+	if ms.readSet.enabled {
+		for _, rec := range ts.writeLog[ms.version:] {
+			if key := ms.readSet.findConflict(rec); key != nil {
+				return &ConflictError{Key: append([]byte{}, key...)}
+			}
+		}
+	}
+	var writtenKeys [][]byte
+	ms.cache.ScanAllEntries(func(key []byte, obj interface{}, isDeleted bool) {
+		writtenKeys = append(writtenKeys, key)
+	})
+	rec := writeRecord{keys: writtenKeys, ranges: ms.deletedRanges}
+	ms.writeBack()
+	ts.writeLog = append(ts.writeLog, rec)
+	return nil
+}
+
 func (ts *TrunkStore) Has(key []byte) bool {
 	if atomic.LoadInt64(&ts.isWriting) != 0 {
 		panic("Is Writing")
@@ -41,6 +98,9 @@ func (ts *TrunkStore) Has(key []byte) bool {
 	case types.Hit:
 		return true
 	case types.Missed:
+		if ts.deletedRanges.contains(key) {
+			return false
+		}
 		return ts.root.Has(key)
 	default:
 		panic("Invalid Status")
@@ -58,6 +118,9 @@ func (ts *TrunkStore) Get(key []byte) []byte {
 	case types.Hit:
 		return res
 	case types.Missed:
+		if ts.deletedRanges.contains(key) {
+			return nil
+		}
 		return ts.root.Get(key)
 	default:
 		panic("Invalid Status")
@@ -73,6 +136,10 @@ func (ts *TrunkStore) GetObjCopy(key []byte, ptr *types.Serializable) {
 	case types.JustDeleted:
 		*ptr = nil
 	case types.Missed:
+		if ts.deletedRanges.contains(key) {
+			*ptr = nil
+			return
+		}
 		ts.root.GetObjCopy(key, ptr)
 	}
 }
@@ -86,22 +153,116 @@ func (ts *TrunkStore) GetReadOnlyObj(key []byte, ptr *types.Serializable) {
 	case types.JustDeleted:
 		*ptr = nil
 	case types.Missed:
+		if ts.deletedRanges.contains(key) {
+			*ptr = nil
+			return
+		}
 		ts.root.GetReadOnlyObj(key, ptr)
 	}
 }
 
+func (ts *TrunkStore) CheckKV(key, value []byte) error {
+	return ts.root.CheckKV(key, value)
+}
+
+func (ts *TrunkStore) CheckRange(start, end []byte) error {
+	return ts.root.CheckRange(start, end)
+}
+
+// Delete all the keys in [start, end), which is passed to the root store's PrepareForDeleteRange
+// and DeleteRange when writing back. The keys need not be prepared. It panics with *onvakv/types.KVError on an
+// invalid range.
+func (ts *TrunkStore) DeleteRange(start, end []byte) {
+	if err := ts.TryDeleteRange(start, end); err != nil {
+		panic(err)
+	}
+}
+
+// end must not be nil. Nothing is deleted if start >= end.
+func (ts *TrunkStore) TryDeleteRange(start, end []byte) error {
+	if atomic.LoadInt64(&ts.isWriting) != 0 {
+		panic("Is Writing")
+	}
+	if err := ts.root.CheckRange(start, end); err != nil {
+		return err
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return nil
+	}
+	ts.cache.removeRange(start, end)
+	ts.deletedRanges = append(ts.deletedRanges, keyRange{
+		start: append([]byte{}, start...),
+		end:   append([]byte{}, end...),
+	})
+	return nil
+}
+
+// PrepareForUpdate and PrepareForDeletion panic with *onvakv/types.KVError on an invalid key
 func (ts *TrunkStore) PrepareForUpdate(key []byte) {
+	if err := ts.TryPrepareForUpdate(key); err != nil {
+		panic(err)
+	}
+}
+
+func (ts *TrunkStore) TryPrepareForUpdate(key []byte) error {
 	if atomic.LoadInt64(&ts.isWriting) != 0 {
 		panic("Is Writing")
 	}
-	ts.root.PrepareForUpdate(key)
+	if err := ts.root.TryPrepareForUpdate(key); err != nil {
+		return err
+	}
+	ts.preparedForUpdate.Store(string(key), struct{}{})
+	return nil
 }
 
 func (ts *TrunkStore) PrepareForDeletion(key []byte) {
+	if err := ts.TryPrepareForDeletion(key); err != nil {
+		panic(err)
+	}
+}
+
+func (ts *TrunkStore) TryPrepareForDeletion(key []byte) error {
 	if atomic.LoadInt64(&ts.isWriting) != 0 {
 		panic("Is Writing")
 	}
-	ts.root.PrepareForDeletion(key)
+	if err := ts.root.TryPrepareForDeletion(key); err != nil {
+		return err
+	}
+	ts.preparedForDeletion.Store(string(key), struct{}{})
+	return nil
+}
+
+// Prepare the keys in cache which have not been prepared yet, using all the CPUs
+func (ts *TrunkStore) prepareForWriteBack() {
+	var keys [][]byte
+	var isDeletion []bool
+	ts.cache.ScanAllEntries(func(key []byte, obj interface{}, isDeleted bool) {
+		prepared := ts.preparedForUpdate
+		if isDeleted {
+			prepared = ts.preparedForDeletion
+		}
+		if _, ok := prepared.Load(string(key)); !ok {
+			keys = append(keys, key)
+			isDeletion = append(isDeletion, isDeleted)
+		}
+	})
+	if len(keys) == 0 {
+		return
+	}
+	sharedIdx := int64(-1)
+	datatree.ParrallelRun(runtime.NumCPU(), func(workerID int) {
+		for {
+			myIdx := atomic.AddInt64(&sharedIdx, 1)
+			if myIdx >= int64(len(keys)) {
+				break
+			}
+			if isDeletion[myIdx] {
+				ts.root.PrepareForDeletion(keys[myIdx])
+			} else {
+				ts.root.PrepareForUpdate(keys[myIdx])
+			}
+		}
+	})
 }
 
 func (ts *TrunkStore) Update(updator func(cache *CacheStore)) {
@@ -115,14 +276,16 @@ func (ts *TrunkStore) Iterator(start, end []byte) types.ObjIterator {
 	if atomic.LoadInt64(&ts.isWriting) != 0 {
 		panic("Is Writing")
 	}
-	return newCacheMergeIterator(ts.root.Iterator(start, end), ts.cache.Iterator(start, end), true)
+	parent := newRangeSkipIterator(ts.root.Iterator(start, end), ts.deletedRanges)
+	return newCacheMergeIterator(parent, ts.cache.Iterator(start, end), true)
 }
 
 func (ts *TrunkStore) ReverseIterator(start, end []byte) types.ObjIterator {
 	if atomic.LoadInt64(&ts.isWriting) != 0 {
 		panic("Is Writing")
 	}
-	return newCacheMergeIterator(ts.root.ReverseIterator(start, end), ts.cache.ReverseIterator(start, end), false)
+	parent := newRangeSkipIterator(ts.root.ReverseIterator(start, end), ts.deletedRanges)
+	return newCacheMergeIterator(parent, ts.cache.ReverseIterator(start, end), false)
 }
 
 func (ts *TrunkStore) writeBack() {
@@ -130,12 +293,26 @@ func (ts *TrunkStore) writeBack() {
 	if atomic.AddInt64(&ts.isWriting, 1) != 1 {
 		panic("Conflict During Writing")
 	}
+	if ts.writeBackTime != nil {
+		defer func(startTime time.Time) {
+			(*ts.writeBackTime).Observe(time.Since(startTime).Seconds())
+		}(time.Now())
+	}
+	ts.prepareForWriteBack()
+	for _, r := range ts.deletedRanges {
+		ts.root.PrepareForDeleteRange(r.start, r.end)
+	}
 	ts.root.BeginWrite()
-	ts.cache.ScanAllEntries(func(key []byte, obj interface{}, isDeleted bool) {
+	for _, r := range ts.deletedRanges {
+		ts.root.DeleteRange(r.start, r.end)
+	}
+	ts.cache.scanAllEntriesWithBytes(func(key []byte, obj interface{}, bz []byte, isDeleted bool) {
 		if isDeleted {
 			ts.root.Delete(key)
 		} else {
-			if sobj, ok := obj.(types.Serializable); ok {
+			if sobj, ok := obj.(types.Serializable); ok && bz != nil {
+				ts.root.SetSerializedObj(key, sobj, bz)
+			} else if ok {
 				ts.root.SetObj(key, sobj)
 			} else {
 				ts.root.Set(key, obj.([]byte))
@@ -160,6 +337,21 @@ func (ts *TrunkStore) Close(writeBack bool) {
 	ts.root = nil
 }
 
+// Get the proof of key's existence or absence in the committed state, i.e., the changes in this
+// TrunkStore are not included. It fails if the root store does not support proofs.
+func (ts *TrunkStore) GetProof(key []byte) (*onvakv.Proof, error) {
+	if atomic.LoadInt64(&ts.isWriting) != 0 {
+		panic("Is Writing")
+	}
+	prover, ok := ts.root.(interface {
+		GetProof(key []byte) (*onvakv.Proof, error)
+	})
+	if !ok {
+		return nil, onvakv.ErrProofUnavailable
+	}
+	return prover.GetProof(key)
+}
+
 func (ts *TrunkStore) ActiveCount() int {
 	return ts.root.ActiveCount()
 }
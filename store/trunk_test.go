@@ -1,13 +1,16 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/coinexchain/onvakv"
+	"github.com/coinexchain/onvakv/metrics"
 	"github.com/coinexchain/onvakv/store/types"
+	onvakvtypes "github.com/coinexchain/onvakv/types"
 )
 
 type TestOp struct {
@@ -76,16 +79,15 @@ func getListDel() []TestOp {
 }
 
 func TestTrunk(t *testing.T) {
-	okv := onvakv.NewOnvaKV4Mock()
 	first := []byte{0}
 	last := []byte{255,255,255,255,255,255}
-	okv.InitGuards(first, last)
+	okv := onvakv.NewOnvaKV4Mock([][]byte{first, last})
 
 	root := NewRootStore(okv, nil, func(k []byte) bool {
 		return k[0] != byte('0')
 	})
 	root.SetHeight(1)
-	ts := root.GetTrunkStore()
+	ts := root.GetTrunkStore().(*TrunkStore)
 
 	list1 := getListAdd()
 	runList(ts, list1)
@@ -159,7 +161,7 @@ func TestTrunk(t *testing.T) {
 	ts.Close(true)
 
 	root.SetHeight(2)
-	ts = root.GetTrunkStore()
+	ts = root.GetTrunkStore().(*TrunkStore)
 	check1()
 
 	//=========
@@ -211,7 +213,7 @@ func TestTrunk(t *testing.T) {
 	ts.Close(true)
 
 	root.SetHeight(3)
-	ts = root.GetTrunkStore()
+	ts = root.GetTrunkStore().(*TrunkStore)
 	check2()
 
 	ts.Close(false)
@@ -220,3 +222,110 @@ func TestTrunk(t *testing.T) {
 	os.RemoveAll("./rocksdb.db")
 }
 
+// The keys written with TrunkStore.Update are prepared by writeBack
+func TestWriteBackWithoutPrepare(t *testing.T) {
+	root := NewMockRootStore()
+	trunk := root.GetTrunkStore().(*TrunkStore)
+	trunk.PrepareForUpdate([]byte("k0"))
+	trunk.Update(func(cache *CacheStore) {
+		cache.Set([]byte("k0"), []byte("v0"))
+		cache.Set([]byte("k1"), []byte("v1"))
+		cache.Set([]byte("k2"), []byte("v2"))
+	})
+	trunk.Close(true)
+	assert.Equal(t, []byte("v1"), root.Get([]byte("k1")))
+
+	trunk = root.GetTrunkStore().(*TrunkStore)
+	trunk.PrepareForUpdate([]byte("k1")) // prepared for update, but deleted
+	trunk.Update(func(cache *CacheStore) {
+		cache.Delete([]byte("k1"))
+		cache.Delete([]byte("k2"))
+	})
+	trunk.Close(true)
+	assert.Nil(t, root.Get([]byte("k1")))
+	assert.Nil(t, root.Get([]byte("k2")))
+	assert.Equal(t, []byte("v0"), root.Get([]byte("k0")))
+}
+
+type countedCoord struct {
+	Coord
+	serialized *int
+}
+
+func (coord *countedCoord) ToBytes() []byte {
+	*coord.serialized++
+	return coord.Coord.ToBytes()
+}
+
+func (coord *countedCoord) DeepCopy() interface{} {
+	return &countedCoord{Coord: coord.Coord, serialized: coord.serialized}
+}
+
+// The bytes serialized by TrySetObj to check the size are written back to the root store
+func TestSerializeOnce(t *testing.T) {
+	okv := onvakv.NewOnvaKV4Mock([][]byte{{0}, {255, 255, 255, 255, 255, 255}})
+	root := NewRootStore(okv, nil, func(k []byte) bool { return false })
+	root.SetHeight(1)
+	ts := root.GetTrunkStore().(*TrunkStore)
+	serialized := 0
+	ms := ts.Cached()
+	sp := ms.Savepoint()
+	ms.SetObj([]byte("obj"), &countedCoord{Coord: Coord{x: 1, y: 2}, serialized: &serialized})
+	assert.Equal(t, 1, serialized)
+	ms.SetObj([]byte("obj"), &countedCoord{Coord: Coord{x: 3, y: 4}, serialized: &serialized})
+	ms.RollbackTo(sp)
+	ms.SetObj([]byte("obj"), &countedCoord{Coord: Coord{x: 5, y: 6}, serialized: &serialized})
+	ms.Close(true)
+	ts.Close(true)
+	assert.Equal(t, 3, serialized)
+	assert.Equal(t, (&Coord{x: 5, y: 6}).ToBytes(), root.Get([]byte("obj")))
+
+	var ptr types.Serializable = &Coord{}
+	root.GetObjCopy([]byte("obj"), &ptr)
+	assert.Equal(t, &Coord{x: 5, y: 6}, ptr)
+	assert.Equal(t, 3, serialized)
+	okv.Close()
+	os.RemoveAll("./rocksdb.db")
+}
+
+func TestRootStoreTryFuncs(t *testing.T) {
+	guard := []byte{255, 255, 255, 255, 255, 255}
+	okv := onvakv.NewOnvaKV4Mock([][]byte{{0}, guard})
+	root := NewRootStore(okv, nil, func(k []byte) bool { return false })
+	root.SetHeight(1)
+	ts := root.GetTrunkStore().(*TrunkStore)
+	assert.True(t, errors.Is(ts.TryPrepareForUpdate(guard), onvakvtypes.ErrGuardKey))
+	assert.True(t, errors.Is(ts.TryPrepareForDeletion(nil), onvakvtypes.ErrEmptyKey))
+	assert.Panics(t, func() { ts.PrepareForUpdate(guard) })
+	ts.Close(false)
+
+	assert.Nil(t, root.TryPrepareForUpdate([]byte("key")))
+	root.BeginWrite()
+	tooLong := make([]byte, onvakvtypes.DefaultMaxValueLength+1)
+	assert.True(t, errors.Is(root.TrySet([]byte("key"), tooLong), onvakvtypes.ErrValueTooLong))
+	assert.True(t, errors.Is(root.TryDelete(guard), onvakvtypes.ErrGuardKey))
+	assert.Panics(t, func() { root.Set(guard, nil) })
+	assert.Nil(t, root.TrySetObj([]byte("key"), &Coord{x: 1, y: 2}))
+	root.EndWrite()
+	assert.Equal(t, (&Coord{x: 1, y: 2}).ToBytes(), root.Get([]byte("key")))
+	okv.Close()
+	os.RemoveAll("./rocksdb.db")
+}
+
+// The TrunkStores created before RootStore.SetMetrics report to the new registry
+func TestWriteBackMetrics(t *testing.T) {
+	okv := onvakv.NewOnvaKV4Mock([][]byte{{0}, {255, 255, 255, 255, 255, 255}})
+	root := NewRootStore(okv, nil, func(k []byte) bool { return false })
+	root.SetHeight(1)
+	ts := root.GetTrunkStore().(*TrunkStore)
+	reg := metrics.NewMemRegistry()
+	root.SetMetrics(reg)
+	ts.Update(func(cache *CacheStore) {
+		cache.Set([]byte("key"), []byte("value"))
+	})
+	ts.Close(true)
+	assert.Equal(t, int64(1), reg.Count(metrics.TrunkWriteBackSecs))
+	assert.Equal(t, int64(1), reg.Count(metrics.RootStoreCacheBytes))
+	okv.Close()
+	os.RemoveAll("./rocksdb.db")
+}
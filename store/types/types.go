@@ -58,6 +58,11 @@ type KObjStore interface {
 	Set(key, value []byte)
 	SetObj(key []byte, obj Serializable)
 	Delete(key []byte)
+
+	// Like Set, SetObj and Delete, but return an error instead of panicking on invalid input
+	TrySet(key, value []byte) error
+	TrySetObj(key []byte, obj Serializable) error
+	TryDelete(key []byte) error
 }
 
 type RootStoreI interface {
@@ -67,14 +72,27 @@ type RootStoreI interface {
 	GetObjCopy(key []byte, ptr *Serializable)
 	GetReadOnlyObj(key []byte, ptr *Serializable)
 	Has(key []byte) bool
+	// Check whether key and value can be written. When value is nil, only key is checked.
+	CheckKV(key, value []byte) error
 	PrepareForUpdate(key []byte)
 	PrepareForDeletion(key []byte)
+	// Like PrepareForUpdate and PrepareForDeletion, but return an error instead of panicking on invalid input
+	TryPrepareForUpdate(key []byte) error
+	TryPrepareForDeletion(key []byte) error
+	// Check whether the keys in [start, end) can be deleted by DeleteRange
+	CheckRange(start, end []byte) error
+	PrepareForDeleteRange(start, end []byte)
 	Iterator(start, end []byte) ObjIterator
 	ReverseIterator(start, end []byte) ObjIterator
 	BeginWrite()
 	Set(key, value []byte)
 	SetObj(key []byte, obj Serializable)
+	// Like SetObj, but bz is what obj.ToBytes() returns, so obj need not be serialized again
+	SetSerializedObj(key []byte, obj Serializable, bz []byte)
 	Delete(key []byte)
+	// Delete all the keys in [start, end) before the Set and Delete operations in this block.
+	// The range must be prepared, but the keys in it need not be.
+	DeleteRange(start, end []byte)
 	EndWrite()
 	CheckConsistency()
 	Close()
@@ -0,0 +1,82 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of invalid input. Use errors.Is to check whether an error returned by
+// the CheckKV/TrySet functions is of some kind.
+var (
+	ErrEmptyKey      = errors.New("empty key")
+	ErrKeyTooLong    = errors.New("key too long")
+	ErrValueTooLong  = errors.New("value too long")
+	ErrNilValue      = errors.New("nil value")
+	ErrGuardKey      = errors.New("key collides with a guard key")
+	ErrKeyOutOfRange = errors.New("key out of range")
+	ErrNoKeySpace    = errors.New("key space does not exist")
+	ErrKeySpaceKey   = errors.New("key is reserved for key spaces")
+)
+
+const (
+	DefaultMaxKeyLength   = 8192
+	DefaultMaxValueLength = 8 * 1024 * 1024
+
+	keyLengthInError = 32 // at most so many bytes of the key are kept in KVError
+)
+
+// KVError describes an invalid key-value pair
+type KVError struct {
+	Kind  error
+	Key   []byte // the leading bytes of the key
+	Size  int    // the size of the key or value, when Kind is ErrKeyTooLong or ErrValueTooLong
+	Limit int
+}
+
+func NewKVError(kind error, key []byte, size, limit int) *KVError {
+	if len(key) > keyLengthInError {
+		key = key[:keyLengthInError]
+	}
+	return &KVError{
+		Kind:  kind,
+		Key:   append([]byte{}, key...),
+		Size:  size,
+		Limit: limit,
+	}
+}
+
+func (e *KVError) Error() string {
+	if e.Kind == ErrKeyTooLong || e.Kind == ErrValueTooLong {
+		return fmt.Sprintf("%s: %d > %d, key=%X", e.Kind, e.Size, e.Limit, e.Key)
+	}
+	return fmt.Sprintf("%s: key=%X", e.Kind, e.Key)
+}
+
+func (e *KVError) Unwrap() error {
+	return e.Kind
+}
+
+// KVLimits limits the sizes of keys and values
+type KVLimits struct {
+	MaxKeyLength   int
+	MaxValueLength int
+}
+
+var DefaultKVLimits = KVLimits{
+	MaxKeyLength:   DefaultMaxKeyLength,
+	MaxValueLength: DefaultMaxValueLength,
+}
+
+// Check the sizes of key and value. When value is nil, only key is checked.
+func (l KVLimits) CheckKV(key, value []byte) error {
+	if len(key) == 0 {
+		return NewKVError(ErrEmptyKey, key, 0, 0)
+	}
+	if len(key) > l.MaxKeyLength {
+		return NewKVError(ErrKeyTooLong, key, len(key), l.MaxKeyLength)
+	}
+	if len(value) > l.MaxValueLength {
+		return NewKVError(ErrValueTooLong, key, len(value), l.MaxValueLength)
+	}
+	return nil
+}
@@ -1,5 +1,12 @@
 package types
 
+import (
+	"context"
+
+	"github.com/coinexchain/onvakv/logging"
+	"github.com/coinexchain/onvakv/metrics"
+)
+
 type Entry struct {
 	Key        []byte
 	Value      []byte
@@ -15,11 +22,39 @@ type EntryX struct {
 	DeactivedSNList []int64
 }
 
+// EntryFormat selects how a datatree serializes new entries. The zero value keeps the legacy
+// (version 0) layout; any other value writes version 1 entries. Entries of both versions can
+// be mixed in one file, and a leaf's hash always covers the bytes as they are stored.
+type EntryFormat struct {
+	// Compress values with snappy, when it makes them shorter
+	Compression Compression
+	// Values shorter than this are never compressed
+	MinCompressLen int
+	// Store NextKey as the length of its common prefix with Key plus the remaining suffix
+	DeltaNextKey bool
+}
+
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+)
+
+// Pos carries the hint of the entry's length, like the positions returned by AppendEntry
 type KeyAndPos struct {
 	Key []byte
 	Pos int64
 }
 
+// The runs of records scanned by DataTree.ScanSortedRunsCtx
+type SortedRuns interface {
+	// Return the next record in the ascending order of keys, or false after the last one
+	Next() (KeyAndPos, bool)
+	// Release the runs, including the ones spilled to disk
+	Close()
+}
+
 type OperationOnEntry int32
 
 const (
@@ -46,6 +81,7 @@ type Iterator interface {
 
 type IndexTree interface {
 	Init(repFn func([]byte)) error
+	InitCtx(ctx context.Context, repFn func([]byte)) error
 	ActiveCount() int
 	BeginWrite(height int64)
 	EndWrite()
@@ -56,6 +92,8 @@ type IndexTree interface {
 	Set(k []byte, v uint64)
 	Delete(k []byte)
 	Close()
+	SetMetrics(reg metrics.Registry)
+	SetLogger(logger logging.Logger)
 }
 
 type EntryHandler func(pos int64, entry *Entry, deactivedSNList []int64)
@@ -65,23 +103,40 @@ type DataTree interface {
 	AppendEntry(entry *Entry) int64
 	AppendEntryRawBytes(entryBz []byte, sn int64) int64
 	ReadEntry(pos int64) *Entry
+	// Read the entries at many positions at once, which is faster than ReadEntry on SSDs
+	ReadEntries(positions []int64) []*Entry
 	GetActiveBit(sn int64) bool
 	EvictTwig(twigID int64)
 	GetActiveEntriesInTwig(twigID int64) chan []byte
 	ScanEntries(oldestActiveTwigID int64, outChan chan EntryX)
 	ScanEntriesLite(oldestActiveTwigID int64, outChan chan KeyAndPos)
+	// The following three functions close outChan when they return. They return ctx.Err()
+	// if ctx is cancelled before all the entries are sent.
+	GetActiveEntriesInTwigCtx(ctx context.Context, twigID int64, outChan chan []byte) error
+	ScanEntriesCtx(ctx context.Context, oldestActiveTwigID int64, outChan chan EntryX) error
+	ScanEntriesLiteCtx(ctx context.Context, oldestActiveTwigID int64, outChan chan KeyAndPos) error
+	// Scan the entries with many workers, returning their runs of records merged in the order of keys
+	ScanSortedRunsCtx(ctx context.Context, oldestActiveTwigID int64, workers int) (SortedRuns, error)
+	// Return the raw bytes of the entry at pos and the proof of its existence, or a nil proof
+	// if it is unavailable. An error is returned if the proof can not be read correctly.
+	GetProofBytes(pos int64) (entryBz, proofBz []byte, err error)
 	TwigCanBePruned(twigID int64) bool
 	PruneTwigs(startID, endID int64) []byte
 	GetFileSizes() (int64, int64)
+	// Change the format of the entries appended afterwards
+	SetEntryFormat(format EntryFormat)
 	EndBlock() []byte
 	Flush()
 	Close()
+	SetMetrics(reg metrics.Registry)
+	SetLogger(logger logging.Logger)
 }
 
 type MetaDB interface {
 	Commit()
 	ReloadFromKVDB()
 	PrintInfo()
+	SetLogger(logger logging.Logger)
 
 	SetCurrHeight(h int64)
 	GetCurrHeight() int64